@@ -16,7 +16,7 @@ import { ping } from "@libp2p/ping";
 //FIXME: Sometimes the room will wait to say offline, then appear to be online after retrying :D
 // This works for me, with my trashy internet, does it work for you as well?
 
-const NESTRI_PROTOCOL_STREAM_REQUEST = "/nestri-relay/stream-request/1.0.0";
+const NESTRI_PROTOCOL_STREAM_PARTICIPANT = "/nestri-relay/stream-participant/1.0.0";
 
 export class WebRTCStream {
   private _p2p: Libp2p | undefined = undefined;
@@ -87,7 +87,7 @@ export class WebRTCStream {
     if (this._p2pConn) {
       console.log("Stream is being established");
       let stream = await this._p2pConn
-        .newStream(NESTRI_PROTOCOL_STREAM_REQUEST)
+        .newStream(NESTRI_PROTOCOL_STREAM_PARTICIPANT)
         .catch(console.error);
       if (stream) {
         this._p2pSafeStream = new SafeStream(stream);
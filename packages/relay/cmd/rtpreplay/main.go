@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"relay/internal/common"
+	"relay/internal/pusher"
+	"relay/internal/shared"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// rtpreplay pushes a room capture of a relay into a relay, as if it came from a live runner.
+// Packets go out in captured order with captured timing, a runner reconnect within the capture continues
+// the same pushed tracks like the relay does for real reconnects
+
+const pushTimeout = 30 * time.Second // Timeout for the relay to accept and connect the push
+
+// replayTrack is a pushed track fed by captured tracks of the same kind and simulcast layer
+type replayTrack struct {
+	local    *webrtc.TrackLocalStaticRTP
+	sender   *webrtc.RTPSender
+	rewriter *common.RTPRewriter
+	source   uint8 // Capture track ID of the latest written packet
+
+	// Negotiated header extensions, simulcast layers are told apart by these
+	midExtID uint8
+	ridExtID uint8
+	mid      string
+}
+
+func main() {
+	capturePath := flag.String("capture", "", "Capture file to replay")
+	relayAddr := flag.String("relay", "", "Multiaddr of the relay to push to, including its peer ID")
+	roomName := flag.String("room", "", "Room to push to, the captured room if empty")
+	loop := flag.Bool("loop", false, "Replay the capture over and over")
+	verbose := flag.Bool("verbose", false, "Verbose mode")
+	flag.Parse()
+
+	logLevel := slog.LevelInfo
+	if *verbose {
+		logLevel = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(&common.CustomHandler{Handler: slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: logLevel,
+	})}))
+
+	if len(*capturePath) == 0 || len(*relayAddr) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := replay(ctx, *capturePath, *relayAddr, *roomName, *loop); err != nil && !errors.Is(err, context.Canceled) {
+		slog.Error("Failed to replay capture", "err", err)
+		os.Exit(1)
+	}
+}
+
+// replay pushes a capture to a relay until it ends, or forever if looping
+func replay(ctx context.Context, capturePath string, relayAddr string, roomName string, loop bool) error {
+	info, captured, err := readTracks(capturePath)
+	if err != nil {
+		return err
+	}
+	if len(roomName) == 0 {
+		roomName = info.Room
+	}
+	slog.Info("Replaying capture", "room", roomName, "captured_room", info.Room, "captured_at", info.StartedAt, "tracks", len(captured))
+
+	push, err := pusher.New(ctx, relayAddr, roomName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = push.Close()
+	}()
+
+	tracks, err := addTracks(push, captured)
+	if err != nil {
+		return err
+	}
+	startCtx, cancel := context.WithTimeout(ctx, pushTimeout)
+	err = push.Start(startCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	pushed := make(map[*replayTrack]bool)
+	for _, track := range tracks {
+		if !pushed[track] {
+			pushed[track] = true
+			track.negotiated(push)
+			go track.readRTCP()
+		}
+	}
+
+	for {
+		if err = replayOnce(ctx, push, capturePath, tracks); err != nil || !loop {
+			return err
+		}
+		slog.Info("Capture ended, replaying again", "room", roomName)
+		for track := range pushed {
+			track.rewriter.SwitchSource()
+		}
+	}
+}
+
+// readTracks reads the info of a capture and descriptions of its tracks
+func readTracks(capturePath string) (shared.CaptureInfo, []shared.CaptureTrack, error) {
+	reader, err := shared.OpenCapture(capturePath)
+	if err != nil {
+		return shared.CaptureInfo{}, nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	var tracks []shared.CaptureTrack
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return reader.Info, nil, err
+		}
+		if record.Type != shared.CaptureRecordTrack {
+			continue
+		}
+		var track shared.CaptureTrack
+		if err = json.Unmarshal(record.Data, &track); err != nil {
+			return reader.Info, nil, fmt.Errorf("failed to read captured track: %w", err)
+		}
+		tracks = append(tracks, track)
+	}
+	if len(tracks) == 0 {
+		return reader.Info, nil, errors.New("capture has no tracks")
+	}
+	return reader.Info, tracks, nil
+}
+
+// addTracks adds a pushed track per kind and simulcast layer of the captured tracks, returned by capture track ID
+func addTracks(push *pusher.Pusher, captured []shared.CaptureTrack) (map[uint8]*replayTrack, error) {
+	tracks := make(map[uint8]*replayTrack)
+	byLayer := make(map[string]*replayTrack)
+	videoSenders := make(map[string]*webrtc.RTPSender) // kind -> sender of the simulcast layers
+	for _, capturedTrack := range captured {
+		layer := capturedTrack.Kind + "/" + capturedTrack.RID
+		if track, ok := byLayer[layer]; ok {
+			// Runner reconnected during the capture, which can't change codecs within a push
+			if !strings.EqualFold(track.local.Codec().MimeType, capturedTrack.MimeType) {
+				slog.Warn("Skipping captured track with another codec than the first of its kind",
+					"track", capturedTrack.ID, "kind", capturedTrack.Kind, "codec", capturedTrack.MimeType)
+				continue
+			}
+			tracks[capturedTrack.ID] = track
+			continue
+		}
+
+		var options []func(*webrtc.TrackLocalStaticRTP)
+		if len(capturedTrack.RID) > 0 {
+			options = append(options, webrtc.WithRTPStreamID(capturedTrack.RID))
+		}
+		local, err := webrtc.NewTrackLocalStaticRTP(capturedTrack.Codec(), capturedTrack.Kind, "nestri-replay", options...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s track: %w", capturedTrack.Kind, err)
+		}
+		track := &replayTrack{
+			local:    local,
+			rewriter: common.NewRTPRewriter(capturedTrack.ClockRate),
+		}
+		if sender, ok := videoSenders[capturedTrack.Kind]; ok && len(capturedTrack.RID) > 0 {
+			// Further simulcast layers are encodings of the same sender
+			if err = sender.AddEncoding(local); err != nil {
+				return nil, fmt.Errorf("failed to add simulcast layer %s: %w", capturedTrack.RID, err)
+			}
+			track.sender = sender
+		} else {
+			if track.sender, err = push.AddTrack(local); err != nil {
+				return nil, fmt.Errorf("failed to add %s track: %w", capturedTrack.Kind, err)
+			}
+			if len(capturedTrack.RID) > 0 {
+				videoSenders[capturedTrack.Kind] = track.sender
+			}
+		}
+		slog.Debug("Pushing captured track", "track", capturedTrack.ID, "kind", capturedTrack.Kind,
+			"codec", capturedTrack.MimeType, "rid", capturedTrack.RID)
+		byLayer[layer] = track
+		tracks[capturedTrack.ID] = track
+	}
+	return tracks, nil
+}
+
+// replayOnce writes the packets of a capture with their captured timing
+func replayOnce(ctx context.Context, push *pusher.Pusher, capturePath string, tracks map[uint8]*replayTrack) error {
+	reader, err := shared.OpenCapture(capturePath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	var firstOffset time.Duration
+	var startedAt time.Time
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Runner RTCP is generated anew by the push, relay RTCP is only informative
+		if record.Type != shared.CaptureRecordRTP {
+			continue
+		}
+		track, ok := tracks[record.Track]
+		if !ok {
+			continue
+		}
+
+		if startedAt.IsZero() {
+			firstOffset = record.Offset
+			startedAt = time.Now()
+		}
+		select {
+		case <-time.After(time.Until(startedAt.Add(record.Offset - firstOffset))):
+		case <-push.Done():
+			return errors.New("relay ended the push")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		packet := &rtp.Packet{}
+		if err = packet.Unmarshal(record.Data); err != nil {
+			slog.Warn("Skipping malformed captured RTP packet", "track", record.Track, "err", err)
+			continue
+		}
+		if err = track.write(record.Track, packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			return fmt.Errorf("failed to write RTP: %w", err)
+		}
+	}
+}
+
+// negotiated picks up the negotiated media ID and header extensions of the track
+func (t *replayTrack) negotiated(push *pusher.Pusher) {
+	t.mid = push.Mid(t.sender)
+	for _, extension := range t.sender.GetParameters().HeaderExtensions {
+		switch extension.URI {
+		case sdp.SDESMidURI:
+			t.midExtID = uint8(extension.ID)
+		case sdp.SDESRTPStreamIDURI:
+			t.ridExtID = uint8(extension.ID)
+		}
+	}
+}
+
+// write writes a captured packet of given capture track
+func (t *replayTrack) write(source uint8, packet *rtp.Packet) error {
+	if t.source != 0 && t.source != source {
+		// Runner reconnected in the capture
+		t.rewriter.SwitchSource()
+	}
+	t.source = source
+	t.rewriter.Rewrite(packet)
+
+	// Captured extensions carry IDs negotiated with the runner, not ours
+	packet.Extension = false
+	packet.ExtensionProfile = 0
+	packet.Extensions = nil
+	if rid := t.local.RID(); len(rid) > 0 && t.midExtID != 0 && t.ridExtID != 0 {
+		// Relay tells simulcast layers apart by these
+		if err := packet.SetExtension(t.midExtID, []byte(t.mid)); err != nil {
+			return err
+		}
+		if err := packet.SetExtension(t.ridExtID, []byte(rid)); err != nil {
+			return err
+		}
+	}
+	return t.local.WriteRTP(packet)
+}
+
+// readRTCP reads RTCP of the relay for the track, so NACKs get answered, until the push ends
+func (t *replayTrack) readRTCP() {
+	for {
+		var err error
+		if rid := t.local.RID(); len(rid) > 0 {
+			_, _, err = t.sender.ReadSimulcastRTCP(rid)
+		} else {
+			_, _, err = t.sender.ReadRTCP()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
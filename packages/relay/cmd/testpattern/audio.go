@@ -0,0 +1,40 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"errors"
+)
+
+// --- Test Tone ---
+// A 440 Hz sine tone as Opus, pre-encoded since encoding Opus in Go would need cgo bindings to libopus.
+// tone.opus holds one second of it as 50 mono CELT-only packets of 20ms, each prefixed by its length as
+// big-endian uint16. One second is a whole number of periods, so the packets loop without a seam
+
+//go:embed tone.opus
+var toneOpus []byte
+
+const (
+	toneSampleRate = 48000 // Opus RTP clock rate, whatever the encoded bandwidth
+	toneChannels   = 2     // Opus is always signaled as stereo in SDP, the packets themselves are mono
+)
+
+// loadTone splits the embedded tone into its packets
+func loadTone() ([][]byte, error) {
+	var packets [][]byte
+	for data := toneOpus; len(data) > 0; {
+		if len(data) < 2 {
+			return nil, errors.New("truncated tone packet length")
+		}
+		size := int(binary.BigEndian.Uint16(data))
+		if size == 0 || len(data) < 2+size {
+			return nil, errors.New("truncated tone packet")
+		}
+		packets = append(packets, data[2:2+size])
+		data = data[2+size:]
+	}
+	if len(packets) == 0 {
+		return nil, errors.New("no tone packets")
+	}
+	return packets, nil
+}
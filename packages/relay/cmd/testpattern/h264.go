@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"math/bits"
+)
+
+// --- H.264 Encoder ---
+// A minimal lossless constrained baseline encoder. Flat macroblocks matching their neighbors are predicted from
+// them without residual, others are sent as raw I_PCM samples, and frames after a keyframe skip unchanged
+// macroblocks. Deblocking is off, so decoded frames match the source exactly. Keyframes of a mostly flat test
+// pattern stay small enough to not be bursts of hundreds of packets
+
+const (
+	h264ProfileBaseline    = 66
+	h264ConstrainedFlags   = 0xC0 // constraint_set0_flag and constraint_set1_flag, constrained baseline
+	h264Level              = 31   // Level 3.1, matching the commonly negotiated profile-level-id 42e01f
+	h264Log2MaxFrameNum    = 4
+	h264MacroblockSize     = 16
+	h264MacroblockSamples  = 16*16 + 2*8*8 // I_PCM samples of a 4:2:0 macroblock
+	h264SliceTypeP         = 5             // P, all slices of the picture are P
+	h264SliceTypeI         = 7             // I, all slices of the picture are I
+	h264MacroblockI16x16DC = 3             // I_16x16_2_0_0 mb_type in I slices, DC prediction without residual
+	h264MacroblockIPCM     = 25            // I_PCM mb_type in I slices
+	h264MacroblockIntraInP = 5             // Offset of intra mb_types in P slices, they follow the 5 P types
+	h264NalSlice           = 1
+	h264NalIDR             = 5
+	h264NalSPS             = 7
+	h264NalPPS             = 8
+	h264NalRefIdcReference = 3
+)
+
+// frameYUV is a 4:2:0 frame with dimensions padded to whole macroblocks
+type frameYUV struct {
+	width, height int // padded to whole macroblocks
+	y, cb, cr     []byte
+}
+
+func newFrameYUV(width, height int) *frameYUV {
+	return &frameYUV{
+		width:  width,
+		height: height,
+		y:      make([]byte, width*height),
+		cb:     make([]byte, width*height/4),
+		cr:     make([]byte, width*height/4),
+	}
+}
+
+// macroblock appends the I_PCM samples of a macroblock, luma then both chroma planes, in raster order
+func (f *frameYUV) macroblock(dst []byte, mbX, mbY int) []byte {
+	for row := 0; row < 16; row++ {
+		start := (mbY*16+row)*f.width + mbX*16
+		dst = append(dst, f.y[start:start+16]...)
+	}
+	for _, plane := range [][]byte{f.cb, f.cr} {
+		for row := 0; row < 8; row++ {
+			start := (mbY*8+row)*(f.width/2) + mbX*8
+			dst = append(dst, plane[start:start+8]...)
+		}
+	}
+	return dst
+}
+
+// macroblockKind is how a macroblock was coded
+type macroblockKind uint8
+
+const (
+	macroblockSkip macroblockKind = iota
+	macroblockI16x16DC
+	macroblockIPCM
+)
+
+// h264Encoder encodes frames of a fixed size into Annex-B access units
+type h264Encoder struct {
+	width, height int // visible size
+	mbWidth       int
+	mbHeight      int
+	frameNum      uint32
+	idrPicID      uint32
+	previous      *frameYUV // last encoded frame, the reference of the next one
+	samples       []byte
+	kinds         []macroblockKind // of the frame being encoded, in raster order
+}
+
+func newH264Encoder(width, height int) *h264Encoder {
+	e := &h264Encoder{
+		width:    width,
+		height:   height,
+		mbWidth:  (width + h264MacroblockSize - 1) / h264MacroblockSize,
+		mbHeight: (height + h264MacroblockSize - 1) / h264MacroblockSize,
+		samples:  make([]byte, 0, h264MacroblockSamples),
+	}
+	e.kinds = make([]macroblockKind, e.mbWidth*e.mbHeight)
+	return e
+}
+
+// newFrame returns a frame sized for the encoder
+func (e *h264Encoder) newFrame() *frameYUV {
+	return newFrameYUV(e.mbWidth*h264MacroblockSize, e.mbHeight*h264MacroblockSize)
+}
+
+// encode encodes a frame, as a keyframe with parameter sets if asked or if there's no reference yet.
+// The frame must not be changed afterwards, it's kept as reference
+func (e *h264Encoder) encode(frame *frameYUV, keyframe bool) []byte {
+	var accessUnit bytes.Buffer
+	if keyframe || e.previous == nil {
+		writeNal(&accessUnit, h264NalRefIdcReference, h264NalSPS, e.sps())
+		writeNal(&accessUnit, h264NalRefIdcReference, h264NalPPS, e.pps())
+		writeNal(&accessUnit, h264NalRefIdcReference, h264NalIDR, e.slice(frame, true))
+		e.frameNum = 1
+		e.idrPicID = (e.idrPicID + 1) % 2 // consecutive IDR pictures must differ
+	} else {
+		writeNal(&accessUnit, h264NalRefIdcReference, h264NalSlice, e.slice(frame, false))
+		e.frameNum = (e.frameNum + 1) % (1 << h264Log2MaxFrameNum)
+	}
+	e.previous = frame
+	return accessUnit.Bytes()
+}
+
+// sps returns the sequence parameter set RBSP
+func (e *h264Encoder) sps() []byte {
+	w := &bitWriter{}
+	w.writeBits(h264ProfileBaseline, 8)
+	w.writeBits(h264ConstrainedFlags, 8)
+	w.writeBits(h264Level, 8)
+	w.writeUE(0) // seq_parameter_set_id
+	w.writeUE(h264Log2MaxFrameNum - 4)
+	w.writeUE(2) // pic_order_cnt_type, output order is decoding order
+	w.writeUE(1) // max_num_ref_frames
+	w.writeBits(0, 1)
+	w.writeUE(uint32(e.mbWidth - 1))
+	w.writeUE(uint32(e.mbHeight - 1))
+	w.writeBits(1, 1)                                         // frame_mbs_only_flag
+	w.writeBits(1, 1)                                         // direct_8x8_inference_flag
+	cropRight := (e.mbWidth*h264MacroblockSize - e.width) / 2 // in chroma samples for 4:2:0
+	cropBottom := (e.mbHeight*h264MacroblockSize - e.height) / 2
+	if cropRight > 0 || cropBottom > 0 {
+		w.writeBits(1, 1)
+		w.writeUE(0)
+		w.writeUE(uint32(cropRight))
+		w.writeUE(0)
+		w.writeUE(uint32(cropBottom))
+	} else {
+		w.writeBits(0, 1)
+	}
+	w.writeBits(0, 1) // vui_parameters_present_flag
+	w.writeTrailingBits()
+	return w.bytes()
+}
+
+// pps returns the picture parameter set RBSP
+func (e *h264Encoder) pps() []byte {
+	w := &bitWriter{}
+	w.writeUE(0)      // pic_parameter_set_id
+	w.writeUE(0)      // seq_parameter_set_id
+	w.writeBits(0, 1) // entropy_coding_mode_flag, CAVLC
+	w.writeBits(0, 1) // bottom_field_pic_order_in_frame_present_flag
+	w.writeUE(0)      // num_slice_groups_minus1
+	w.writeUE(0)      // num_ref_idx_l0_default_active_minus1
+	w.writeUE(0)      // num_ref_idx_l1_default_active_minus1
+	w.writeBits(0, 1) // weighted_pred_flag
+	w.writeBits(0, 2) // weighted_bipred_idc
+	w.writeSE(0)      // pic_init_qp_minus26
+	w.writeSE(0)      // pic_init_qs_minus26
+	w.writeSE(0)      // chroma_qp_index_offset
+	w.writeBits(1, 1) // deblocking_filter_control_present_flag, to turn deblocking off in slices
+	w.writeBits(0, 1) // constrained_intra_pred_flag
+	w.writeBits(0, 1) // redundant_pic_cnt_present_flag
+	w.writeTrailingBits()
+	return w.bytes()
+}
+
+// slice returns the RBSP of a slice covering the whole frame
+func (e *h264Encoder) slice(frame *frameYUV, idr bool) []byte {
+	w := &bitWriter{}
+	w.writeUE(0) // first_mb_in_slice
+	if idr {
+		w.writeUE(h264SliceTypeI)
+	} else {
+		w.writeUE(h264SliceTypeP)
+	}
+	w.writeUE(0) // pic_parameter_set_id
+	if idr {
+		w.writeBits(0, h264Log2MaxFrameNum) // frame_num
+		w.writeUE(e.idrPicID)
+	} else {
+		w.writeBits(uint64(e.frameNum), h264Log2MaxFrameNum)
+		w.writeBits(0, 1) // num_ref_idx_active_override_flag
+		w.writeBits(0, 1) // ref_pic_list_modification_flag_l0
+	}
+	if idr {
+		w.writeBits(0, 1) // no_output_of_prior_pics_flag
+		w.writeBits(0, 1) // long_term_reference_flag
+	} else {
+		w.writeBits(0, 1) // adaptive_ref_pic_marking_mode_flag, sliding window
+	}
+	w.writeSE(0) // slice_qp_delta
+	w.writeUE(1) // disable_deblocking_filter_idc
+
+	intraOffset := uint32(0)
+	if !idr {
+		intraOffset = h264MacroblockIntraInP
+	}
+	skipped := uint32(0)
+	for mbY := 0; mbY < e.mbHeight; mbY++ {
+		for mbX := 0; mbX < e.mbWidth; mbX++ {
+			mb := mbY*e.mbWidth + mbX
+			e.samples = frame.macroblock(e.samples[:0], mbX, mbY)
+			if !idr {
+				if bytes.Equal(e.samples, e.previous.macroblock(nil, mbX, mbY)) {
+					e.kinds[mb] = macroblockSkip
+					skipped++
+					continue
+				}
+				w.writeUE(skipped) // mb_skip_run
+				skipped = 0
+			}
+			if predictable(frame, mbX, mbY) {
+				e.kinds[mb] = macroblockI16x16DC
+				w.writeUE(intraOffset + h264MacroblockI16x16DC)
+				w.writeUE(0)                                           // intra_chroma_pred_mode, DC
+				w.writeSE(0)                                           // mb_qp_delta
+				writeNoCoefficients(w, e.coefficientContext(mbX, mbY)) // Intra16x16DCLevel
+				continue
+			}
+			e.kinds[mb] = macroblockIPCM
+			w.writeUE(intraOffset + h264MacroblockIPCM)
+			w.alignZero() // pcm_alignment_zero_bit
+			w.writeBytes(e.samples)
+		}
+	}
+	if skipped > 0 {
+		w.writeUE(skipped)
+	}
+	w.writeTrailingBits()
+	return w.bytes()
+}
+
+// coefficientContext returns nC of the first luma block of a macroblock, which picks the coeff_token table.
+// Only I_PCM neighbors count, as 16 coefficients, the other coded kinds carry none
+func (e *h264Encoder) coefficientContext(mbX, mbY int) int {
+	total, available := 0, 0
+	if mbX > 0 {
+		if e.kinds[mbY*e.mbWidth+mbX-1] == macroblockIPCM {
+			total += 16
+		}
+		available++
+	}
+	if mbY > 0 {
+		if e.kinds[(mbY-1)*e.mbWidth+mbX] == macroblockIPCM {
+			total += 16
+		}
+		available++
+	}
+	if available == 2 {
+		return (total + 1) >> 1
+	}
+	return total
+}
+
+// writeNoCoefficients writes the coeff_token of a residual block without coefficients for given nC
+func writeNoCoefficients(w *bitWriter, nC int) {
+	switch {
+	case nC < 2:
+		w.writeBits(0b1, 1)
+	case nC < 4:
+		w.writeBits(0b11, 2)
+	case nC < 8:
+		w.writeBits(0b1111, 4)
+	default:
+		w.writeBits(0b000011, 6)
+	}
+}
+
+// predictable returns whether a macroblock is a single color that DC prediction from its decoded neighbors
+// reproduces exactly. Decoding is lossless, so the neighbors' source samples are what gets predicted from
+func predictable(frame *frameYUV, mbX, mbY int) bool {
+	chromaWidth := frame.width / 2
+	y := frame.y[mbY*16*frame.width+mbX*16]
+	cb := frame.cb[mbY*8*chromaWidth+mbX*8]
+	cr := frame.cr[mbY*8*chromaWidth+mbX*8]
+	flat := func(plane []byte, stride, x0, y0, w, h int, value byte) bool {
+		for row := y0; row < y0+h; row++ {
+			for col := x0; col < x0+w; col++ {
+				if plane[row*stride+col] != value {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if !flat(frame.y, frame.width, mbX*16, mbY*16, 16, 16, y) ||
+		!flat(frame.cb, chromaWidth, mbX*8, mbY*8, 8, 8, cb) || !flat(frame.cr, chromaWidth, mbX*8, mbY*8, 8, 8, cr) {
+		return false
+	}
+	if mbX == 0 && mbY == 0 {
+		// Nothing to predict from, DC prediction is mid gray
+		return y == 128 && cb == 128 && cr == 128
+	}
+	if mbX > 0 && (!flat(frame.y, frame.width, mbX*16-1, mbY*16, 1, 16, y) ||
+		!flat(frame.cb, chromaWidth, mbX*8-1, mbY*8, 1, 8, cb) || !flat(frame.cr, chromaWidth, mbX*8-1, mbY*8, 1, 8, cr)) {
+		return false
+	}
+	if mbY > 0 && (!flat(frame.y, frame.width, mbX*16, mbY*16-1, 16, 1, y) ||
+		!flat(frame.cb, chromaWidth, mbX*8, mbY*8-1, 8, 1, cb) || !flat(frame.cr, chromaWidth, mbX*8, mbY*8-1, 8, 1, cr)) {
+		return false
+	}
+	return true
+}
+
+// writeNal writes a NAL unit with Annex-B start code, escaping start code emulation in its RBSP
+func writeNal(dst *bytes.Buffer, refIdc byte, nalType byte, rbsp []byte) {
+	dst.Write([]byte{0, 0, 0, 1, refIdc<<5 | nalType})
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			dst.WriteByte(3) // emulation_prevention_three_byte
+			zeros = 0
+		}
+		dst.WriteByte(b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+}
+
+// bitWriter writes the bit strings of H.264 syntax elements
+type bitWriter struct {
+	buf  []byte
+	cur  byte
+	used uint8 // bits used of cur
+}
+
+func (w *bitWriter) writeBits(value uint64, count int) {
+	for i := count - 1; i >= 0; i-- {
+		w.cur = w.cur<<1 | byte(value>>uint(i)&1)
+		w.used++
+		if w.used == 8 {
+			w.buf = append(w.buf, w.cur)
+			w.cur, w.used = 0, 0
+		}
+	}
+}
+
+// writeUE writes an unsigned Exp-Golomb code
+func (w *bitWriter) writeUE(value uint32) {
+	length := bits.Len64(uint64(value) + 1)
+	w.writeBits(0, length-1)
+	w.writeBits(uint64(value)+1, length)
+}
+
+// writeSE writes a signed Exp-Golomb code
+func (w *bitWriter) writeSE(value int32) {
+	if value > 0 {
+		w.writeUE(uint32(2*value - 1))
+	} else {
+		w.writeUE(uint32(-2 * value))
+	}
+}
+
+// writeBytes writes whole bytes, the writer must be byte aligned
+func (w *bitWriter) writeBytes(data []byte) {
+	w.buf = append(w.buf, data...)
+}
+
+// alignZero writes zero bits up to the next byte boundary
+func (w *bitWriter) alignZero() {
+	if w.used > 0 {
+		w.writeBits(0, int(8-w.used))
+	}
+}
+
+// writeTrailingBits writes the RBSP stop bit and alignment
+func (w *bitWriter) writeTrailingBits() {
+	w.writeBits(1, 1)
+	w.alignZero()
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
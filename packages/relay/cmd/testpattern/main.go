@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+	"relay/internal/pusher"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"google.golang.org/protobuf/proto"
+)
+
+// testpattern pushes a synthetic room stream into a relay like a runner does, so rooms can be tested without
+// a runner and its GPU. Video is a test pattern encoded in software, audio a sine tone, and participant input
+// arriving on the data channel moves a cursor in the video
+
+const (
+	pushTimeout        = 30 * time.Second // Timeout for the relay to accept and connect the push
+	audioFrameDuration = 20 * time.Millisecond
+)
+
+// testPattern is a running synthetic push
+type testPattern struct {
+	push             *pusher.Pusher
+	video            *webrtc.TrackLocalStaticSample
+	videoSender      *webrtc.RTPSender
+	audio            *webrtc.TrackLocalStaticSample
+	forceKeyframe    atomic.Bool // Set when the relay asks for a keyframe
+	inputMutex       sync.Mutex
+	input            inputState
+	width, height    int
+	fps              int
+	keyframeInterval time.Duration
+}
+
+func main() {
+	relayAddr := flag.String("relay", "", "Multiaddr of the relay to push to, including its peer ID")
+	roomName := flag.String("room", "", "Room to push to")
+	width := flag.Int("width", 640, "Video width, must be even")
+	height := flag.Int("height", 360, "Video height, must be even")
+	fps := flag.Int("fps", 30, "Video frames per second")
+	keyframeInterval := flag.Duration("keyframeInterval", 2*time.Second, "Interval of periodic keyframes")
+	verbose := flag.Bool("verbose", false, "Verbose mode")
+	flag.Parse()
+
+	logLevel := slog.LevelInfo
+	if *verbose {
+		logLevel = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(&common.CustomHandler{Handler: slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		Level: logLevel,
+	})}))
+
+	if len(*relayAddr) == 0 || len(*roomName) == 0 || *width < cursorSize || *height < cursorSize ||
+		*width%2 != 0 || *height%2 != 0 || *fps <= 0 || *keyframeInterval <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	t := &testPattern{
+		width:            *width,
+		height:           *height,
+		fps:              *fps,
+		keyframeInterval: *keyframeInterval,
+		input:            inputState{cursorX: *width / 2, cursorY: *height / 2},
+	}
+	if err := t.run(ctx, *relayAddr, *roomName); err != nil && !errors.Is(err, context.Canceled) {
+		slog.Error("Failed to push test pattern", "err", err)
+		os.Exit(1)
+	}
+}
+
+// run pushes the test pattern to a relay until interrupted or the relay ends the push
+func (t *testPattern) run(ctx context.Context, relayAddr string, roomName string) error {
+	var err error
+	t.push, err = pusher.New(ctx, relayAddr, roomName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = t.push.Close()
+	}()
+
+	t.video, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}, "video", "nestri-testpattern")
+	if err != nil {
+		return fmt.Errorf("failed to create video track: %w", err)
+	}
+	if t.videoSender, err = t.push.AddTrack(t.video); err != nil {
+		return fmt.Errorf("failed to add video track: %w", err)
+	}
+	t.audio, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeOpus,
+		ClockRate: toneSampleRate,
+		Channels:  toneChannels,
+	}, "audio", "nestri-testpattern")
+	if err != nil {
+		return fmt.Errorf("failed to create audio track: %w", err)
+	}
+	if _, err = t.push.AddTrack(t.audio); err != nil {
+		return fmt.Errorf("failed to add audio track: %w", err)
+	}
+
+	ndc, err := t.push.CreateDataChannel()
+	if err != nil {
+		return fmt.Errorf("failed to create data channel: %w", err)
+	}
+	ndc.RegisterMessageCallback("input", t.handleInput)
+	ndc.RegisterMessageCallback("bitrate", func(data []byte) {
+		var msg gen.ProtoMessageBitrate
+		if err := proto.Unmarshal(data, &msg); err != nil {
+			slog.Error("Failed to decode bitrate message", "err", err)
+			return
+		}
+		// Software encoding has no rate control, the hint is only shown
+		slog.Info("Relay asked for bitrate", "room", roomName, "bitrate", msg.GetTargetBitrate())
+	})
+
+	startCtx, cancel := context.WithTimeout(ctx, pushTimeout)
+	err = t.push.Start(startCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	slog.Info("Pushing test pattern", "room", roomName, "width", t.width, "height", t.height, "fps", t.fps)
+
+	go t.readVideoRTCP()
+	go func() {
+		if err := t.pushAudio(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("Failed to push audio", "room", roomName, "err", err)
+			_ = t.push.Close()
+		}
+	}()
+	return t.pushVideo(ctx)
+}
+
+// pushVideo encodes and writes test pattern frames until the push ends
+func (t *testPattern) pushVideo(ctx context.Context) error {
+	encoder := newH264Encoder(t.width, t.height)
+	frames := [2]*frameYUV{encoder.newFrame(), encoder.newFrame()} // Encoder keeps the previous one as reference
+	pattern := newPattern(t.width, t.height, encoder.newFrame())
+	frameDuration := time.Second / time.Duration(t.fps)
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+
+	var lastKeyframe time.Time
+	for n := uint64(0); ; n++ {
+		select {
+		case <-ticker.C:
+		case <-t.push.Done():
+			return errors.New("relay ended the push")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		now := time.Now()
+		frame := frames[n%2]
+		t.inputMutex.Lock()
+		input := t.input
+		t.inputMutex.Unlock()
+		pattern.render(frame, n, now, input)
+
+		keyframe := t.forceKeyframe.Swap(false) || now.Sub(lastKeyframe) >= t.keyframeInterval
+		if keyframe {
+			lastKeyframe = now
+		}
+		sample := media.Sample{Data: encoder.encode(frame, keyframe), Duration: frameDuration}
+		if err := t.video.WriteSample(sample); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			return fmt.Errorf("failed to write video: %w", err)
+		}
+	}
+}
+
+// pushAudio writes the tone, looping it, until the push ends
+func (t *testPattern) pushAudio(ctx context.Context) error {
+	tone, err := loadTone()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(audioFrameDuration)
+	defer ticker.Stop()
+
+	for n := 0; ; n++ {
+		select {
+		case <-ticker.C:
+		case <-t.push.Done():
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		sample := media.Sample{Data: tone[n%len(tone)], Duration: audioFrameDuration}
+		if err := t.audio.WriteSample(sample); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			return err
+		}
+	}
+}
+
+// readVideoRTCP reads RTCP of the relay for the video track, answering keyframe requests, until the push ends
+func (t *testPattern) readVideoRTCP() {
+	for {
+		packets, _, err := t.videoSender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				slog.Debug("Relay asked for a keyframe", "room", t.push.Room)
+				t.forceKeyframe.Store(true)
+			}
+		}
+	}
+}
+
+// handleInput shows participant input in the video, the cursor follows the mouse and turns solid while
+// keys or buttons are held
+func (t *testPattern) handleInput(data []byte) {
+	var msg gen.ProtoMessageInput
+	if err := proto.Unmarshal(data, &msg); err != nil {
+		slog.Error("Failed to decode input message", "err", err)
+		return
+	}
+	input := msg.GetData()
+	slog.Debug("Received input", "room", t.push.Room, "input", input.String())
+
+	t.inputMutex.Lock()
+	defer t.inputMutex.Unlock()
+	switch {
+	case input.GetMouseMove() != nil:
+		t.input.cursorX = min(max(t.input.cursorX+int(input.GetMouseMove().GetX()), 0), t.width)
+		t.input.cursorY = min(max(t.input.cursorY+int(input.GetMouseMove().GetY()), 0), t.height)
+	case input.GetMouseMoveAbs() != nil:
+		t.input.cursorX = int(input.GetMouseMoveAbs().GetX())
+		t.input.cursorY = int(input.GetMouseMoveAbs().GetY())
+	case input.GetMouseKeyDown() != nil:
+		t.input.held++
+	case input.GetKeyDown() != nil:
+		t.input.held++
+		t.input.lastKey = input.GetKeyDown().GetKey()
+	case input.GetMouseKeyUp() != nil, input.GetKeyUp() != nil:
+		t.input.held = max(t.input.held-1, 0)
+	}
+}
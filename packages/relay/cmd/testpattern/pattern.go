@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// --- Test Pattern ---
+// Color bars with a bouncing box, a wall clock and frame counter for glass-to-glass latency checks, and a cursor
+// following participant input. Everything but the overlays stays put, so frames encode to few macroblocks
+
+// colorYUV is a BT.601 limited range color
+type colorYUV struct {
+	y, cb, cr byte
+}
+
+var (
+	colorBars = []colorYUV{ // 75% bars, white to blue
+		{180, 128, 128}, {162, 44, 142}, {131, 156, 44}, {112, 72, 58},
+		{84, 184, 198}, {65, 100, 212}, {35, 212, 114},
+	}
+	colorBackground = colorYUV{32, 128, 128}
+	colorText       = colorYUV{235, 128, 128}
+	colorBox        = colorYUV{235, 128, 128}
+	colorCursor     = colorYUV{235, 128, 128}
+	colorCursorHeld = colorYUV{81, 90, 240}
+)
+
+const (
+	boxSize         = 48
+	boxPeriod       = 4 * time.Second // Time for the box to cross the frame and back
+	cursorSize      = 16
+	clockScale      = 4 // Pixels per font pixel
+	counterScale    = 3
+	fontWidth       = 5
+	fontHeight      = 7
+	fontCharAdvance = fontWidth + 1
+)
+
+// font is a 5x7 bitmap font for the overlay text, rows top to bottom with the leftmost pixel in bit 4
+var font = map[rune][fontHeight]byte{
+	'0': {0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E},
+	'1': {0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'2': {0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F},
+	'3': {0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E},
+	'4': {0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02},
+	'5': {0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E},
+	'6': {0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E},
+	'7': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E},
+	'9': {0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C},
+	':': {0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x0C, 0x00},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x0C},
+	'#': {0x0A, 0x0A, 0x1F, 0x0A, 0x1F, 0x0A, 0x0A},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'E': {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x1F},
+	'Y': {0x11, 0x11, 0x0A, 0x04, 0x04, 0x04, 0x04},
+	'-': {0x00, 0x00, 0x00, 0x1F, 0x00, 0x00, 0x00},
+	' ': {},
+}
+
+// inputState is what the pattern shows of participant input
+type inputState struct {
+	cursorX, cursorY int
+	held             int   // Keys and mouse buttons held down
+	lastKey          int32 // Last key pressed, 0 if none yet
+}
+
+// pattern renders test pattern frames of a fixed size
+type pattern struct {
+	width, height int // visible size
+	background    *frameYUV
+	startedAt     time.Time
+}
+
+func newPattern(width, height int, frame *frameYUV) *pattern {
+	p := &pattern{
+		width:      width,
+		height:     height,
+		background: frame,
+		startedAt:  time.Now(),
+	}
+	fillRect(frame, 0, 0, frame.width, frame.height, colorBackground)
+	// Bar edges on macroblock edges keep bars cheap to encode
+	barWidth := (width/len(colorBars) + h264MacroblockSize - 1) &^ (h264MacroblockSize - 1)
+	for i, color := range colorBars {
+		fillRect(frame, i*barWidth, 0, barWidth, p.barsHeight(), color)
+	}
+	return p
+}
+
+// barsHeight returns the height of the color bars, the overlays are below
+func (p *pattern) barsHeight() int {
+	return p.height * 2 / 3 &^ (h264MacroblockSize - 1)
+}
+
+// render draws frame number n at given time into frame
+func (p *pattern) render(frame *frameYUV, n uint64, now time.Time, input inputState) {
+	copy(frame.y, p.background.y)
+	copy(frame.cb, p.background.cb)
+	copy(frame.cr, p.background.cr)
+
+	// Box bouncing along the bottom of the bars
+	phase := float64(now.Sub(p.startedAt)%boxPeriod) / float64(boxPeriod)
+	if phase > 0.5 {
+		phase = 1 - phase
+	}
+	boxX := int(phase * 2 * float64(p.width-boxSize))
+	fillRect(frame, boxX&^1, (p.barsHeight()-boxSize)&^1, boxSize, boxSize, colorBox)
+
+	// Wall clock and frame counter below the bars
+	textX := p.width / 16
+	clockY := p.barsHeight() + p.height/24
+	drawText(frame, textX, clockY, clockScale, now.Format("15:04:05.000"))
+	status := fmt.Sprintf("#%d", n)
+	if input.lastKey != 0 {
+		status += fmt.Sprintf("  KEY %d", input.lastKey)
+	}
+	drawText(frame, textX, clockY+(fontHeight+2)*clockScale, counterScale, status)
+
+	// Cursor, filled while keys or buttons are held
+	cursorColor := colorCursor
+	if input.held > 0 {
+		cursorColor = colorCursorHeld
+	}
+	x := min(max(input.cursorX, 0), p.width-cursorSize) &^ 1
+	y := min(max(input.cursorY, 0), p.height-cursorSize) &^ 1
+	if input.held > 0 {
+		fillRect(frame, x, y, cursorSize, cursorSize, cursorColor)
+	} else {
+		fillRect(frame, x, y, cursorSize, 2, cursorColor)
+		fillRect(frame, x, y+cursorSize-2, cursorSize, 2, cursorColor)
+		fillRect(frame, x, y, 2, cursorSize, cursorColor)
+		fillRect(frame, x+cursorSize-2, y, 2, cursorSize, cursorColor)
+	}
+}
+
+// fillRect fills a rectangle, chroma is set per 2x2 pixels so rectangles should start at even coordinates
+func fillRect(frame *frameYUV, x, y, w, h int, color colorYUV) {
+	x0, y0 := max(x, 0), max(y, 0)
+	x1, y1 := min(x+w, frame.width), min(y+h, frame.height)
+	for row := y0; row < y1; row++ {
+		for col := x0; col < x1; col++ {
+			frame.y[row*frame.width+col] = color.y
+		}
+	}
+	chromaWidth := frame.width / 2
+	for row := y0 / 2; row < (y1+1)/2; row++ {
+		for col := x0 / 2; col < (x1+1)/2; col++ {
+			frame.cb[row*chromaWidth+col] = color.cb
+			frame.cr[row*chromaWidth+col] = color.cr
+		}
+	}
+}
+
+// drawText draws text with the bitmap font, characters missing from it are left blank
+func drawText(frame *frameYUV, x, y, scale int, text string) {
+	for i, char := range []rune(text) {
+		glyph := font[char]
+		charX := x + i*fontCharAdvance*scale
+		for row := 0; row < fontHeight; row++ {
+			for col := 0; col < fontWidth; col++ {
+				if glyph[row]&(0x10>>col) != 0 {
+					fillRect(frame, charX+col*scale, y+row*scale, scale, scale, colorText)
+				}
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ module relay
 go 1.24
 
 require (
+	github.com/bluenviron/mediacommon v1.9.2
 	github.com/libp2p/go-libp2p v0.41.1
 	github.com/libp2p/go-libp2p-pubsub v0.13.1
 	github.com/libp2p/go-reuseport v0.4.0
@@ -10,12 +11,15 @@ require (
 	github.com/oklog/ulid/v2 v2.1.1
 	github.com/pion/ice/v4 v4.0.10
 	github.com/pion/interceptor v0.1.38
+	github.com/pion/rtcp v1.2.15
 	github.com/pion/rtp v1.8.15
+	github.com/pion/sdp/v3 v3.0.13
 	github.com/pion/webrtc/v4 v4.1.1
 	google.golang.org/protobuf v1.36.6
 )
 
 require (
+	github.com/abema/go-mp4 v1.4.1 // indirect
 	github.com/benbjohnson/clock v1.3.5 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
@@ -77,9 +81,7 @@ require (
 	github.com/pion/logging v0.2.3 // indirect
 	github.com/pion/mdns/v2 v2.0.7 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.15 // indirect
 	github.com/pion/sctp v1.8.39 // indirect
-	github.com/pion/sdp/v3 v3.0.13 // indirect
 	github.com/pion/srtp/v3 v3.0.4 // indirect
 	github.com/pion/stun v0.6.1 // indirect
 	github.com/pion/stun/v3 v3.0.0 // indirect
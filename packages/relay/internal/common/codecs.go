@@ -0,0 +1,146 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Codec Policy ---
+// Pushes may offer several video codecs, the relay answers with the allowed ones in order of preference.
+// Receivers of a room, participants and relays alike, must support the codec the room ended up with
+
+// ErrUnsupportedCodec is returned when a peer can't receive the codec of a room
+var ErrUnsupportedCodec = errors.New("unsupported codec")
+
+// supportedCodecs are the MIME types of codecs RegisterCodecs registers
+var supportedCodecs = []string{
+	webrtc.MimeTypeOpus, webrtc.MimeTypeG722, webrtc.MimeTypePCMU, webrtc.MimeTypePCMA,
+	webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeH264, webrtc.MimeTypeAV1, webrtc.MimeTypeH265,
+}
+
+// SupportsCodec checks if the relay can receive and forward given codec
+func SupportsCodec(mimeType string) bool {
+	return slices.ContainsFunc(supportedCodecs, func(supported string) bool {
+		return strings.EqualFold(supported, mimeType)
+	})
+}
+
+// ParseVideoCodecs parses a comma separated list of video codecs into MIME types, "H264" being short for "video/H264"
+func ParseVideoCodecs(list string) []string {
+	var policy []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if !strings.Contains(name, "/") {
+			name = "video/" + name
+		}
+		policy = append(policy, name)
+	}
+	return policy
+}
+
+// ApplyVideoCodecPolicy limits the video codecs answered to a push offer to the allowed ones, in order of preference.
+// An empty policy allows any codec. Must be called after setting the remote offer, before creating the answer
+func ApplyVideoCodecPolicy(pc *webrtc.PeerConnection, policy []string) error {
+	if len(policy) == 0 {
+		return nil
+	}
+
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Kind() != webrtc.RTPCodecTypeVideo || transceiver.Receiver() == nil {
+			continue
+		}
+		// Codecs both the push and the relay support
+		offered := transceiver.Receiver().GetParameters().Codecs
+
+		var preferred []webrtc.RTPCodecParameters
+		for _, mimeType := range policy {
+			for _, codec := range offered {
+				if strings.EqualFold(codec.MimeType, mimeType) {
+					preferred = append(preferred, codec)
+				}
+			}
+		}
+		if len(preferred) == 0 {
+			var names []string
+			for _, codec := range offered {
+				if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeRTX) {
+					names = append(names, codec.MimeType)
+				}
+			}
+			return fmt.Errorf("%w: push offers video codecs [%s], allowed are [%s]",
+				ErrUnsupportedCodec, strings.Join(names, ", "), strings.Join(policy, ", "))
+		}
+		// Retransmissions of the kept codecs stay usable
+		for _, codec := range offered {
+			if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeRTX) {
+				continue
+			}
+			for _, kept := range preferred {
+				if codec.SDPFmtpLine == fmt.Sprintf("apt=%d", kept.PayloadType) {
+					preferred = append(preferred, codec)
+					break
+				}
+			}
+		}
+		if err := transceiver.SetCodecPreferences(preferred); err != nil {
+			return fmt.Errorf("failed to set video codec preferences: %w", err)
+		}
+	}
+	return nil
+}
+
+// CheckRemoteCodecs verifies that the remote answer accepted the codec of every track we send.
+// Returns ErrUnsupportedCodec naming the codec otherwise
+func CheckRemoteCodecs(pc *webrtc.PeerConnection) error {
+	remote := pc.RemoteDescription()
+	if remote == nil {
+		return nil
+	}
+	// Parse a copy, Unmarshal caches into the description pion shares between goroutines
+	var parsed sdp.SessionDescription
+	if err := parsed.UnmarshalString(remote.SDP); err != nil {
+		return fmt.Errorf("failed to parse remote description: %w", err)
+	}
+
+	for _, transceiver := range pc.GetTransceivers() {
+		sender := transceiver.Sender()
+		if sender == nil || sender.Track() == nil {
+			continue
+		}
+		track, ok := sender.Track().(*webrtc.TrackLocalStaticRTP)
+		if !ok {
+			continue
+		}
+		mimeType := track.Codec().MimeType
+		subtype := mimeType[strings.Index(mimeType, "/")+1:]
+
+		accepted := false
+		for _, media := range parsed.MediaDescriptions {
+			if mid, _ := media.Attribute("mid"); mid != transceiver.Mid() || media.MediaName.Port.Value == 0 {
+				continue
+			}
+			for _, attribute := range media.Attributes {
+				// rtpmap:<payload type> <encoding name>/<clock rate>[/<channels>]
+				if attribute.Key != "rtpmap" {
+					continue
+				}
+				if _, encoding, found := strings.Cut(attribute.Value, " "); found {
+					name, _, _ := strings.Cut(encoding, "/")
+					accepted = accepted || strings.EqualFold(name, subtype)
+				}
+			}
+		}
+		if !accepted {
+			return fmt.Errorf("%w: %s codec %s is not supported by the receiver", ErrUnsupportedCodec, track.Kind(), mimeType)
+		}
+	}
+	return nil
+}
@@ -3,63 +3,126 @@ package common
 import (
 	"fmt"
 	"log/slog"
+	"net"
 	"strconv"
+	"sync"
 
 	"github.com/libp2p/go-reuseport"
 	"github.com/pion/ice/v4"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/nack"
 	"github.com/pion/webrtc/v4"
 )
 
-var globalWebRTCAPI *webrtc.API
-var globalWebRTCConfig = webrtc.Configuration{
-	ICETransportPolicy: webrtc.ICETransportPolicyAll,
-	BundlePolicy:       webrtc.BundlePolicyBalanced,
-	SDPSemantics:       webrtc.SDPSemanticsUnifiedPlan,
+// bweInitialBitrate is the bandwidth estimate of a new PeerConnection before receiver feedback arrives, bits per second
+const bweInitialBitrate = 10_000_000
+
+// WebRTCConfig configures the WebRTC API of a relay
+type WebRTCConfig struct {
+	STUNServer   string // STUN server as host:port, none if empty
+	UDPMuxPort   int    // UDP port all PeerConnections share, overrides the port range if set
+	UDPPortStart int    // Start of the UDP port range of PeerConnections, any port if unset
+	UDPPortEnd   int    // End of the UDP port range of PeerConnections
+	NAT11IP      string // IP of the relay behind a 1:1 NAT, announced as server reflexive candidate
+}
+
+// WebRTCAPI creates the PeerConnections of a relay, all sharing its settings, codecs and interceptors
+type WebRTCAPI struct {
+	api         *webrtc.API
+	config      webrtc.Configuration
+	extensions  map[webrtc.RTPCodecType]map[string]uint8 // extension URI -> ID, by media kind
+	muxListener net.PacketConn                           // UDP mux socket, nil without mux
+
+	// Interceptors of a PeerConnection are handed over while it's created
+	interceptorMutex  sync.Mutex
+	nextEstimator     cc.BandwidthEstimator
+	nextRetransmitter *retransmitter
+	nextProtection    *linkProtection
+	nextPacer         *linkPacer
+
+	estimators  *SafeMap[*webrtc.PeerConnection, cc.BandwidthEstimator] // PeerConnection -> its send-side bandwidth estimator
+	protections *SafeMap[*webrtc.PeerConnection, *linkProtection]       // PeerConnection -> FEC and RED of its streams
+	histories   *SafeMap[*webrtc.TrackLocalStaticRTP, *PacketHistory]   // local track -> packets forwarded to it, for retransmissions
 }
 
-func InitWebRTCAPI() error {
+// NewWebRTCAPI creates a WebRTC API with given settings
+func NewWebRTCAPI(config WebRTCConfig) (*WebRTCAPI, error) {
 	var err error
-	flags := GetFlags()
+	w := &WebRTCAPI{
+		config: webrtc.Configuration{
+			ICETransportPolicy: webrtc.ICETransportPolicyAll,
+			BundlePolicy:       webrtc.BundlePolicyBalanced,
+			SDPSemantics:       webrtc.SDPSemanticsUnifiedPlan,
+		},
+		estimators:  NewSafeMap[*webrtc.PeerConnection, cc.BandwidthEstimator](),
+		protections: NewSafeMap[*webrtc.PeerConnection, *linkProtection](),
+		histories:   NewSafeMap[*webrtc.TrackLocalStaticRTP, *PacketHistory](),
+	}
+	if len(config.STUNServer) > 0 {
+		w.config.ICEServers = []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:" + config.STUNServer},
+			},
+		}
+	}
 
 	// Media engine
 	mediaEngine := &webrtc.MediaEngine{}
 
 	// Register our extensions
-	if err := RegisterExtensions(mediaEngine); err != nil {
-		return fmt.Errorf("failed to register extensions: %w", err)
-	}
-
-	// Default codecs cover most of our needs
-	err = mediaEngine.RegisterDefaultCodecs()
-	if err != nil {
-		return err
+	if w.extensions, err = RegisterExtensions(mediaEngine); err != nil {
+		return nil, fmt.Errorf("failed to register extensions: %w", err)
 	}
 
-	// Add H.265 for special cases
-	videoRTCPFeedback := []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}}
-	for _, codec := range []webrtc.RTPCodecParameters{
-		{
-			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, RTCPFeedback: videoRTCPFeedback},
-			PayloadType:        48,
-		},
-		{
-			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=48"},
-			PayloadType:        49,
-		},
-	} {
-		if err = mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
-			return err
-		}
+	// Codecs
+	if err = RegisterCodecs(mediaEngine); err != nil {
+		return nil, err
 	}
 
 	// Interceptor registry
 	interceptorRegistry := &interceptor.Registry{}
 
-	// Use default set
-	err = webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry)
+	// Default set, except NACKs of receivers are answered from the shared packet history of each track
+	if err = w.configureNack(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+	if err = webrtc.ConfigureRTCPReports(interceptorRegistry); err != nil {
+		return nil, err
+	}
+	if err = webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return nil, err
+	}
+	if err = webrtc.ConfigureTWCCSender(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+
+	// Send-side bandwidth estimation from TWCC feedback of receivers. Forwarded streams can't be slowed down
+	// by pacing, receivers are adapted by video layer selection and the runner's encoder bitrate instead
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		w.nextPacer = newLinkPacer()
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(bweInitialBitrate),
+			gcc.SendSideBWEPacer(w.nextPacer),
+		)
+	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		w.nextEstimator = estimator
+	})
+	interceptorRegistry.Add(congestionController)
+
+	// Transport-wide sequence numbers on sent packets, added after the congestion controller so it sees them
+	if err = webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+
+	// FEC and RED of protected links, added before transport-wide sequence numbers so congestion control accounts for them
+	if err = w.configureLinkProtection(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
 	}
 
 	// Setting engine
@@ -68,50 +131,127 @@ func InitWebRTCAPI() error {
 	// New in v4, reduces CPU usage and latency when enabled
 	settingEngine.EnableSCTPZeroChecksum(true)
 
-	nat11IP := GetFlags().NAT11IP
-	if len(nat11IP) > 0 {
-		settingEngine.SetNAT1To1IPs([]string{nat11IP}, webrtc.ICECandidateTypeSrflx)
-		slog.Info("Using NAT 1:1 IP for WebRTC", "nat11_ip", nat11IP)
+	if len(config.NAT11IP) > 0 {
+		settingEngine.SetNAT1To1IPs([]string{config.NAT11IP}, webrtc.ICECandidateTypeSrflx)
+		slog.Info("Using NAT 1:1 IP for WebRTC", "nat11_ip", config.NAT11IP)
 	}
 
-	muxPort := GetFlags().UDPMuxPort
-	if muxPort > 0 {
+	if config.UDPMuxPort > 0 {
 		// Use reuseport to allow multiple listeners on the same port
-		pktListener, err := reuseport.ListenPacket("udp", ":"+strconv.Itoa(muxPort))
+		w.muxListener, err = reuseport.ListenPacket("udp", ":"+strconv.Itoa(config.UDPMuxPort))
 		if err != nil {
-			return fmt.Errorf("failed to create WebRTC muxed UDP listener: %w", err)
+			return nil, fmt.Errorf("failed to create WebRTC muxed UDP listener: %w", err)
 		}
 
 		mux := ice.NewMultiUDPMuxDefault(ice.NewUDPMuxDefault(ice.UDPMuxParams{
-			UDPConn: pktListener,
+			UDPConn: w.muxListener,
 		}))
-		slog.Info("Using UDP Mux for WebRTC", "port", muxPort)
+		slog.Info("Using UDP Mux for WebRTC", "port", config.UDPMuxPort)
 		settingEngine.SetICEUDPMux(mux)
-	}
-
-	if flags.WebRTCUDPStart > 0 && flags.WebRTCUDPEnd > 0 && flags.WebRTCUDPStart < flags.WebRTCUDPEnd {
+	} else if config.UDPPortStart > 0 && config.UDPPortEnd > 0 && config.UDPPortStart < config.UDPPortEnd {
 		// Set the UDP port range used by WebRTC
-		err = settingEngine.SetEphemeralUDPPortRange(uint16(flags.WebRTCUDPStart), uint16(flags.WebRTCUDPEnd))
+		err = settingEngine.SetEphemeralUDPPortRange(uint16(config.UDPPortStart), uint16(config.UDPPortEnd))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		slog.Info("Using WebRTC UDP Port Range", "start", flags.WebRTCUDPStart, "end", flags.WebRTCUDPEnd)
+		slog.Info("Using WebRTC UDP Port Range", "start", config.UDPPortStart, "end", config.UDPPortEnd)
 	}
 
 	settingEngine.SetIncludeLoopbackCandidate(true) // Just in case
 
 	// Create a new API object with our customized settings
-	globalWebRTCAPI = webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine), webrtc.WithInterceptorRegistry(interceptorRegistry))
+	w.api = webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(settingEngine), webrtc.WithInterceptorRegistry(interceptorRegistry))
+
+	return w, nil
+}
+
+// Close releases the UDP mux socket, PeerConnections using it stop working
+func (w *WebRTCAPI) Close() error {
+	if w.muxListener == nil {
+		return nil
+	}
+	return w.muxListener.Close()
+}
+
+// RegisterCodecs registers the codecs relays can forward
+func RegisterCodecs(mediaEngine *webrtc.MediaEngine) error {
+	// Default codecs cover most of our needs
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return err
+	}
+
+	// Add H.265 for special cases
+	videoRTCPFeedback := []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, RTCPFeedback: videoRTCPFeedback},
+			PayloadType:        48,
+		},
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=48"},
+			PayloadType:        49,
+		},
+	} {
+		if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// configureLinkProtection registers FlexFEC and RED for relay links, see ProtectLink
+func (w *WebRTCAPI) configureLinkProtection(mediaEngine *webrtc.MediaEngine, interceptorRegistry *interceptor.Registry) error {
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeFlexFEC03, ClockRate: 90000, SDPFmtpLine: "repair-window=10000000"},
+		PayloadType:        fecPayloadType,
+	}, webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRED, ClockRate: 48000, Channels: 2, SDPFmtpLine: "111/111"},
+		PayloadType:        redPayloadType,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return err
+	}
+	interceptorRegistry.Add(linkProtectionFactory{api: w})
+	return nil
+}
+
+// configureNack sets up generating NACKs for received streams and answering NACKs for sent streams
+func (w *WebRTCAPI) configureNack(mediaEngine *webrtc.MediaEngine, interceptorRegistry *interceptor.Registry) error {
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return err
+	}
+
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	interceptorRegistry.Add(retransmitterFactory{api: w})
+	interceptorRegistry.Add(generator)
 	return nil
 }
 
 // CreatePeerConnection sets up a new peer connection
-func CreatePeerConnection(onClose func()) (*webrtc.PeerConnection, error) {
-	pc, err := globalWebRTCAPI.NewPeerConnection(globalWebRTCConfig)
+func (w *WebRTCAPI) CreatePeerConnection(onClose func()) (*webrtc.PeerConnection, error) {
+	// Interceptors of the PeerConnection are handed over while it's created
+	w.interceptorMutex.Lock()
+	pc, err := w.api.NewPeerConnection(w.config)
+	estimator, rtx, protection := w.nextEstimator, w.nextRetransmitter, w.nextProtection
+	w.nextEstimator, w.nextRetransmitter, w.nextProtection = nil, nil, nil
+	w.interceptorMutex.Unlock()
 	if err != nil {
 		return nil, err
 	}
+	if estimator != nil {
+		w.estimators.Set(pc, estimator)
+	}
+	if rtx != nil {
+		rtx.pc = pc
+	}
+	if protection != nil {
+		protection.pc = pc
+		w.protections.Set(pc, protection)
+	}
 
 	// Log connection state changes and handle failed/disconnected connections
 	pc.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
@@ -123,9 +263,21 @@ func CreatePeerConnection(onClose func()) (*webrtc.PeerConnection, error) {
 			if err != nil {
 				slog.Error("Failed to close PeerConnection", "err", err)
 			}
+			w.estimators.Delete(pc)
+			w.protections.Delete(pc)
 			onClose()
 		}
 	})
 
 	return pc, nil
 }
+
+// TargetBitrate returns the send-side bandwidth estimate of a PeerConnection in bits per second, 0 if unknown.
+// Estimates are only meaningful once the receiver sends TWCC feedback
+func (w *WebRTCAPI) TargetBitrate(pc *webrtc.PeerConnection) uint64 {
+	estimator, ok := w.estimators.Get(pc)
+	if !ok {
+		return 0
+	}
+	return uint64(max(estimator.GetTargetBitrate(), 0))
+}
@@ -6,37 +6,37 @@ const (
 	ExtensionPlayoutDelay string = "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay"
 )
 
-// ExtensionMap maps audio/video extension URIs to their IDs based on registration order
-var ExtensionMap = map[webrtc.RTPCodecType]map[string]uint8{}
-
-func RegisterExtensions(mediaEngine *webrtc.MediaEngine) error {
+// RegisterExtensions registers additional header extensions to a media engine.
+// Returns the extension URIs mapped to their IDs based on registration order, by media kind
+func RegisterExtensions(mediaEngine *webrtc.MediaEngine) (map[webrtc.RTPCodecType]map[string]uint8, error) {
 	// Register additional header extensions to reduce latency
 	// Playout Delay (Video)
 	if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{
 		URI: ExtensionPlayoutDelay,
 	}, webrtc.RTPCodecTypeVideo); err != nil {
-		return err
+		return nil, err
 	}
 	// Playout Delay (Audio)
 	if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{
 		URI: ExtensionPlayoutDelay,
 	}, webrtc.RTPCodecTypeAudio); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Register the extension IDs for both audio and video
-	ExtensionMap[webrtc.RTPCodecTypeAudio] = map[string]uint8{
-		ExtensionPlayoutDelay: 1,
-	}
-	ExtensionMap[webrtc.RTPCodecTypeVideo] = map[string]uint8{
-		ExtensionPlayoutDelay: 1,
-	}
-
-	return nil
+	return map[webrtc.RTPCodecType]map[string]uint8{
+		webrtc.RTPCodecTypeAudio: {
+			ExtensionPlayoutDelay: 1,
+		},
+		webrtc.RTPCodecTypeVideo: {
+			ExtensionPlayoutDelay: 1,
+		},
+	}, nil
 }
 
-func GetExtension(codecType webrtc.RTPCodecType, extURI string) (uint8, bool) {
-	cType, ok := ExtensionMap[codecType]
+// GetExtension returns the ID of a header extension registered to the API
+func (w *WebRTCAPI) GetExtension(codecType webrtc.RTPCodecType, extURI string) (uint8, bool) {
+	cType, ok := w.extensions[codecType]
 	if !ok {
 		return 0, false
 	}
@@ -0,0 +1,595 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/flexfec"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Link Protection ---
+// Streams sent over lossy relay links are protected with codecs negotiated in SDP: video with FlexFEC-03 on its own
+// SSRC, generated by pion's FEC interceptor, Opus with RED (RFC 2198). Protection of a PeerConnection is off until
+// enabled with ProtectLink, and is added before transport-wide sequence numbers, so congestion control accounts for it.
+// The receiving relay recovers lost packets and strips FEC and RED before forwarding the streams
+
+const (
+	fecPayloadType  = 118 // Payload type of FlexFEC-03, protecting video
+	redPayloadType  = 63  // Payload type of RED, protecting Opus
+	fecMediaPackets = 10  // Video packets protected together by the FEC packets of a group
+	fecHistorySize  = 512 // Received video packets kept per stream for recovery, a power of 2
+	fecHeaderSize   = 20  // FlexFEC-03 header with the shortest packet mask
+)
+
+const (
+	mimeTypeRED    = "audio/red"
+	fecGroupFECFR  = "FEC-FR" // ssrc-group semantics of a FEC stream, followed by the protected and the FEC SSRC
+	recoveredLimit = 64       // Recovered packets waiting to be read, more are dropped
+)
+
+var errUnsupportedFEC = errors.New("unsupported FEC packet")
+
+// linkProtection protects the streams a PeerConnection sends while enabled, and recovers lost packets of the
+// streams it receives from their FEC and RED
+type linkProtection struct {
+	interceptor.NoOp
+	fec        interceptor.Interceptor // pion's FlexFEC interceptor, encoding with encoders of the link
+	pc         *webrtc.PeerConnection
+	fecPackets atomic.Uint32 // FEC packets sent per fecMediaPackets video packets, 0 while unprotected
+	pacer      *linkPacer    // Pacer of the congestion controller FEC packets are sent through, nil without one
+
+	mutex    sync.Mutex
+	received map[uint32]*protectedStream // SSRC -> received stream
+	resolved bool                        // Whether payload types were taken from the remote description
+	red      uint8                       // Payload type of RED, 0 if not negotiated
+	flexFEC  uint8                       // Payload type of FlexFEC, 0 if not negotiated
+}
+
+// linkProtectionFactory creates link protections, handed to CreatePeerConnection while a PeerConnection is created
+type linkProtectionFactory struct {
+	api *WebRTCAPI
+}
+
+func (f linkProtectionFactory) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	lp := &linkProtection{
+		received: make(map[uint32]*protectedStream),
+	}
+	factory, err := flexfec.NewFecInterceptor(flexfec.NumMediaPackets(fecMediaPackets), flexfec.FECEncoderFactory(lp))
+	if err != nil {
+		return nil, err
+	}
+	if lp.fec, err = factory.NewInterceptor(id); err != nil {
+		return nil, err
+	}
+	lp.pacer, f.api.nextPacer = f.api.nextPacer, nil
+	f.api.nextProtection = lp
+	return lp, nil
+}
+
+// linkPacer sends packets of the congestion controller without pacing like gcc.NoOpPacer, sending FEC packets
+// through the stream they protect. The congestion controller only knows streams pion binds, which FEC streams aren't
+type linkPacer struct {
+	mutex     sync.Mutex
+	writers   map[uint32]interceptor.RTPWriter // SSRC -> writer of the stream
+	protected map[uint32]uint32                // FEC SSRC -> SSRC of the stream it protects
+}
+
+func newLinkPacer() *linkPacer {
+	return &linkPacer{
+		writers:   make(map[uint32]interceptor.RTPWriter),
+		protected: make(map[uint32]uint32),
+	}
+}
+
+func (p *linkPacer) AddStream(ssrc uint32, writer interceptor.RTPWriter) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.writers[ssrc] = writer
+}
+
+// protect sends packets of a FEC stream through the stream it protects, unprotected if ssrc is 0
+func (p *linkPacer) protect(fecSSRC, ssrc uint32) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if ssrc == 0 {
+		delete(p.protected, fecSSRC)
+		return
+	}
+	p.protected[fecSSRC] = ssrc
+}
+
+func (p *linkPacer) Write(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+	p.mutex.Lock()
+	writer, ok := p.writers[header.SSRC]
+	if !ok {
+		writer, ok = p.writers[p.protected[header.SSRC]]
+	}
+	p.mutex.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("%w: %d", gcc.ErrUnknownStream, header.SSRC)
+	}
+	return writer.Write(header, payload, attributes)
+}
+
+func (p *linkPacer) SetTargetBitrate(int) {}
+
+func (p *linkPacer) Close() error {
+	return nil
+}
+
+// ProtectLink sets the FEC packets sent per group of video packets of a PeerConnection, audio is sent with RED
+// while any are. 0 stops protecting it. Returns whether protection changed
+func (w *WebRTCAPI) ProtectLink(pc *webrtc.PeerConnection, fecPackets int) bool {
+	lp, ok := w.protections.Get(pc)
+	if !ok {
+		return false
+	}
+	packets := uint32(max(fecPackets, 0))
+	return lp.fecPackets.Swap(packets) != packets
+}
+
+// ReceiveFEC starts receiving the FlexFEC stream protecting a received video track, if the remote peer sends one.
+// Lost packets of the track are recovered from it and read from the track like received ones
+func (w *WebRTCAPI) ReceiveFEC(pc *webrtc.PeerConnection, track *webrtc.TrackRemote) error {
+	ssrc, err := fecSSRC(pc.RemoteDescription(), track.SSRC())
+	if err != nil || ssrc == 0 {
+		return err
+	}
+
+	// pion doesn't start FEC streams it's offered, receive it next to the track on the same transport
+	receiver, err := w.api.NewRTPReceiver(webrtc.RTPCodecTypeVideo, pc.SCTP().Transport())
+	if err != nil {
+		return fmt.Errorf("failed to create FEC receiver: %w", err)
+	}
+	if err = receiver.Receive(webrtc.RTPReceiveParameters{
+		Encodings: []webrtc.RTPDecodingParameters{{RTPCodingParameters: webrtc.RTPCodingParameters{SSRC: ssrc}}},
+	}); err != nil {
+		return fmt.Errorf("failed to receive FEC stream: %w", err)
+	}
+
+	// FEC packets are consumed by the link protection while read, see protectedStream
+	go func() {
+		defer func() {
+			_ = receiver.Stop()
+		}()
+		buffer := make([]byte, 1500)
+		for {
+			if _, _, err := receiver.Track().Read(buffer); err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// fecSSRC returns the SSRC of the FEC stream protecting given SSRC in a session description, 0 if there is none
+func fecSSRC(description *webrtc.SessionDescription, ssrc webrtc.SSRC) (webrtc.SSRC, error) {
+	if description == nil {
+		return 0, nil
+	}
+	// Parse a copy, Unmarshal caches into the description pion shares between goroutines
+	var parsed sdp.SessionDescription
+	if err := parsed.UnmarshalString(description.SDP); err != nil {
+		return 0, fmt.Errorf("failed to parse remote description: %w", err)
+	}
+
+	protected := strconv.FormatUint(uint64(ssrc), 10)
+	for _, media := range parsed.MediaDescriptions {
+		for _, attribute := range media.Attributes {
+			if attribute.Key != sdp.AttrKeySSRCGroup {
+				continue
+			}
+			fields := strings.Fields(attribute.Value)
+			if len(fields) != 3 || fields[0] != fecGroupFECFR || fields[1] != protected {
+				continue
+			}
+			fec, err := strconv.ParseUint(fields[2], 10, 32)
+			if err != nil {
+				return 0, fmt.Errorf("failed to parse FEC SSRC: %w", err)
+			}
+			return webrtc.SSRC(fec), nil
+		}
+	}
+	return 0, nil
+}
+
+// WithoutFECSources returns a remote offer without the ssrc lines of its FEC streams, which pion would take for
+// further tracks of their media sections, rejecting the offer as Plan B. FEC-FR groups are kept to find FEC streams by
+func WithoutFECSources(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	return withoutFECStreams(offer, true)
+}
+
+// WithoutFEC returns an offer for a participant without the FEC streams pion declares for its video tracks.
+// Participants are never sent FEC, and clients built on pion would reject the offer as Plan B otherwise
+func WithoutFEC(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	return withoutFECStreams(offer, false)
+}
+
+// withoutFECStreams strips the ssrc lines of FEC streams from a session description, and their FEC-FR groups unless kept
+func withoutFECStreams(description webrtc.SessionDescription, keepGroups bool) (webrtc.SessionDescription, error) {
+	var parsed sdp.SessionDescription
+	if err := parsed.UnmarshalString(description.SDP); err != nil {
+		return description, fmt.Errorf("failed to parse session description: %w", err)
+	}
+
+	stripped := false
+	for _, media := range parsed.MediaDescriptions {
+		fecSources := make(map[string]bool)
+		for _, attribute := range media.Attributes {
+			if fields := strings.Fields(attribute.Value); attribute.Key == sdp.AttrKeySSRCGroup &&
+				len(fields) == 3 && fields[0] == fecGroupFECFR {
+				fecSources[fields[2]] = true
+			}
+		}
+		if len(fecSources) == 0 {
+			continue
+		}
+		attributes := media.Attributes[:0]
+		for _, attribute := range media.Attributes {
+			// ssrc:<SSRC> <attribute>
+			ssrc, _, _ := strings.Cut(attribute.Value, " ")
+			switch {
+			case attribute.Key == sdp.AttrKeySSRCGroup && !keepGroups && ssrc == fecGroupFECFR:
+				stripped = true
+			case attribute.Key == sdp.AttrKeySSRC && fecSources[ssrc]:
+				stripped = true
+			default:
+				attributes = append(attributes, attribute)
+			}
+		}
+		media.Attributes = attributes
+	}
+	if !stripped {
+		return description, nil
+	}
+
+	marshaled, err := parsed.Marshal()
+	if err != nil {
+		return description, fmt.Errorf("failed to marshal session description: %w", err)
+	}
+	return webrtc.SessionDescription{Type: description.Type, SDP: string(marshaled)}, nil
+}
+
+// payloadTypes returns the payload types of RED and FlexFEC negotiated with the remote peer, 0 if not negotiated
+func (lp *linkProtection) payloadTypes() (red uint8, fec uint8) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	if lp.resolved || lp.pc == nil {
+		return lp.red, lp.flexFEC
+	}
+	remote := lp.pc.RemoteDescription()
+	if remote == nil {
+		return 0, 0
+	}
+
+	lp.resolved = true
+	var parsed sdp.SessionDescription
+	if err := parsed.UnmarshalString(remote.SDP); err != nil {
+		return 0, 0
+	}
+	lp.red, _ = parsed.GetPayloadTypeForCodec(sdp.Codec{Name: strings.TrimPrefix(mimeTypeRED, "audio/")})
+	lp.flexFEC, _ = parsed.GetPayloadTypeForCodec(sdp.Codec{Name: strings.TrimPrefix(webrtc.MimeTypeFlexFEC03, "video/")})
+	return lp.red, lp.flexFEC
+}
+
+// NewEncoder creates the FlexFEC encoder of a sent video stream, see flexfec.EncoderFactory
+func (lp *linkProtection) NewEncoder(payloadType uint8, ssrc uint32) flexfec.FlexEncoder {
+	return &linkEncoder{
+		link:    lp,
+		encoder: flexfec.NewFlexEncoder03(payloadType, ssrc),
+	}
+}
+
+// BindLocalStream adds RED to sent Opus streams and FEC to sent video streams, while the link is protected.
+// pion's FEC interceptor passes streams through as is unless the remote peer negotiated FlexFEC
+func (lp *linkProtection) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if strings.EqualFold(info.MimeType, webrtc.MimeTypeOpus) {
+		return &redWriter{link: lp, writer: writer}
+	}
+	if lp.pacer != nil && info.SSRCForwardErrorCorrection != 0 {
+		lp.pacer.protect(info.SSRCForwardErrorCorrection, info.SSRC)
+	}
+	return lp.fec.BindLocalStream(info, writer)
+}
+
+func (lp *linkProtection) UnbindLocalStream(info *interceptor.StreamInfo) {
+	if lp.pacer != nil && info.SSRCForwardErrorCorrection != 0 {
+		lp.pacer.protect(info.SSRCForwardErrorCorrection, 0)
+	}
+	lp.fec.UnbindLocalStream(info)
+}
+
+// BindRemoteStream recovers lost packets of received streams and strips their RED and FEC
+func (lp *linkProtection) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	stream := &protectedStream{
+		link:   lp,
+		reader: reader,
+		video:  strings.HasPrefix(strings.ToLower(info.MimeType), "video/"),
+	}
+	for _, extension := range info.RTPHeaderExtensions {
+		if extension.URI == sdp.TransportCCURI {
+			stream.transportCCID = uint8(extension.ID)
+		}
+	}
+	lp.mutex.Lock()
+	lp.received[info.SSRC] = stream
+	lp.mutex.Unlock()
+	return stream
+}
+
+func (lp *linkProtection) UnbindRemoteStream(info *interceptor.StreamInfo) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	delete(lp.received, info.SSRC)
+}
+
+func (lp *linkProtection) Close() error {
+	return lp.fec.Close()
+}
+
+// recoverFEC recovers a lost packet of a received video stream from a FlexFEC packet protecting it
+func (lp *linkProtection) recoverFEC(data []byte) {
+	var packet rtp.Packet
+	if err := packet.Unmarshal(data); err != nil {
+		return
+	}
+	fec, err := parseFEC(packet.Payload)
+	if err != nil {
+		return
+	}
+	lp.mutex.Lock()
+	stream, ok := lp.received[fec.ssrc]
+	lp.mutex.Unlock()
+	if ok {
+		stream.recover(fec)
+	}
+}
+
+// linkEncoder encodes the FEC packets of a sent video stream, as many as the link is protected with
+type linkEncoder struct {
+	link    *linkProtection
+	encoder *flexfec.FlexEncoder03
+}
+
+func (e *linkEncoder) EncodeFec(mediaPackets []rtp.Packet, _ uint32) []rtp.Packet {
+	fecPackets := e.link.fecPackets.Load()
+	if fecPackets == 0 {
+		return nil
+	}
+	return e.encoder.EncodeFec(mediaPackets, fecPackets)
+}
+
+// --- FEC Recovery ---
+
+// fecPacket is a parsed FlexFEC-03 packet
+type fecPacket struct {
+	recovery  []byte   // Header recovery fields: P, X, CC, M, PT, length recovery and TS recovery
+	ssrc      uint32   // SSRC of the protected stream
+	protected []uint16 // Sequence numbers of the protected packets
+	repair    []byte   // XOR of the protected packets after their fixed header
+}
+
+// parseFEC parses a FlexFEC-03 payload protecting a single stream with a flexible mask
+func parseFEC(payload []byte) (*fecPacket, error) {
+	if len(payload) < fecHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	// R and F bits select retransmissions and fixed masks, not sent by pion
+	if payload[0]&0xC0 != 0 || payload[8] != 1 {
+		return nil, errUnsupportedFEC
+	}
+
+	fec := &fecPacket{
+		recovery: payload[:8],
+		ssrc:     binary.BigEndian.Uint32(payload[12:16]),
+	}
+	seqBase := binary.BigEndian.Uint16(payload[16:18])
+	// Masks of 15, 31 and 63 bits follow each other, a set K bit ends them
+	offset := 18
+	index := uint16(0)
+	for _, bits := range []int{15, 31, 63} {
+		size := (bits + 1) / 8
+		if len(payload) < offset+size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		var mask uint64
+		for _, b := range payload[offset : offset+size] {
+			mask = mask<<8 | uint64(b)
+		}
+		last := mask>>bits != 0
+		for bit := bits - 1; bit >= 0; bit-- {
+			if mask>>bit&1 == 1 {
+				fec.protected = append(fec.protected, seqBase+index)
+			}
+			index++
+		}
+		offset += size
+		if last {
+			fec.repair = payload[offset:]
+			return fec, nil
+		}
+	}
+	return nil, errUnsupportedFEC
+}
+
+// protectedStream is a received stream of a link, lost packets are recovered from its RED or its FEC stream
+type protectedStream struct {
+	link          *linkProtection
+	reader        interceptor.RTPReader
+	video         bool
+	transportCCID uint8 // Extension ID of transport-wide sequence numbers, added after FEC by the sender
+
+	mutex     sync.Mutex
+	recovered []*rtp.Packet          // Recovered and unwrapped packets waiting to be read
+	history   [fecHistorySize][]byte // Received video packets as protected by FEC, by sequence number
+	started   bool                   // Whether a packet was received
+	lastSeq   uint16                 // Sequence number of the latest received packet
+}
+
+func (s *protectedStream) Read(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+	for {
+		if n, ok, err := s.readRecovered(b); ok {
+			return n, interceptor.Attributes{}, err
+		}
+
+		n, attributes, err := s.reader.Read(b, a)
+		if err != nil || n < 2 {
+			return n, attributes, err
+		}
+		red, fec := s.link.payloadTypes()
+		switch payloadType := b[1] & 0x7F; {
+		case red != 0 && payloadType == red:
+			// Primary packet is read after the ones recovered from its redundancy
+			s.unwrapRED(b[:n])
+			continue
+		case fec != 0 && payloadType == fec:
+			s.link.recoverFEC(b[:n])
+		case s.video:
+			s.keep(b[:n])
+		default:
+			s.receivedSeq(binary.BigEndian.Uint16(b[2:4]))
+		}
+		return n, attributes, nil
+	}
+}
+
+// readRecovered writes the next recovered packet to b, ok is false if there is none
+func (s *protectedStream) readRecovered(b []byte) (n int, ok bool, err error) {
+	s.mutex.Lock()
+	if len(s.recovered) == 0 {
+		s.mutex.Unlock()
+		return 0, false, nil
+	}
+	packet := s.recovered[0]
+	s.recovered = s.recovered[1:]
+	s.mutex.Unlock()
+	n, err = packet.MarshalTo(b)
+	return n, true, err
+}
+
+// queue adds recovered packets to be read, s.mutex must be held
+func (s *protectedStream) queue(packets ...*rtp.Packet) {
+	if len(s.recovered)+len(packets) > recoveredLimit {
+		return
+	}
+	s.recovered = append(s.recovered, packets...)
+}
+
+// receivedSeq moves the latest received sequence number forward, returning the packets lost before given one
+func (s *protectedStream) receivedSeq(seq uint16) uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lost := uint16(0)
+	if s.started {
+		diff := seq - s.lastSeq
+		if diff == 0 || diff >= 0x8000 {
+			// Duplicate or reordered
+			return 0
+		}
+		lost = diff - 1
+	}
+	s.started = true
+	s.lastSeq = seq
+	return lost
+}
+
+// keep keeps a received video packet as the sender protected it, without the transport-wide sequence number
+func (s *protectedStream) keep(data []byte) {
+	var header rtp.Header
+	headerSize, err := header.Unmarshal(data)
+	if err != nil {
+		return
+	}
+	protected := append([]byte(nil), data...)
+	if s.transportCCID != 0 && header.GetExtension(s.transportCCID) != nil {
+		_ = header.DelExtension(s.transportCCID)
+		if len(header.Extensions) == 0 {
+			header.Extension = false
+			header.ExtensionProfile = 0
+		}
+		if protected, err = header.Marshal(); err != nil {
+			return
+		}
+		protected = append(protected, data[headerSize:]...)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.history[header.SequenceNumber%fecHistorySize] = protected
+}
+
+// kept returns the kept packet with given sequence number, nil if it wasn't received
+func (s *protectedStream) kept(seq uint16) []byte {
+	packet := s.history[seq%fecHistorySize]
+	if len(packet) < 12 || binary.BigEndian.Uint16(packet[2:4]) != seq {
+		return nil
+	}
+	return packet
+}
+
+// recover rebuilds the packet a FEC packet protects if it's the only one of them lost
+func (s *protectedStream) recover(fec *fecPacket) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var received [][]byte
+	lost, missing := uint16(0), 0
+	for _, seq := range fec.protected {
+		if packet := s.kept(seq); packet != nil {
+			received = append(received, packet)
+		} else {
+			lost = seq
+			missing++
+		}
+	}
+	if missing != 1 {
+		return
+	}
+
+	// XOR of the header recovery fields and the remaining bytes of the other protected packets
+	recovery := append([]byte(nil), fec.recovery...)
+	for _, packet := range received {
+		recovery[0] ^= packet[0]
+		recovery[1] ^= packet[1]
+		length := uint16(len(packet) - 12)
+		recovery[2] ^= byte(length >> 8)
+		recovery[3] ^= byte(length)
+		for i := 4; i < 8; i++ {
+			recovery[i] ^= packet[i]
+		}
+	}
+	length := int(binary.BigEndian.Uint16(recovery[2:4]))
+	if length > len(fec.repair) {
+		return
+	}
+	data := make([]byte, 12+length)
+	data[0] = 0x80 | recovery[0]&0x3F
+	data[1] = recovery[1]
+	binary.BigEndian.PutUint16(data[2:4], lost)
+	copy(data[4:8], recovery[4:8])
+	binary.BigEndian.PutUint32(data[8:12], fec.ssrc)
+	copy(data[12:], fec.repair[:length])
+	for _, packet := range received {
+		for i := 12; i < len(packet) && i < len(data); i++ {
+			data[i] ^= packet[i]
+		}
+	}
+
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(data); err != nil {
+		return
+	}
+	s.history[lost%fecHistorySize] = data
+	s.queue(packet)
+}
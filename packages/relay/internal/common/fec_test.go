@@ -0,0 +1,447 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Link Protection Round Trips ---
+// Packets go through the sending side of a protected link, some are lost on the way, the receiving side must
+// rebuild the lost ones from FEC or RED and read them like received ones
+
+const (
+	testVideoSSRC     = 1234
+	testFECSSRC       = 5678
+	testAudioSSRC     = 4321
+	testTransportCCID = 5
+)
+
+// testWire collects packets written by the sending side, adding transport-wide sequence numbers like the
+// interceptors after link protection do
+type testWire struct {
+	packets      []*rtp.Packet
+	transportSeq uint16
+}
+
+func (w *testWire) Write(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+	packet := &rtp.Packet{Header: header.Clone(), Payload: append([]byte(nil), payload...)}
+	w.transportSeq++
+	if err := packet.Header.SetExtension(testTransportCCID, binary.BigEndian.AppendUint16(nil, w.transportSeq)); err != nil {
+		return 0, err
+	}
+	w.packets = append(w.packets, packet)
+	return len(payload), nil
+}
+
+// testQueue is a received stream reading queued packets, io.EOF once empty
+type testQueue struct {
+	packets [][]byte
+}
+
+func (q *testQueue) Read(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+	if len(q.packets) == 0 {
+		return 0, nil, io.EOF
+	}
+	n := copy(b, q.packets[0])
+	q.packets = q.packets[1:]
+	return n, a, nil
+}
+
+// newTestProtection returns a link protection with RED and FlexFEC negotiated, protected with given FEC packets
+func newTestProtection(t *testing.T, fecPackets int) *linkProtection {
+	t.Helper()
+	i, err := linkProtectionFactory{api: &WebRTCAPI{}}.NewInterceptor("")
+	if err != nil {
+		t.Fatalf("failed to create link protection: %v", err)
+	}
+	lp := i.(*linkProtection)
+	lp.resolved, lp.red, lp.flexFEC = true, redPayloadType, fecPayloadType
+	lp.fecPackets.Store(uint32(fecPackets))
+	return lp
+}
+
+// testPackets returns count packets from seqStart on, with payload sizes, markers and extensions varying like video frames
+func testPackets(ssrc uint32, payloadType uint8, seqStart uint16, count int) []*rtp.Packet {
+	packets := make([]*rtp.Packet, count)
+	for i := range packets {
+		payload := make([]byte, 20+(i*37)%200)
+		for j := range payload {
+			payload[j] = byte(i*7 + j)
+		}
+		packets[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i%5 == 4,
+				PayloadType:    payloadType,
+				SequenceNumber: seqStart + uint16(i),
+				Timestamp:      90000 + uint32(i/5)*3000,
+				SSRC:           ssrc,
+			},
+			Payload: payload,
+		}
+		if i%3 == 0 {
+			_ = packets[i].Header.SetExtension(1, []byte{0, 0, 0})
+		}
+	}
+	return packets
+}
+
+// send writes packets through the sending side of a link
+func send(t *testing.T, writer interceptor.RTPWriter, packets []*rtp.Packet) {
+	t.Helper()
+	for _, packet := range packets {
+		header := packet.Header.Clone()
+		if _, err := writer.Write(&header, packet.Payload, interceptor.Attributes{}); err != nil {
+			t.Fatalf("failed to send packet %d: %v", packet.SequenceNumber, err)
+		}
+	}
+}
+
+// readAll reads packets from a received stream until its queue is empty
+func readAll(t *testing.T, reader interceptor.RTPReader) []*rtp.Packet {
+	t.Helper()
+	var packets []*rtp.Packet
+	for {
+		b := make([]byte, 1500)
+		n, _, err := reader.Read(b, interceptor.Attributes{})
+		if errors.Is(err, io.EOF) {
+			return packets
+		}
+		if err != nil {
+			t.Fatalf("failed to read packet: %v", err)
+		}
+		packet := &rtp.Packet{}
+		if err = packet.Unmarshal(b[:n]); err != nil {
+			t.Fatalf("failed to unmarshal read packet: %v", err)
+		}
+		packets = append(packets, packet)
+	}
+}
+
+// sendVideo sends video packets over a link with given FEC packets per group, losing some of them.
+// Returns the packets read on the receiving side by sequence number
+func sendVideo(t *testing.T, fecPackets int, packets []*rtp.Packet, lost map[uint16]bool) map[uint16]*rtp.Packet {
+	t.Helper()
+	wire := &testWire{}
+	writer := newTestProtection(t, fecPackets).BindLocalStream(&interceptor.StreamInfo{
+		SSRC:                              testVideoSSRC,
+		MimeType:                          webrtc.MimeTypeVP8,
+		SSRCForwardErrorCorrection:        testFECSSRC,
+		PayloadTypeForwardErrorCorrection: fecPayloadType,
+	}, wire)
+	send(t, writer, packets)
+
+	receiver := newTestProtection(t, 0)
+	media, fec := &testQueue{}, &testQueue{}
+	mediaReader := receiver.BindRemoteStream(&interceptor.StreamInfo{
+		SSRC:                testVideoSSRC,
+		MimeType:            webrtc.MimeTypeVP8,
+		RTPHeaderExtensions: []interceptor.RTPHeaderExtension{{URI: sdp.TransportCCURI, ID: testTransportCCID}},
+	}, media)
+	fecReader := receiver.BindRemoteStream(&interceptor.StreamInfo{SSRC: testFECSSRC, MimeType: webrtc.MimeTypeVP8}, fec)
+
+	received := make(map[uint16]*rtp.Packet)
+	for _, packet := range wire.packets {
+		data, err := packet.Marshal()
+		if err != nil {
+			t.Fatalf("failed to marshal sent packet: %v", err)
+		}
+		switch {
+		case packet.SSRC == testFECSSRC:
+			fec.packets = append(fec.packets, data)
+			readAll(t, fecReader)
+		case !lost[packet.SequenceNumber]:
+			media.packets = append(media.packets, data)
+		}
+		// Recovered packets are read with the next read of their stream
+		for _, read := range readAll(t, mediaReader) {
+			received[read.SequenceNumber] = read
+		}
+	}
+	return received
+}
+
+// checkReceived checks that packets were read, or not if they were lost and not expected to be recovered
+func checkReceived(t *testing.T, packets []*rtp.Packet, received map[uint16]*rtp.Packet, lost map[uint16]bool, recovered []uint16) {
+	t.Helper()
+	expected := make(map[uint16]bool)
+	for _, seq := range recovered {
+		expected[seq] = true
+	}
+	for _, original := range packets {
+		seq := original.SequenceNumber
+		got, ok := received[seq]
+		if lost[seq] && !expected[seq] {
+			if ok {
+				t.Fatalf("packet %d was recovered, expected it to stay lost", seq)
+			}
+			continue
+		}
+		if !ok {
+			t.Fatalf("packet %d was not read", seq)
+		}
+		if got.Timestamp != original.Timestamp || got.Marker != original.Marker || got.PayloadType != original.PayloadType {
+			t.Fatalf("packet %d read with timestamp %d, marker %v and payload type %d, expected %d, %v and %d", seq,
+				got.Timestamp, got.Marker, got.PayloadType, original.Timestamp, original.Marker, original.PayloadType)
+		}
+		if !bytes.Equal(got.Payload, original.Payload) {
+			t.Fatalf("packet %d read with payload of %d bytes differing from original of %d bytes",
+				seq, len(got.Payload), len(original.Payload))
+		}
+	}
+}
+
+// TestFECRecoversLoss checks a single loss per FEC packet being recovered, wherever in the group it is
+func TestFECRecoversLoss(t *testing.T) {
+	packets := testPackets(testVideoSSRC, 96, 1000, 20)
+	// FEC packets of a group cover every other packet, one loss each is recovered
+	lost := map[uint16]bool{1000: true, 1007: true, 1013: true, 1018: true}
+	received := sendVideo(t, 2, packets, lost)
+	checkReceived(t, packets, received, lost, []uint16{1000, 1007, 1013, 1018})
+}
+
+// TestFECTooMuchLoss checks that losing more packets than a FEC packet covers recovers nothing of them
+func TestFECTooMuchLoss(t *testing.T) {
+	packets := testPackets(testVideoSSRC, 96, 2000, 10)
+	lost := map[uint16]bool{2004: true, 2005: true}
+	received := sendVideo(t, 1, packets, lost)
+	checkReceived(t, packets, received, lost, nil)
+}
+
+// TestFECWraparound checks groups spanning the sequence number wraparound
+func TestFECWraparound(t *testing.T) {
+	packets := testPackets(testVideoSSRC, 96, 65530, 20)
+	lost := map[uint16]bool{65535: true, 8: true}
+	received := sendVideo(t, 1, packets, lost)
+	checkReceived(t, packets, received, lost, []uint16{65535, 8})
+}
+
+// TestFECUnprotected checks that an unprotected link sends no FEC packets
+func TestFECUnprotected(t *testing.T) {
+	packets := testPackets(testVideoSSRC, 96, 3000, 20)
+	lost := map[uint16]bool{3003: true}
+	received := sendVideo(t, 0, packets, lost)
+	checkReceived(t, packets, received, lost, nil)
+}
+
+// sendAudio sends Opus packets over a link, losing some of them. Returns packets read on the receiving side in order
+func sendAudio(t *testing.T, fecPackets int, packets []*rtp.Packet, lost map[uint16]bool) []*rtp.Packet {
+	t.Helper()
+	wire := &testWire{}
+	writer := newTestProtection(t, fecPackets).BindLocalStream(&interceptor.StreamInfo{
+		SSRC:     testAudioSSRC,
+		MimeType: webrtc.MimeTypeOpus,
+	}, wire)
+	send(t, writer, packets)
+
+	queue := &testQueue{}
+	for _, packet := range wire.packets {
+		if fecPackets > 0 && packet.PayloadType != redPayloadType {
+			t.Fatalf("packet %d sent with payload type %d, expected RED", packet.SequenceNumber, packet.PayloadType)
+		}
+		if lost[packet.SequenceNumber] {
+			continue
+		}
+		data, err := packet.Marshal()
+		if err != nil {
+			t.Fatalf("failed to marshal sent packet: %v", err)
+		}
+		queue.packets = append(queue.packets, data)
+	}
+	return readAll(t, newTestProtection(t, 0).BindRemoteStream(&interceptor.StreamInfo{
+		SSRC:     testAudioSSRC,
+		MimeType: webrtc.MimeTypeOpus,
+	}, queue))
+}
+
+// TestREDRecoversLoss checks that a lost Opus packet is recovered from the next one, in order
+func TestREDRecoversLoss(t *testing.T) {
+	packets := testPackets(testAudioSSRC, 111, 100, 10)
+	// Of two consecutive losses only the latter is in the next packet
+	lost := map[uint16]bool{102: true, 105: true, 106: true}
+	read := sendAudio(t, 1, packets, lost)
+
+	received := make(map[uint16]*rtp.Packet)
+	var order []uint16
+	for _, packet := range read {
+		received[packet.SequenceNumber] = packet
+		order = append(order, packet.SequenceNumber)
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] <= order[i-1] {
+			t.Fatalf("packets read out of order: %v", order)
+		}
+	}
+	// Recovered packets have no marker, the originals of these don't either
+	checkReceived(t, packets, received, lost, []uint16{102, 106})
+}
+
+// TestREDUnprotected checks that Opus packets of an unprotected link are sent and read as is
+func TestREDUnprotected(t *testing.T) {
+	packets := testPackets(testAudioSSRC, 111, 500, 6)
+	lost := map[uint16]bool{502: true}
+	read := sendAudio(t, 0, packets, lost)
+
+	received := make(map[uint16]*rtp.Packet)
+	for _, packet := range read {
+		received[packet.SequenceNumber] = packet
+	}
+	checkReceived(t, packets, received, lost, nil)
+}
+
+// TestLinkProtectionNegotiated checks that FlexFEC and RED are negotiated between relays, and that a protected link
+// delivers its streams without RED and with the FEC stream received
+func TestLinkProtectionNegotiated(t *testing.T) {
+	api, err := NewWebRTCAPI(WebRTCConfig{})
+	if err != nil {
+		t.Fatalf("failed to create WebRTC API: %v", err)
+	}
+	sender, err := api.CreatePeerConnection(func() {})
+	if err != nil {
+		t.Fatalf("failed to create sending PeerConnection: %v", err)
+	}
+	defer func() { _ = sender.Close() }()
+	receiver, err := api.CreatePeerConnection(func() {})
+	if err != nil {
+		t.Fatalf("failed to create receiving PeerConnection: %v", err)
+	}
+	defer func() { _ = receiver.Close() }()
+
+	audio, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "test")
+	video, _ := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "test")
+	for _, track := range []*webrtc.TrackLocalStaticRTP{audio, video} {
+		if _, err = sender.AddTrack(track); err != nil {
+			t.Fatalf("failed to add track: %v", err)
+		}
+	}
+
+	audioRead := make(chan *rtp.Packet, 100)
+	receiver.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			if err := api.ReceiveFEC(receiver, track); err != nil {
+				t.Errorf("failed to receive FEC: %v", err)
+			}
+		}
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			if track.Kind() == webrtc.RTPCodecTypeAudio {
+				audioRead <- packet
+			}
+		}
+	})
+
+	connectTestPeers(t, sender, receiver)
+	if fec, _ := fecSSRC(receiver.RemoteDescription(), sender.GetSenders()[1].GetParameters().Encodings[0].SSRC); fec == 0 {
+		t.Fatalf("FlexFEC stream of the video track was not negotiated")
+	}
+	if !api.ProtectLink(sender, 2) {
+		t.Fatalf("failed to protect link")
+	}
+
+	deadline := time.After(10 * time.Second)
+	for seq := uint16(0); ; seq++ {
+		for _, packet := range append(testPackets(0, 111, seq, 1), testPackets(0, 96, seq, 1)...) {
+			track := audio
+			if packet.PayloadType == 96 {
+				track = video
+			}
+			if err = track.WriteRTP(packet); err != nil {
+				t.Fatalf("failed to write packet: %v", err)
+			}
+		}
+		select {
+		case packet := <-audioRead:
+			if packet.PayloadType != 111 {
+				t.Fatalf("audio packet read with payload type %d, expected Opus", packet.PayloadType)
+			}
+			// Protected packets were sent and unwrapped for a while, RED must be what they were sent as
+			if protection, ok := api.protections.Get(sender); ok && seq > 50 {
+				if red, fec := protection.payloadTypes(); red != redPayloadType || fec != fecPayloadType {
+					t.Fatalf("negotiated RED %d and FlexFEC %d, expected %d and %d", red, fec, redPayloadType, fecPayloadType)
+				}
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no audio read over the protected link")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// connectTestPeers negotiates a PeerConnection offering to another, waiting until both gathered candidates
+func connectTestPeers(t *testing.T, offerer, answerer *webrtc.PeerConnection) {
+	t.Helper()
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("failed to create offer: %v", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err = offerer.SetLocalDescription(offer); err != nil {
+		t.Fatalf("failed to set offer: %v", err)
+	}
+	<-gathered
+	offer, err = WithoutFECSources(*offerer.LocalDescription())
+	if err != nil {
+		t.Fatalf("failed to strip FEC sources of offer: %v", err)
+	}
+	if err = answerer.SetRemoteDescription(offer); err != nil {
+		t.Fatalf("failed to set remote offer: %v", err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("failed to create answer: %v", err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err = answerer.SetLocalDescription(answer); err != nil {
+		t.Fatalf("failed to set answer: %v", err)
+	}
+	<-gathered
+	if err = offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		t.Fatalf("failed to set remote answer: %v", err)
+	}
+}
+
+// TestWithoutFEC checks FEC streams being left out of offers, with their groups kept for relays only
+func TestWithoutFEC(t *testing.T) {
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=-\r\nt=0 0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96 118\r\nc=IN IP4 0.0.0.0\r\na=mid:0\r\n" +
+		"a=ssrc-group:FEC-FR 1234 5678\r\na=ssrc:1234 cname:test\r\na=ssrc:5678 cname:test\r\n"}
+
+	relayOffer, err := WithoutFECSources(offer)
+	if err != nil {
+		t.Fatalf("failed to strip FEC sources: %v", err)
+	}
+	participantOffer, err := WithoutFEC(offer)
+	if err != nil {
+		t.Fatalf("failed to strip FEC: %v", err)
+	}
+	for _, c := range []struct {
+		sdp      string
+		contains string
+		expected bool
+	}{
+		{relayOffer.SDP, "a=ssrc:1234 ", true},
+		{relayOffer.SDP, "a=ssrc:5678 ", false},
+		{relayOffer.SDP, "a=ssrc-group:FEC-FR 1234 5678", true},
+		{participantOffer.SDP, "a=ssrc:1234 ", true},
+		{participantOffer.SDP, "a=ssrc:5678 ", false},
+		{participantOffer.SDP, "a=ssrc-group:FEC-FR", false},
+	} {
+		if strings.Contains(c.sdp, c.contains) != c.expected {
+			t.Fatalf("offer containing %q is %v, expected %v:\n%s", c.contains, !c.expected, c.expected, c.sdp)
+		}
+	}
+}
@@ -6,12 +6,9 @@ import (
 	"net"
 	"os"
 	"strconv"
-
-	"github.com/pion/webrtc/v4"
 )
 
-var globalFlags *Flags
-
+// Flags are the command line flags of the relay, defaulting to environment variables
 type Flags struct {
 	RegenIdentity  bool   // Remove old identity on startup and regenerate it
 	Verbose        bool   // Log everything to console
@@ -24,6 +21,9 @@ type Flags struct {
 	AutoAddLocalIP bool   // Automatically add local IP to NAT 1 to 1 IPs
 	NAT11IP        string // WebRTC NAT 1 to 1 IP - allows specifying IP of relay if behind NAT
 	PersistDir     string // Directory to save persistent data to
+	TrustRoots     string // Comma separated relay IDs which may approve new mesh members, admission is open if empty
+	ApproveRelay   string // Relay ID to sign a mesh admission approval for, relay exits after printing it
+	VideoCodecs    string // Comma separated video codecs pushes may use, most preferred first, any codec if empty
 }
 
 func (flags *Flags) DebugLog() {
@@ -39,6 +39,9 @@ func (flags *Flags) DebugLog() {
 		"autoAddLocalIP", flags.AutoAddLocalIP,
 		"webrtcNAT11IPs", flags.NAT11IP,
 		"persistDir", flags.PersistDir,
+		"trustRoots", flags.TrustRoots,
+		"approveRelay", flags.ApproveRelay,
+		"videoCodecs", flags.VideoCodecs,
 	)
 }
 
@@ -68,48 +71,43 @@ func getEnvAsString(name string, defaultVal string) string {
 	return valueStr
 }
 
-func InitFlags() {
+// ParseFlags parses the command line flags
+func ParseFlags() *Flags {
 	// Create Flags struct
-	globalFlags = &Flags{}
+	flags := &Flags{}
 	// Get flags
-	flag.BoolVar(&globalFlags.RegenIdentity, "regenIdentity", getEnvAsBool("REGEN_IDENTITY", false), "Regenerate identity on startup")
-	flag.BoolVar(&globalFlags.Verbose, "verbose", getEnvAsBool("VERBOSE", false), "Verbose mode")
-	flag.BoolVar(&globalFlags.Debug, "debug", getEnvAsBool("DEBUG", false), "Debug mode")
-	flag.IntVar(&globalFlags.EndpointPort, "endpointPort", getEnvAsInt("ENDPOINT_PORT", 8088), "HTTP endpoint port")
-	flag.IntVar(&globalFlags.WebRTCUDPStart, "webrtcUDPStart", getEnvAsInt("WEBRTC_UDP_START", 0), "WebRTC UDP port range start")
-	flag.IntVar(&globalFlags.WebRTCUDPEnd, "webrtcUDPEnd", getEnvAsInt("WEBRTC_UDP_END", 0), "WebRTC UDP port range end")
-	flag.StringVar(&globalFlags.STUNServer, "stunServer", getEnvAsString("STUN_SERVER", "stun.l.google.com:19302"), "WebRTC STUN server")
-	flag.IntVar(&globalFlags.UDPMuxPort, "webrtcUDPMux", getEnvAsInt("WEBRTC_UDP_MUX", 8088), "WebRTC UDP mux port")
-	flag.BoolVar(&globalFlags.AutoAddLocalIP, "autoAddLocalIP", getEnvAsBool("AUTO_ADD_LOCAL_IP", true), "Automatically add local IP to NAT 1 to 1 IPs")
+	flag.BoolVar(&flags.RegenIdentity, "regenIdentity", getEnvAsBool("REGEN_IDENTITY", false), "Regenerate identity on startup")
+	flag.BoolVar(&flags.Verbose, "verbose", getEnvAsBool("VERBOSE", false), "Verbose mode")
+	flag.BoolVar(&flags.Debug, "debug", getEnvAsBool("DEBUG", false), "Debug mode")
+	flag.IntVar(&flags.EndpointPort, "endpointPort", getEnvAsInt("ENDPOINT_PORT", 8088), "HTTP endpoint port")
+	flag.IntVar(&flags.WebRTCUDPStart, "webrtcUDPStart", getEnvAsInt("WEBRTC_UDP_START", 0), "WebRTC UDP port range start")
+	flag.IntVar(&flags.WebRTCUDPEnd, "webrtcUDPEnd", getEnvAsInt("WEBRTC_UDP_END", 0), "WebRTC UDP port range end")
+	flag.StringVar(&flags.STUNServer, "stunServer", getEnvAsString("STUN_SERVER", "stun.l.google.com:19302"), "WebRTC STUN server")
+	flag.IntVar(&flags.UDPMuxPort, "webrtcUDPMux", getEnvAsInt("WEBRTC_UDP_MUX", 8088), "WebRTC UDP mux port")
+	flag.BoolVar(&flags.AutoAddLocalIP, "autoAddLocalIP", getEnvAsBool("AUTO_ADD_LOCAL_IP", true), "Automatically add local IP to NAT 1 to 1 IPs")
 	// String with comma separated IPs
 	nat11IP := ""
 	flag.StringVar(&nat11IP, "webrtcNAT11IP", getEnvAsString("WEBRTC_NAT_IP", ""), "WebRTC NAT 1 to 1 IP")
-	flag.StringVar(&globalFlags.PersistDir, "persistDir", getEnvAsString("PERSIST_DIR", "./persist-data"), "Directory to save persistent data to")
+	flag.StringVar(&flags.PersistDir, "persistDir", getEnvAsString("PERSIST_DIR", "./persist-data"), "Directory to save persistent data to")
+	flag.StringVar(&flags.TrustRoots, "trustRoots", getEnvAsString("TRUST_ROOTS", ""), "Comma separated relay IDs allowed to approve new mesh members")
+	flag.StringVar(&flags.ApproveRelay, "approveRelay", "", "Sign a mesh admission approval for given relay ID and exit")
+	flag.StringVar(&flags.VideoCodecs, "videoCodecs", getEnvAsString("VIDEO_CODECS", ""), "Comma separated video codecs pushes may use, most preferred first")
 	// Parse flags
 	flag.Parse()
 
 	// If debug is enabled, verbose is also enabled
-	if globalFlags.Debug {
-		globalFlags.Verbose = true
-	}
-
-	// ICE STUN servers
-	globalWebRTCConfig.ICEServers = []webrtc.ICEServer{
-		{
-			URLs: []string{"stun:" + globalFlags.STUNServer},
-		},
+	if flags.Debug {
+		flags.Verbose = true
 	}
 
 	// Parse NAT 1 to 1 IPs from string
 	if len(nat11IP) > 0 {
-		globalFlags.NAT11IP = nat11IP
-	} else if globalFlags.AutoAddLocalIP {
-		globalFlags.NAT11IP = getLocalIP()
+		flags.NAT11IP = nat11IP
+	} else if flags.AutoAddLocalIP {
+		flags.NAT11IP = getLocalIP()
 	}
-}
 
-func GetFlags() *Flags {
-	return globalFlags
+	return flags
 }
 
 // getLocalIP returns local IP, be it either IPv4 or IPv6, skips loopback addresses
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// hlcCounterBits is the amount of low bits of a HLC timestamp used for the logical counter
+const hlcCounterBits = 16
+
+// HLC is a hybrid logical clock, producing timestamps that follow wall clock time
+// but always increase and order after any timestamp observed from other relays.
+// Timestamps are packed into an uint64: milliseconds since epoch << 16 | logical counter
+type HLC struct {
+	mutex sync.Mutex
+	last  uint64
+}
+
+func NewHLC() *HLC {
+	return &HLC{}
+}
+
+// Now returns a new timestamp, greater than any previously returned or observed one
+func (c *HLC) Now() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	physical := uint64(time.Now().UnixMilli()) << hlcCounterBits
+	if physical > c.last {
+		c.last = physical
+	} else {
+		c.last++
+	}
+	return c.last
+}
+
+// Update merges a timestamp received from another relay into the clock
+func (c *HLC) Update(remote uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if remote > c.last {
+		c.last = remote
+	}
+}
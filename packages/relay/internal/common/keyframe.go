@@ -0,0 +1,110 @@
+package common
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Keyframe Detection ---
+// Forwarding switches between video sources, such as simulcast layers, only at a keyframe of the new source,
+// receivers can't decode the new source before one
+
+// IsKeyframeStart checks if an RTP payload of given codec starts a keyframe, or carries the parameter sets
+// sent right before one. Payloads of codecs without detection always count as keyframe starts
+func IsKeyframeStart(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264KeyframeStart(payload)
+	case strings.ToLower(webrtc.MimeTypeH265):
+		return isH265KeyframeStart(payload)
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		var packet codecs.VP8Packet
+		if _, err := packet.Unmarshal(payload); err != nil || len(packet.Payload) == 0 {
+			return false
+		}
+		// Start of the first partition, with the inverse key frame flag of the frame header unset
+		return packet.S == 1 && packet.PID == 0 && packet.Payload[0]&0x01 == 0
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		var packet codecs.VP9Packet
+		if _, err := packet.Unmarshal(payload); err != nil {
+			return false
+		}
+		return packet.B && !packet.P
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		var packet codecs.AV1Packet
+		if _, err := packet.Unmarshal(payload); err != nil {
+			return false
+		}
+		return packet.N
+	default:
+		return true
+	}
+}
+
+// isH264KeyframeStart checks for an IDR slice or SPS in a single NAL unit, STAP-A or the first FU-A fragment
+func isH264KeyframeStart(payload []byte) bool {
+	const (
+		naluIDR   = 5
+		naluSPS   = 7
+		naluSTAPA = 24
+		naluFUA   = 28
+	)
+	if len(payload) < 2 {
+		return false
+	}
+	switch naluType := payload[0] & 0x1f; naluType {
+	case naluIDR, naluSPS:
+		return true
+	case naluSTAPA:
+		for offset := 1; offset+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[offset:]))
+			if nalu := payload[offset+2]; nalu&0x1f == naluIDR || nalu&0x1f == naluSPS {
+				return true
+			}
+			offset += 2 + size
+		}
+		return false
+	case naluFUA:
+		start := payload[1]&0x80 != 0
+		return start && payload[1]&0x1f == naluIDR
+	default:
+		return false
+	}
+}
+
+// isH265KeyframeStart checks for an IRAP picture or VPS/SPS in a single NAL unit, aggregation packet or the first fragment
+func isH265KeyframeStart(payload []byte) bool {
+	const (
+		naluIRAPFirst = 16
+		naluIRAPLast  = 23
+		naluVPS       = 32
+		naluSPS       = 33
+		naluAP        = 48
+		naluFU        = 49
+	)
+	keyframeType := func(naluType byte) bool {
+		return (naluType >= naluIRAPFirst && naluType <= naluIRAPLast) || naluType == naluVPS || naluType == naluSPS
+	}
+	if len(payload) < 3 {
+		return false
+	}
+	switch naluType := (payload[0] >> 1) & 0x3f; naluType {
+	case naluAP:
+		for offset := 2; offset+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[offset:]))
+			if keyframeType((payload[offset+2] >> 1) & 0x3f) {
+				return true
+			}
+			offset += 2 + size
+		}
+		return false
+	case naluFU:
+		start := payload[2]&0x80 != 0
+		return start && keyframeType(payload[2]&0x3f)
+	default:
+		return keyframeType(naluType)
+	}
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// --- RED ---
+// Opus packets of protected links are sent as RED (RFC 2198), carrying the previous packet as redundant block.
+// A lost packet is recovered from the redundancy of the next one
+
+var errInvalidRED = errors.New("invalid RED payload")
+
+// redBlock is a redundant block of a RED payload
+type redBlock struct {
+	payloadType     uint8
+	timestampOffset uint32
+	payload         []byte
+}
+
+// redWriter sends the packets of an Opus stream as RED while the link is protected
+type redWriter struct {
+	link   *linkProtection
+	writer interceptor.RTPWriter
+
+	mutex    sync.Mutex
+	previous *rtp.Packet // Previous packet sent while protected, nil if none
+}
+
+func (w *redWriter) Write(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+	red, _ := w.link.payloadTypes()
+	if red == 0 || w.link.fecPackets.Load() == 0 {
+		w.mutex.Lock()
+		w.previous = nil
+		w.mutex.Unlock()
+		return w.writer.Write(header, payload, attributes)
+	}
+
+	w.mutex.Lock()
+	redPayload := encodeRED(header, payload, w.previous)
+	w.previous = &rtp.Packet{Header: header.Clone(), Payload: append([]byte(nil), payload...)}
+	w.mutex.Unlock()
+
+	redHeader := header.Clone()
+	redHeader.PayloadType = red
+	return w.writer.Write(&redHeader, redPayload, attributes)
+}
+
+// encodeRED builds the RED payload of a packet, with the previous packet as redundant block if it directly precedes it
+func encodeRED(header *rtp.Header, payload []byte, previous *rtp.Packet) []byte {
+	if previous != nil && previous.SequenceNumber == header.SequenceNumber-1 {
+		// Block header: F bit, payload type, 14 bit timestamp offset and 10 bit block length
+		offset := header.Timestamp - previous.Timestamp
+		if offset < 1<<14 && len(previous.Payload) < 1<<10 {
+			fields := offset<<10 | uint32(len(previous.Payload))
+			red := make([]byte, 0, 5+len(previous.Payload)+len(payload))
+			red = append(red, 0x80|previous.PayloadType, byte(fields>>16), byte(fields>>8), byte(fields))
+			red = append(red, header.PayloadType)
+			red = append(red, previous.Payload...)
+			return append(red, payload...)
+		}
+	}
+	red := make([]byte, 0, 1+len(payload))
+	red = append(red, header.PayloadType)
+	return append(red, payload...)
+}
+
+// decodeRED splits a RED payload into its primary payload type and payload, and its redundant blocks oldest first
+func decodeRED(payload []byte) (uint8, []byte, []redBlock, error) {
+	var blocks []redBlock
+	offset := 0
+	for {
+		if len(payload) <= offset {
+			return 0, nil, nil, errInvalidRED
+		}
+		if payload[offset]&0x80 == 0 {
+			break
+		}
+		if len(payload) < offset+4 {
+			return 0, nil, nil, errInvalidRED
+		}
+		fields := uint32(payload[offset+1])<<16 | uint32(payload[offset+2])<<8 | uint32(payload[offset+3])
+		blocks = append(blocks, redBlock{
+			payloadType:     payload[offset] & 0x7F,
+			timestampOffset: fields >> 10,
+			payload:         make([]byte, fields&0x3FF),
+		})
+		offset += 4
+	}
+	primaryType := payload[offset] & 0x7F
+	offset++
+
+	for i := range blocks {
+		if len(payload) < offset+len(blocks[i].payload) {
+			return 0, nil, nil, errInvalidRED
+		}
+		offset += copy(blocks[i].payload, payload[offset:])
+	}
+	return primaryType, payload[offset:], blocks, nil
+}
+
+// unwrapRED queues the primary packet of a received RED packet to be read, after packets lost before it
+// that are recovered from its redundant blocks
+func (s *protectedStream) unwrapRED(data []byte) {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(append([]byte(nil), data...)); err != nil {
+		return
+	}
+	primaryType, primary, blocks, err := decodeRED(packet.Payload)
+	if err != nil {
+		return
+	}
+
+	lost := s.receivedSeq(packet.SequenceNumber)
+	var packets []*rtp.Packet
+	// Blocks are the packets directly preceding the primary one, the latest last
+	for i := min(int(lost), len(blocks)); i > 0; i-- {
+		block := blocks[len(blocks)-i]
+		header := packet.Header.Clone()
+		header.Marker = false
+		header.PayloadType = block.payloadType
+		header.SequenceNumber = packet.SequenceNumber - uint16(i)
+		header.Timestamp = packet.Timestamp - block.timestampOffset
+		packets = append(packets, &rtp.Packet{Header: header, Payload: block.payload})
+	}
+	packet.PayloadType = primaryType
+	packet.Payload = primary
+	packets = append(packets, packet)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queue(packets...)
+}
@@ -0,0 +1,216 @@
+package common
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Retransmissions ---
+// Forwarded video packets are kept per local track, shared by all receivers of the track. NACKs of receivers
+// are answered from it with RTX, so loss on the hop to a receiver doesn't travel back to the runner.
+// Loss on the runner's uplink is recovered by the NACKs we send for incoming streams
+
+const packetHistorySize = 4096 // Packets kept per local track, a power of 2, about a second of video at high bitrates
+
+// PacketHistory keeps the latest packets forwarded to a local track, by sequence number
+type PacketHistory struct {
+	mutex   sync.RWMutex
+	packets [packetHistorySize]*rtp.Packet
+}
+
+// Add keeps a copy of a packet, replacing the packet sent packetHistorySize sequence numbers before
+func (h *PacketHistory) Add(packet *rtp.Packet) {
+	clone := packet.Clone()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.packets[packet.SequenceNumber%packetHistorySize] = clone
+}
+
+// Get returns the kept packet with given sequence number, nil if it's not kept anymore
+func (h *PacketHistory) Get(seq uint16) *rtp.Packet {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if packet := h.packets[seq%packetHistorySize]; packet != nil && packet.SequenceNumber == seq {
+		return packet
+	}
+	return nil
+}
+
+// TrackWriter writes packets forwarded to the local tracks of a relay, keeping what retransmissions and taps
+// of in-process receivers need
+type TrackWriter interface {
+	// WriteRTP writes a packet to a local track
+	WriteRTP(track *webrtc.TrackLocalStaticRTP, packet *rtp.Packet) error
+	// ForgetTrack drops what is kept for a local track that is no longer forwarded to
+	ForgetTrack(track *webrtc.TrackLocalStaticRTP)
+	// TapTrack passes packets forwarded to a local track to given function, until untapped by key
+	TapTrack(track *webrtc.TrackLocalStaticRTP, key any, tap func(packet *rtp.Packet))
+	// UntapTrack removes a tap added with TapTrack
+	UntapTrack(track *webrtc.TrackLocalStaticRTP, key any)
+}
+
+// KeepPacket keeps a video packet forwarded to a local track for retransmissions to its receivers
+func (w *WebRTCAPI) KeepPacket(track *webrtc.TrackLocalStaticRTP, packet *rtp.Packet) {
+	if track.Kind() != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	history, ok := w.histories.Get(track)
+	if !ok {
+		history, _ = w.histories.LoadOrStore(track, &PacketHistory{})
+	}
+	history.Add(packet)
+}
+
+// ForgetPackets drops the packet history of a local track that is no longer forwarded to
+func (w *WebRTCAPI) ForgetPackets(track *webrtc.TrackLocalStaticRTP) {
+	w.histories.Delete(track)
+}
+
+// retransmitter answers NACKs of a PeerConnection's receivers from the packet history of the sent tracks
+type retransmitter struct {
+	interceptor.NoOp
+	pc        *webrtc.PeerConnection
+	histories *SafeMap[*webrtc.TrackLocalStaticRTP, *PacketHistory] // local track -> packets forwarded to it
+
+	mutex   sync.Mutex
+	streams map[uint32]*retransmitStream // SSRC -> sent stream
+}
+
+// retransmitStream is a sent stream retransmissions are written to
+type retransmitStream struct {
+	info   *interceptor.StreamInfo
+	writer interceptor.RTPWriter
+
+	mutex  sync.Mutex
+	rtxSeq uint16 // Sequence number of the latest RTX packet
+}
+
+// retransmitterFactory creates retransmitters, handed to CreatePeerConnection while a PeerConnection is created
+type retransmitterFactory struct {
+	api *WebRTCAPI
+}
+
+func (f retransmitterFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	r := &retransmitter{
+		histories: f.api.histories,
+		streams:   make(map[uint32]*retransmitStream),
+	}
+	f.api.nextRetransmitter = r
+	return r, nil
+}
+
+// BindLocalStream keeps the writer of sent streams supporting NACK, packets are passed through as is
+func (r *retransmitter) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	for _, feedback := range info.RTCPFeedback {
+		if feedback.Type == "nack" && len(feedback.Parameter) == 0 {
+			r.mutex.Lock()
+			r.streams[info.SSRC] = &retransmitStream{info: info, writer: writer}
+			r.mutex.Unlock()
+			break
+		}
+	}
+	return writer
+}
+
+func (r *retransmitter) UnbindLocalStream(info *interceptor.StreamInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.streams, info.SSRC)
+}
+
+// BindRTCPReader answers NACKs in RTCP from receivers
+func (r *retransmitter) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		i, attr, err := reader.Read(b, a)
+		if err != nil {
+			return 0, nil, err
+		}
+		if attr == nil {
+			attr = make(interceptor.Attributes)
+		}
+		packets, err := attr.GetRTCPPackets(b[:i])
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, packet := range packets {
+			if nack, ok := packet.(*rtcp.TransportLayerNack); ok {
+				go r.resend(nack)
+			}
+		}
+		return i, attr, nil
+	})
+}
+
+// resend retransmits the packets a NACK asks for, from the history of the track sent on the NACKed stream
+func (r *retransmitter) resend(nack *rtcp.TransportLayerNack) {
+	r.mutex.Lock()
+	stream, ok := r.streams[nack.MediaSSRC]
+	r.mutex.Unlock()
+	if !ok || r.pc == nil {
+		return
+	}
+	history := r.historyOf(nack.MediaSSRC)
+	if history == nil {
+		return
+	}
+
+	for _, pair := range nack.Nacks {
+		pair.Range(func(seq uint16) bool {
+			if packet := history.Get(seq); packet != nil {
+				if err := stream.write(packet); err != nil {
+					slog.Debug("Failed to retransmit packet", "ssrc", nack.MediaSSRC, "seq", seq, "err", err)
+				}
+			}
+			return true
+		})
+	}
+}
+
+// historyOf returns the packet history of the track currently sent on given SSRC
+func (r *retransmitter) historyOf(ssrc uint32) *PacketHistory {
+	for _, sender := range r.pc.GetSenders() {
+		for _, encoding := range sender.GetParameters().Encodings {
+			if uint32(encoding.SSRC) != ssrc {
+				continue
+			}
+			if track, ok := sender.Track().(*webrtc.TrackLocalStaticRTP); ok {
+				if history, ok := r.histories.Get(track); ok {
+					return history
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// write retransmits a packet on the stream, as RTX if negotiated
+func (s *retransmitStream) write(packet *rtp.Packet) error {
+	header := packet.Header.Clone()
+	header.Padding = false
+	if s.info.SSRCRetransmission == 0 || s.info.PayloadTypeRetransmission == 0 {
+		header.SSRC = s.info.SSRC
+		header.PayloadType = s.info.PayloadType
+		_, err := s.writer.Write(&header, packet.Payload, interceptor.Attributes{})
+		return err
+	}
+
+	// RTX payload is the original sequence number followed by the original payload (RFC 4588)
+	s.mutex.Lock()
+	s.rtxSeq++
+	header.SequenceNumber = s.rtxSeq
+	s.mutex.Unlock()
+	header.SSRC = s.info.SSRCRetransmission
+	header.PayloadType = s.info.PayloadTypeRetransmission
+	payload := make([]byte, 2+len(packet.Payload))
+	binary.BigEndian.PutUint16(payload, packet.SequenceNumber)
+	copy(payload[2:], packet.Payload)
+	_, err := s.writer.Write(&header, payload, interceptor.Attributes{})
+	return err
+}
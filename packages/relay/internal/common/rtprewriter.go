@@ -0,0 +1,69 @@
+package common
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// RTPRewriter keeps sequence numbers and timestamps of a forwarded track continuous when its source changes,
+// such as a runner reconnect or an upstream relay failover. Packets of a new source continue right after
+// the latest forwarded packet, with timestamps advanced by the wall clock time passed in between.
+// SSRC is not touched, local tracks rewrite it for each receiver already
+type RTPRewriter struct {
+	mutex     sync.Mutex
+	clockRate uint32
+
+	sourceSSRC uint32    // SSRC of the current source
+	switched   bool      // Set on explicit source switch, offsets are recalculated on the next packet
+	started    bool      // Whether any packet has been rewritten yet
+	seqOffset  uint16    // Added to sequence numbers of the current source
+	tsOffset   uint32    // Added to timestamps of the current source
+	lastSeq    uint16    // Latest rewritten sequence number
+	lastTS     uint32    // Timestamp of the latest rewritten packet
+	lastWrite  time.Time // When the latest packet was rewritten
+}
+
+func NewRTPRewriter(clockRate uint32) *RTPRewriter {
+	return &RTPRewriter{
+		clockRate: clockRate,
+	}
+}
+
+// SwitchSource marks the start of a new source, needed when the new source may keep the previous SSRC
+func (rw *RTPRewriter) SwitchSource() {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	rw.switched = true
+}
+
+// Rewrite rewrites sequence number and timestamp of a packet in place
+func (rw *RTPRewriter) Rewrite(packet *rtp.Packet) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	if rw.switched || packet.SSRC != rw.sourceSSRC {
+		if rw.started {
+			tsGap := uint32(time.Since(rw.lastWrite).Seconds() * float64(rw.clockRate))
+			if tsGap == 0 {
+				tsGap = 1
+			}
+			rw.seqOffset = rw.lastSeq + 1 - packet.SequenceNumber
+			rw.tsOffset = rw.lastTS + tsGap - packet.Timestamp
+		}
+		rw.sourceSSRC = packet.SSRC
+		rw.switched = false
+	}
+
+	packet.SequenceNumber += rw.seqOffset
+	packet.Timestamp += rw.tsOffset
+
+	// Reordered packets don't move the latest position back
+	if !rw.started || int16(packet.SequenceNumber-rw.lastSeq) > 0 {
+		rw.lastSeq = packet.SequenceNumber
+		rw.lastTS = packet.Timestamp
+		rw.lastWrite = time.Now()
+	}
+	rw.started = true
+}
@@ -16,8 +16,9 @@ const MaxSize = 1024 * 1024
 
 // SafeBufioRW wraps a bufio.ReadWriter for sending and receiving JSON and protobufs safely
 type SafeBufioRW struct {
-	brw   *bufio.ReadWriter
-	mutex sync.RWMutex
+	brw        *bufio.ReadWriter
+	readMutex  sync.Mutex // Separate from writes, a receive waiting on the peer must not hold up sending
+	writeMutex sync.Mutex
 }
 
 func NewSafeBufioRW(brw *bufio.ReadWriter) *SafeBufioRW {
@@ -26,8 +27,8 @@ func NewSafeBufioRW(brw *bufio.ReadWriter) *SafeBufioRW {
 
 // SendJSON serializes the given data as JSON and sends it with a 4-byte length prefix
 func (bu *SafeBufioRW) SendJSON(data interface{}) error {
-	bu.mutex.Lock()
-	defer bu.mutex.Unlock()
+	bu.writeMutex.Lock()
+	defer bu.writeMutex.Unlock()
 
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -54,8 +55,8 @@ func (bu *SafeBufioRW) SendJSON(data interface{}) error {
 
 // ReceiveJSON reads a 4-byte length prefix, then reads and unmarshals the JSON
 func (bu *SafeBufioRW) ReceiveJSON(dest interface{}) error {
-	bu.mutex.RLock()
-	defer bu.mutex.RUnlock()
+	bu.readMutex.Lock()
+	defer bu.readMutex.Unlock()
 
 	// Read the 4-byte length prefix
 	var length uint32
@@ -78,8 +79,8 @@ func (bu *SafeBufioRW) ReceiveJSON(dest interface{}) error {
 
 // Receive reads a 4-byte length prefix, then reads the raw data
 func (bu *SafeBufioRW) Receive() ([]byte, error) {
-	bu.mutex.RLock()
-	defer bu.mutex.RUnlock()
+	bu.readMutex.Lock()
+	defer bu.readMutex.Unlock()
 
 	// Read the 4-byte length prefix
 	var length uint32
@@ -102,8 +103,8 @@ func (bu *SafeBufioRW) Receive() ([]byte, error) {
 
 // SendProto serializes the given protobuf message and sends it with a 4-byte length prefix
 func (bu *SafeBufioRW) SendProto(msg proto.Message) error {
-	bu.mutex.Lock()
-	defer bu.mutex.Unlock()
+	bu.writeMutex.Lock()
+	defer bu.writeMutex.Unlock()
 
 	protoData, err := proto.Marshal(msg)
 	if err != nil {
@@ -130,8 +131,8 @@ func (bu *SafeBufioRW) SendProto(msg proto.Message) error {
 
 // ReceiveProto reads a 4-byte length prefix, then reads and unmarshals the protobuf
 func (bu *SafeBufioRW) ReceiveProto(msg proto.Message) error {
-	bu.mutex.RLock()
-	defer bu.mutex.RUnlock()
+	bu.readMutex.Lock()
+	defer bu.readMutex.Unlock()
 
 	// Read the 4-byte length prefix
 	var length uint32
@@ -154,8 +155,8 @@ func (bu *SafeBufioRW) ReceiveProto(msg proto.Message) error {
 
 // Write writes raw data to the underlying buffer
 func (bu *SafeBufioRW) Write(data []byte) (int, error) {
-	bu.mutex.Lock()
-	defer bu.mutex.Unlock()
+	bu.writeMutex.Lock()
+	defer bu.writeMutex.Unlock()
 
 	if len(data) > MaxSize {
 		return 0, errors.New("data exceeds maximum size")
@@ -42,6 +42,31 @@ func (sm *SafeMap[K, V]) Set(key K, value V) {
 	sm.m[key] = value
 }
 
+// LoadOrStore returns the existing value of the key if present.
+// Otherwise it stores the given value, loaded reports whether the value was already there
+func (sm *SafeMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if v, ok := sm.m[key]; ok {
+		return v, true
+	}
+	sm.m[key] = value
+	return value, false
+}
+
+// Update stores the value f returns for the key, given the current value and whether the key is present.
+// Nothing is stored if f returns false. Returns whether the value was stored
+func (sm *SafeMap[K, V]) Update(key K, f func(current V, ok bool) (V, bool)) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	current, ok := sm.m[key]
+	value, store := f(current, ok)
+	if store {
+		sm.m[key] = value
+	}
+	return store
+}
+
 // Delete removes a key from the map
 func (sm *SafeMap[K, V]) Delete(key K) {
 	sm.mu.Lock()
@@ -49,6 +74,16 @@ func (sm *SafeMap[K, V]) Delete(key K) {
 	delete(sm.m, key)
 }
 
+// LoadAndDelete removes a key from the map, returning its value if present.
+// loaded reports whether the key was there
+func (sm *SafeMap[K, V]) LoadAndDelete(key K) (value V, loaded bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	value, loaded = sm.m[key]
+	delete(sm.m, key)
+	return value, loaded
+}
+
 // Len returns the number of items in the map
 func (sm *SafeMap[K, V]) Len() int {
 	sm.mu.RLock()
@@ -67,6 +102,17 @@ func (sm *SafeMap[K, V]) Copy() map[K]V {
 	return copied
 }
 
+// Keys returns a snapshot of the keys in the map
+func (sm *SafeMap[K, V]) Keys() []K {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	keys := make([]K, 0, len(sm.m))
+	for k := range sm.m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
 // Range iterates over the map and applies a function to each key-value pair
 func (sm *SafeMap[K, V]) Range(f func(K, V) bool) {
 	sm.mu.RLock()
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// --- Track Taps ---
+// Taps receive every packet forwarded to a local track, for in-process receivers of a room such as recorders.
+// Packets are shared with the track, taps must copy what they keep
+
+// TrackTaps holds taps of a local track by key
+type TrackTaps struct {
+	mutex sync.RWMutex
+	taps  map[any]func(packet *rtp.Packet)
+}
+
+func NewTrackTaps() *TrackTaps {
+	return &TrackTaps{
+		taps: make(map[any]func(packet *rtp.Packet)),
+	}
+}
+
+// Tap passes packets forwarded to the track to given function, until untapped by key
+func (t *TrackTaps) Tap(key any, tap func(packet *rtp.Packet)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.taps[key] = tap
+}
+
+// Untap removes a tap added with Tap
+func (t *TrackTaps) Untap(key any) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.taps, key)
+}
+
+// Push passes a packet forwarded to the track to its taps
+func (t *TrackTaps) Push(packet *rtp.Packet) {
+	// Taps may (un)tap while called, don't hold the lock
+	t.mutex.RLock()
+	funcs := make([]func(packet *rtp.Packet), 0, len(t.taps))
+	for _, tap := range t.taps {
+		funcs = append(funcs, tap)
+	}
+	t.mutex.RUnlock()
+	for _, tap := range funcs {
+		tap(packet)
+	}
+}
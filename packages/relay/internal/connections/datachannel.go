@@ -37,8 +37,12 @@ func NewNestriDataChannel(dc *webrtc.DataChannel) *NestriDataChannel {
 			return
 		}
 
-		// Handle message type callback
-		if callback, ok := ndc.callbacks["input"]; ok {
+		// Handle message type callback, messages without a type are input of older clients
+		msgType := base.GetMessageBase().GetPayloadType()
+		if len(msgType) == 0 {
+			msgType = "input"
+		}
+		if callback, ok := ndc.callbacks[msgType]; ok {
 			go callback(msg.Data)
 		} // We don't care about unhandled messages
 	})
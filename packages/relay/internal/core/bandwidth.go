@@ -0,0 +1,98 @@
+package core
+
+import (
+	"context"
+	"log/slog"
+	gen "relay/internal/proto"
+	"relay/internal/shared"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- Bandwidth Feedback ---
+// Every receiver of a room stream, participant or relay, has its own send-side bandwidth estimate.
+// Estimates of a room's receivers are consolidated into a single target bitrate and sent upstream,
+// relay by relay, until it reaches the runner, which can adapt its encoder to it
+
+// feedbackState is the latest target bitrate sent upstream for a room
+type feedbackState struct {
+	bitrate uint64
+	sentAt  time.Time
+}
+
+// periodicBandwidthFeedback collects receiver estimates of local rooms and sends their target bitrate upstream
+func (r *Relay) periodicBandwidthFeedback(ctx context.Context) {
+	ticker := time.NewTicker(bandwidthFeedbackInterval)
+	defer ticker.Stop()
+
+	sent := make(map[ulid.ULID]feedbackState) // room ID -> latest sent target bitrate
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rooms := r.LocalRooms.Copy()
+			for id := range sent {
+				if _, ok := rooms[id]; !ok {
+					delete(sent, id)
+				}
+			}
+			for id, room := range rooms {
+				target := r.roomTargetBitrate(room)
+				if target == 0 {
+					continue
+				}
+				last := sent[id]
+				change := float64(max(target, last.bitrate)-min(target, last.bitrate)) / float64(max(last.bitrate, 1))
+				if change < bandwidthFeedbackChange && time.Since(last.sentAt) < bandwidthFeedbackRefresh {
+					continue
+				}
+				if err := r.sendTargetBitrate(room, target); err != nil {
+					slog.Debug("Failed to send target bitrate upstream", "room", room.Name, "err", err)
+					continue
+				}
+				sent[id] = feedbackState{bitrate: target, sentAt: time.Now()}
+			}
+		}
+	}
+}
+
+// roomTargetBitrate consolidates bandwidth estimates of all receivers of a room, 0 if none is known.
+// Layered rooms ask for what the best receiver takes, lower layers serve the others.
+// Rooms with a single encoding ask for what the weakest receiver takes, so nobody falls behind
+func (r *Relay) roomTargetBitrate(room *shared.Room) uint64 {
+	layered := room.IsLayered()
+	var target uint64
+	consider := func(estimate uint64) {
+		if estimate == 0 {
+			return
+		}
+		if target == 0 || (layered && estimate > target) || (!layered && estimate < target) {
+			target = estimate
+		}
+	}
+
+	for _, participant := range room.Participants.Copy() {
+		consider(participant.UpdateBandwidth(r.WebRTC))
+	}
+	for key, conn := range r.StreamProtocol.servedConns.Copy() {
+		if key.room == room.Name {
+			consider(conn.updateBandwidth(r.WebRTC))
+		}
+	}
+	return target
+}
+
+// sendTargetBitrate sends the target bitrate of a room to the runner pushing it, or the relay we get it from
+func (r *Relay) sendTargetBitrate(room *shared.Room, bitrate uint64) error {
+	data, err := proto.Marshal(&gen.ProtoMessageBitrate{
+		MessageBase:   &gen.ProtoMessageBase{PayloadType: "bitrate"},
+		TargetBitrate: bitrate,
+	})
+	if err != nil {
+		return err
+	}
+	return r.StreamProtocol.sendUpstream(room, data)
+}
@@ -7,7 +7,46 @@ const (
 	// PubSub Topics
 	roomStateTopicName    = "room-states"
 	relayMetricsTopicName = "relay-metrics"
+	relayHealthTopicName  = "relay-health"
 
 	// Timers and Intervals
-	metricsPublishInterval = 15 * time.Second // How often to publish own metrics
+	metricsPublishInterval = 15 * time.Second           // How often to publish own metrics
+	meshAddrTTL            = 3 * metricsPublishInterval // How long addresses advertised in relay metrics are kept for dialing
+	stateSyncTimeout       = 10 * time.Second           // Timeout for recovering a missed room state update
+	roomClaimTimeout       = 10 * time.Second           // Timeout for the owner relay to answer a room claim
+	heartbeatInterval      = 2 * time.Second            // How often to probe a mesh peer for liveness
+	heartbeatTimeout       = 1 * time.Second            // Timeout for a direct liveness probe
+	indirectProbeTimeout   = 3 * time.Second            // Timeout for a liveness probe through another peer
+	suspicionTimeout       = 10 * time.Second           // How long a suspected peer has to refute before declared dead
+	handshakeTimeout       = 10 * time.Second           // Timeout for mesh admission handshake
+	pushReconnectGrace     = 5 * time.Second            // How long pushed room tracks are kept for a reconnecting runner
+	transitStreamTimeout   = 15 * time.Second           // How long to wait for upstream relay to provide a stream we forward
+	closeTimeout           = 2 * time.Second            // How long closing the relay waits for its PeerConnections to close
+
+	// PubSub Limits
+	maxMeshMessageSize = 256 * 1024 // Largest accepted PubSub message, in bytes
+
+	// Failure Detection
+	indirectProbeCount = 3 // How many peers to probe through when a direct probe fails
+
+	// Stream Re-establishment
+	reestablishBackoffMin = 500 * time.Millisecond // First retry delay when re-establishing a lost room stream
+	reestablishBackoffMax = 30 * time.Second       // Longest retry delay when re-establishing a lost room stream
+
+	// Bandwidth Feedback
+	bandwidthFeedbackInterval = 500 * time.Millisecond // How often receiver bandwidth estimates are collected
+	bandwidthFeedbackRefresh  = 5 * time.Second        // How often an unchanged target bitrate is sent upstream again
+	bandwidthFeedbackChange   = 0.1                    // Relative change of the target bitrate sent upstream right away
+
+	// Recording
+	recordingRequestTimeout = 10 * time.Second // Timeout for a recording start or stop request
+
+	// RTCP Routing
+	keyframeRequestInterval = 500 * time.Millisecond // Least time between keyframe requests sent upstream for a room video track
+
+	// Link Protection
+	linkLossSmoothing = 0.3  // Weight of the latest loss report in the smoothed loss of a relay link
+	linkLossProtect   = 0.01 // Smoothed loss over which a relay link is protected with FEC and RED
+	linkLossModerate  = 0.03 // Smoothed loss over which more FEC packets are sent per group
+	linkLossHeavy     = 0.08 // Smoothed loss over which the most FEC packets are sent per group
 )
@@ -3,11 +3,15 @@ package core
 import (
 	"context"
 	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"relay/internal/common"
+	gen "relay/internal/proto"
 	"relay/internal/shared"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
@@ -24,26 +28,56 @@ import (
 	"github.com/pion/webrtc/v4"
 )
 
-// -- Variables --
+// -- Structs --
 
-var globalRelay *Relay
+// Config configures a relay, relays of a process may each have their own
+type Config struct {
+	Port          int                 // Mesh port, for raw TCP and WebSocket
+	Identity      crypto.PrivKey      // Identity of the relay, loaded from or generated into PersistDir if nil, generated for this run only without PersistDir
+	RegenIdentity bool                // Generate a new identity even if PersistDir has one
+	PersistDir    string              // Directory for identity, approvals, recordings and captures, nothing is persisted if empty
+	TrustRoots    []string            // Relay IDs which may approve new mesh members, admission is open if empty
+	VideoCodecs   []string            // MIME types of video codecs pushes may use, most preferred first, any codec if empty
+	DisableMDNS   bool                // Don't discover relays on the local network over mDNS
+	WebRTC        common.WebRTCConfig // Settings of the PeerConnections of the relay
+}
 
-// -- Structs --
+// ConfigFromFlags returns the relay configuration given on the command line
+func ConfigFromFlags(flags *common.Flags) Config {
+	return Config{
+		Port:          flags.EndpointPort,
+		RegenIdentity: flags.RegenIdentity,
+		PersistDir:    flags.PersistDir,
+		TrustRoots:    strings.Split(flags.TrustRoots, ","),
+		VideoCodecs:   common.ParseVideoCodecs(flags.VideoCodecs),
+		WebRTC: common.WebRTCConfig{
+			STUNServer:   flags.STUNServer,
+			UDPMuxPort:   flags.UDPMuxPort,
+			UDPPortStart: flags.WebRTCUDPStart,
+			UDPPortEnd:   flags.WebRTCUDPEnd,
+			NAT11IP:      flags.NAT11IP,
+		},
+	}
+}
 
 // RelayInfo contains light information of Relay, in mesh-friendly format
 type RelayInfo struct {
 	ID            peer.ID
 	MeshAddrs     []string                                 // Addresses of this relay
-	MeshRooms     *common.SafeMap[string, shared.RoomInfo] // Rooms hosted by this relay
+	MeshRooms     *common.SafeMap[string, shared.RoomInfo] // room name -> Rooms hosted in the mesh
 	MeshLatencies *common.SafeMap[string, time.Duration]   // Latencies to other peers from this relay
+	MeshRoutes    *common.SafeMap[string, Route]           // room name -> Route this relay pulls the room stream over
+	StateSequence uint64                                   // Sequence number of the latest room state update published by this relay
 }
 
 // Relay structure enhanced with metrics and state
 type Relay struct {
 	RelayInfo
+	Config Config
 
-	Host        host.Host      // libp2p host for peer-to-peer networking
-	PubSub      *pubsub.PubSub // PubSub for state synchronization
+	WebRTC      *common.WebRTCAPI // creates the PeerConnections of this relay
+	Host        host.Host         // libp2p host for peer-to-peer networking
+	PubSub      *pubsub.PubSub    // PubSub for state synchronization
 	PingService *ping.PingService
 
 	// Local
@@ -57,9 +91,37 @@ type Relay struct {
 	// PubSub Topics
 	pubTopicState        *pubsub.Topic // topic for room states
 	pubTopicRelayMetrics *pubsub.Topic // topic for relay metrics/status
+	pubTopicRelayHealth  *pubsub.Topic // topic for failure detector suspicions and refutations
+
+	// Mesh State
+	clock              *common.HLC // clock for versioning room states
+	stateMutex         sync.Mutex
+	stateSequence      uint64                           // sequence number of latest published state update
+	lastStateUpdate    *gen.StateUpdate                 // latest published state update, kept for retransmissions
+	meshStateSequences *common.SafeMap[peer.ID, uint64] // peer ID -> sequence number of latest applied state update
+
+	// Stream Routing
+	reestablishing sync.Map // room name -> true, while the lost stream of the room is being re-established
+
+	cancel    context.CancelFunc // stops the background tasks of the relay
+	closeOnce sync.Once
 }
 
-func NewRelay(ctx context.Context, port int, identityKey crypto.PrivKey) (*Relay, error) {
+// NewRelay starts a relay, running until ctx is done
+func NewRelay(ctx context.Context, config Config) (*Relay, error) {
+	var err error
+	if _, err = parseTrustRoots(config.TrustRoots); err != nil {
+		return nil, err
+	}
+
+	identityKey := config.Identity
+	if identityKey == nil {
+		if identityKey, err = loadIdentity(config); err != nil {
+			return nil, err
+		}
+	}
+
+	port := config.Port
 	listenAddrs := []string{
 		fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port),    // IPv4 - Raw TCP
 		fmt.Sprintf("/ip6/::/tcp/%d", port),         // IPv6 - Raw TCP
@@ -76,6 +138,11 @@ func NewRelay(ctx context.Context, port int, identityKey crypto.PrivKey) (*Relay
 		muAddrs = append(muAddrs, multiAddr)
 	}
 
+	webRTC, err := common.NewWebRTCAPI(config.WebRTC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WebRTC API: %w", err)
+	}
+
 	// Initialize libp2p host
 	p2pHost, err := libp2p.New(
 		// TODO: Currently static identity
@@ -93,15 +160,10 @@ func NewRelay(ctx context.Context, port int, identityKey crypto.PrivKey) (*Relay
 		libp2p.ShareTCPListener(),
 	)
 	if err != nil {
+		_ = webRTC.Close()
 		return nil, fmt.Errorf("failed to create libp2p host for relay: %w", err)
 	}
 
-	// Set up pubsub
-	p2pPubsub, err := pubsub.NewGossipSub(ctx, p2pHost)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create pubsub: %w, addrs: %v", err, p2pHost.Addrs())
-	}
-
 	// Initialize Ping Service
 	pingSvc := ping.NewPingService(p2pHost)
 
@@ -110,61 +172,185 @@ func NewRelay(ctx context.Context, port int, identityKey crypto.PrivKey) (*Relay
 		addresses = append(addresses, addr.String())
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	r := &Relay{
 		RelayInfo: RelayInfo{
 			ID:            p2pHost.ID(),
 			MeshAddrs:     addresses,
 			MeshRooms:     common.NewSafeMap[string, shared.RoomInfo](),
 			MeshLatencies: common.NewSafeMap[string, time.Duration](),
+			MeshRoutes:    common.NewSafeMap[string, Route](),
 		},
+		Config:         config,
+		WebRTC:         webRTC,
 		Host:           p2pHost,
-		PubSub:         p2pPubsub,
 		PingService:    pingSvc,
 		LocalRooms:     common.NewSafeMap[ulid.ULID, *shared.Room](),
 		LocalMeshPeers: common.NewSafeMap[peer.ID, *RelayInfo](),
+		clock:          common.NewHLC(),
+		// Start sequence from current time, so sequence keeps increasing across restarts
+		stateSequence:      uint64(time.Now().UnixMilli()),
+		meshStateSequences: common.NewSafeMap[peer.ID, uint64](),
+		cancel:             cancel,
 	}
 
+	// Initialize Protocol Registry, before PubSub and connection handlers may use it
+	r.ProtocolRegistry = NewProtocolRegistry(r)
+
 	// Add network notifier after relay is initialized
 	p2pHost.Network().Notify(&networkNotifier{relay: r})
 
+	// Set up pubsub, peer scoring relies on mesh admission
+	r.PubSub, err = pubsub.NewGossipSub(ctx, p2pHost,
+		pubsub.WithPeerScore(r.peerScoreParams(), peerScoreThresholds),
+		pubsub.WithMaxMessageSize(maxMeshMessageSize),
+	)
+	if err != nil {
+		cancel()
+		_ = webRTC.Close()
+		addrs := p2pHost.Addrs()
+		if closeErr := p2pHost.Close(); closeErr != nil {
+			slog.Error("Failed to close host after PubSub creation failure", "err", closeErr)
+		}
+		return nil, fmt.Errorf("failed to create pubsub: %w, addrs: %v", err, addrs)
+	}
+
 	// Set up PubSub topics and handlers
 	if err = r.setupPubSub(ctx); err != nil {
-		err = p2pHost.Close()
-		if err != nil {
-			slog.Error("Failed to close host after PubSub setup failure", "err", err)
+		cancel()
+		_ = webRTC.Close()
+		if closeErr := p2pHost.Close(); closeErr != nil {
+			slog.Error("Failed to close host after PubSub setup failure", "err", closeErr)
 		}
 		return nil, fmt.Errorf("failed to setup PubSub: %w", err)
 	}
 
-	// Initialize Protocol Registry
-	r.ProtocolRegistry = NewProtocolRegistry(r)
-
 	// Start discovery features
-	if err = startMDNSDiscovery(r); err != nil {
-		slog.Warn("Failed to initialize mDNS discovery, continuing without..", "error", err)
+	if !config.DisableMDNS {
+		if err = startMDNSDiscovery(r); err != nil {
+			slog.Warn("Failed to initialize mDNS discovery, continuing without..", "error", err)
+		}
 	}
 
 	// Start background tasks
 	go r.periodicMetricsPublisher(ctx)
+	go r.HealthProtocol.periodicProbe(ctx)
+	go r.periodicBandwidthFeedback(ctx)
+	go r.RecordingProtocol.stopAllOnDone(ctx)
+	go func() {
+		<-ctx.Done()
+		if err := r.WebRTC.Close(); err != nil {
+			slog.Error("Failed to close WebRTC API", "err", err)
+		}
+	}()
 
 	printConnectInstructions(p2pHost)
 
 	return r, nil
 }
 
-func InitRelay(ctx context.Context, ctxCancel context.CancelFunc) error {
+// Close stops the relay like cancelling its context does, and closes its PeerConnections and mesh connections.
+// Other relays find out the relay is gone by failure detection
+func (r *Relay) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		r.cancel()
+
+		// PeerConnections with a remote end that is already gone can take until ICE fails to close,
+		// they are closed together and not waited for longer than closeTimeout
+		var closing sync.WaitGroup
+		for _, room := range r.LocalRooms.Copy() {
+			for _, participant := range room.Participants.Copy() {
+				closeConcurrently(&closing, func() {
+					if closeErr := participant.Close(); closeErr != nil {
+						slog.Error("Failed to close participant PeerConnection", "room", room.Name, "participant", participant.ID, "err", closeErr)
+					}
+				})
+			}
+			if pc := room.GetPeerConnection(); pc != nil {
+				closeConcurrently(&closing, func() {
+					if closeErr := pc.Close(); closeErr != nil {
+						slog.Error("Failed to close Room PeerConnection", "room", room.Name, "err", closeErr)
+					}
+				})
+			}
+		}
+		r.StreamProtocol.closeConnections(&closing)
+
+		closed := make(chan struct{})
+		go func() {
+			closing.Wait()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(closeTimeout):
+			slog.Warn("PeerConnections of the relay did not close in time, closing host anyway")
+		}
+
+		if err = r.Host.Close(); err != nil {
+			err = fmt.Errorf("failed to close host: %w", err)
+		}
+	})
+	return err
+}
+
+// closeConcurrently runs closer on a goroutine of its own, tracked by closing
+func closeConcurrently(closing *sync.WaitGroup, closer func()) {
+	closing.Add(1)
+	go func() {
+		defer closing.Done()
+		closer()
+	}()
+}
+
+// ApproveRelay signs a mesh admission approval for given relay with our identity.
+// Returns approvals entry to add to the approvals.json of the approved relay
+func ApproveRelay(config Config, relayID string) (map[string]string, error) {
+	peerID, err := peer.Decode(relayID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay ID: %w", err)
+	}
+	if len(config.PersistDir) == 0 {
+		return nil, errors.New("approving relays needs the identity in the persistent data directory")
+	}
+	identityKey, err := loadIdentity(config)
+	if err != nil {
+		return nil, err
+	}
+	ourID, err := peer.IDFromPrivateKey(identityKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get relay ID from identity: %w", err)
+	}
+	approval, err := SignApproval(identityKey, peerID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{ourID.String(): approval}, nil
+}
+
+// loadIdentity loads the relay identity key from persistent directory, generating a new one if needed.
+// Without persistent directory, the generated identity only lasts for this run
+func loadIdentity(config Config) (crypto.PrivKey, error) {
 	var err error
-	persistentDir := common.GetFlags().PersistDir
+	persistentDir := config.PersistDir
+	if len(persistentDir) == 0 {
+		slog.Info("Generating new identity for relay, not persisted")
+		privKey, err := common.GenerateED25519Key()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate new identity: %w", err)
+		}
+		return crypto.UnmarshalEd25519PrivateKey(privKey)
+	}
 
 	// Load or generate identity key
-	var identityKey crypto.PrivKey
 	var privKey ed25519.PrivateKey
 	// First check if we need to generate identity
-	hasIdentity := len(persistentDir) > 0 && common.GetFlags().RegenIdentity == false
+	hasIdentity := len(persistentDir) > 0 && config.RegenIdentity == false
 	if hasIdentity {
 		_, err = os.Stat(persistentDir + "/identity.key")
 		if err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("failed to check identity key file: %w", err)
+			return nil, fmt.Errorf("failed to check identity key file: %w", err)
 		} else if os.IsNotExist(err) {
 			hasIdentity = false
 		}
@@ -172,17 +358,17 @@ func InitRelay(ctx context.Context, ctxCancel context.CancelFunc) error {
 	if !hasIdentity {
 		// Make sure the persistent directory exists
 		if err = os.MkdirAll(persistentDir, 0700); err != nil {
-			return fmt.Errorf("failed to create persistent data directory: %w", err)
+			return nil, fmt.Errorf("failed to create persistent data directory: %w", err)
 		}
 		// Generate
 		slog.Info("Generating new identity for relay")
 		privKey, err = common.GenerateED25519Key()
 		if err != nil {
-			return fmt.Errorf("failed to generate new identity: %w", err)
+			return nil, fmt.Errorf("failed to generate new identity: %w", err)
 		}
 		// Save the key
 		if err = common.SaveED25519Key(privKey, persistentDir+"/identity.key"); err != nil {
-			return fmt.Errorf("failed to save identity key: %w", err)
+			return nil, fmt.Errorf("failed to save identity key: %w", err)
 		}
 		slog.Info("New identity generated and saved", "path", persistentDir+"/identity.key")
 	} else {
@@ -190,25 +376,14 @@ func InitRelay(ctx context.Context, ctxCancel context.CancelFunc) error {
 		// Load the key
 		privKey, err = common.LoadED25519Key(persistentDir + "/identity.key")
 		if err != nil {
-			return fmt.Errorf("failed to load identity key: %w", err)
+			return nil, fmt.Errorf("failed to load identity key: %w", err)
 		}
 	}
 
 	// Convert to libp2p crypto.PrivKey
-	identityKey, err = crypto.UnmarshalEd25519PrivateKey(privKey)
-	if err != nil {
-		return fmt.Errorf("failed to unmarshal ED25519 private key: %w", err)
-	}
-
-	globalRelay, err = NewRelay(ctx, common.GetFlags().EndpointPort, identityKey)
+	identityKey, err := crypto.UnmarshalEd25519PrivateKey(privKey)
 	if err != nil {
-		return fmt.Errorf("failed to create relay: %w", err)
-	}
-
-	if err = common.InitWebRTCAPI(); err != nil {
-		return err
+		return nil, fmt.Errorf("failed to unmarshal ED25519 private key: %w", err)
 	}
-
-	slog.Info("Relay initialized", "id", globalRelay.ID)
-	return nil
+	return identityKey, nil
 }
@@ -0,0 +1,463 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"relay/internal/common"
+	"relay/internal/connections"
+	"relay/internal/pusher"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// --- Test Harness ---
+// Relays of a test run in this process, each with its own identity, mesh port and WebRTC port, meshed over loopback.
+// Rooms are fed by synthetic pushes like runners do, and watched by viewers signaling like browsers do,
+// so scenarios exercise the same protocols as a deployed mesh
+
+const (
+	testTimeout       = 20 * time.Second       // Longest wait for the mesh to get into an expected state
+	testPollInterval  = 100 * time.Millisecond // How often an expected state is checked for
+	testVideoInterval = 33 * time.Millisecond  // Synthetic video frame interval
+	testAudioInterval = 20 * time.Millisecond  // Synthetic audio frame interval
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Verbose() {
+		slog.SetDefault(slog.New(&common.CustomHandler{Handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+		})}))
+	} else {
+		slog.SetDefault(slog.New(slog.DiscardHandler))
+	}
+	os.Exit(m.Run())
+}
+
+// testRelay is a relay of a test
+type testRelay struct {
+	*Relay
+	Addr   string // Loopback multiaddr including the peer ID
+	cancel context.CancelFunc
+}
+
+// startRelays starts given number of relays, closed when the test ends. They aren't connected to each other
+func startRelays(t *testing.T, count int) []*testRelay {
+	t.Helper()
+	relays := make([]*testRelay, count)
+	for i := range relays {
+		relays[i] = startRelay(t)
+	}
+	return relays
+}
+
+// startRelay starts a relay with a fresh identity on free ports, closed when the test ends
+func startRelay(t *testing.T) *testRelay {
+	t.Helper()
+	privKey, err := common.GenerateED25519Key()
+	if err != nil {
+		t.Fatalf("failed to generate identity: %v", err)
+	}
+	identityKey, err := crypto.UnmarshalEd25519PrivateKey(privKey)
+	if err != nil {
+		t.Fatalf("failed to unmarshal identity: %v", err)
+	}
+	port := freePort(t, "tcp4")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	relay, err := NewRelay(ctx, Config{
+		Port:        port,
+		Identity:    identityKey,
+		DisableMDNS: true, // Relays of a test only know the peers the test connects them to
+		// No STUN server, ICE stays on loopback
+		WebRTC: common.WebRTCConfig{
+			UDPMuxPort: freePort(t, "udp4"),
+		},
+	})
+	if err != nil {
+		cancel()
+		t.Fatalf("failed to start relay: %v", err)
+	}
+	tr := &testRelay{
+		Relay:  relay,
+		Addr:   fmt.Sprintf("/ip4/127.0.0.1/tcp/%d/p2p/%s", port, relay.ID),
+		cancel: cancel,
+	}
+	t.Cleanup(tr.Close)
+	return tr
+}
+
+// freePort returns a port of given network nothing listens on
+func freePort(t *testing.T, network string) int {
+	t.Helper()
+	if network == "udp4" {
+		conn, err := net.ListenPacket(network, "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to find free port: %v", err)
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	listener, err := net.Listen(network, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find free port: %v", err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the relay like a crashed process, without telling the mesh
+func (tr *testRelay) Close() {
+	tr.cancel()
+	_ = tr.Relay.Close()
+}
+
+// connect connects relay a to relay b and waits for both to admit each other to the mesh
+func connect(t *testing.T, a, b *testRelay) {
+	t.Helper()
+	if err := a.ConnectToRelay(context.Background(), b.Addr); err != nil {
+		t.Fatalf("failed to connect relays: %v", err)
+	}
+	waitFor(t, "relays admitted to each other", func() bool {
+		return a.LocalMeshPeers.Has(b.ID) && b.LocalMeshPeers.Has(a.ID)
+	})
+}
+
+// waitFor waits until cond holds, failing the test after testTimeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(testPollInterval)
+	}
+}
+
+// roomState returns the owner and online state a relay knows of a room, from its own rooms or the mesh
+func roomState(r *testRelay, roomName string) (ownerID peer.ID, online bool, ok bool) {
+	if room := r.GetRoomByName(roomName); room != nil && room.GetOwnerID() == r.ID {
+		// Tracks are read under the room lock, pushes set them concurrently
+		online := room.GetTrack(webrtc.RTPCodecTypeAudio) != nil && room.GetTrack(webrtc.RTPCodecTypeVideo) != nil
+		return r.ID, online, true
+	}
+	info, ok := r.MeshRooms.Get(roomName)
+	if !ok {
+		return "", false, false
+	}
+	return info.OwnerID, info.Online, true
+}
+
+// waitRoomState waits until all given relays know a room to be owned by owner and in given online state
+func waitRoomState(t *testing.T, relays []*testRelay, roomName string, owner *testRelay, online bool) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("room %s owned by %s with online=%t everywhere", roomName, owner.ID, online), func() bool {
+		for _, r := range relays {
+			ownerID, roomOnline, ok := roomState(r, roomName)
+			if !ok || ownerID != owner.ID || roomOnline != online {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// --- Synthetic Push ---
+
+// startPush pushes synthetic H.264 video and Opus audio of a room to a relay until the test ends or it's closed.
+// The media isn't decodable, relays forward packets without decoding them
+func startPush(t *testing.T, relay *testRelay, roomName string) *pusher.Pusher {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	push, err := pusher.New(ctx, relay.Addr, roomName)
+	if err != nil {
+		t.Fatalf("failed to create push: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = push.Close()
+	})
+	video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}, "video", "nestri-test")
+	if err != nil {
+		t.Fatalf("failed to create video track: %v", err)
+	}
+	audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeOpus,
+		ClockRate: 48000,
+		Channels:  2,
+	}, "audio", "nestri-test")
+	if err != nil {
+		t.Fatalf("failed to create audio track: %v", err)
+	}
+	for _, track := range []webrtc.TrackLocal{video, audio} {
+		if _, err = push.AddTrack(track); err != nil {
+			t.Fatalf("failed to add track: %v", err)
+		}
+	}
+	if _, err = push.CreateDataChannel(); err != nil {
+		t.Fatalf("failed to create data channel: %v", err)
+	}
+	if err = push.Start(ctx); err != nil {
+		t.Fatalf("failed to start push: %v", err)
+	}
+
+	go writeSamples(push, video, testVideoInterval, func(n int) []byte {
+		if n%30 == 0 {
+			// Parameter sets and IDR slice headers, enough for relays to see keyframes
+			return []byte{0, 0, 0, 1, 0x67, 0x42, 0xe0, 0x1f, 0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80, 0, 0, 0, 1, 0x65, 0x88, 0x84, 0x21}
+		}
+		return []byte{0, 0, 0, 1, 0x41, 0x9a, 0x02, 0x04}
+	})
+	go writeSamples(push, audio, testAudioInterval, func(int) []byte {
+		return []byte{0xfc, 0xff, 0xfe} // Opus silence
+	})
+	return push
+}
+
+// writeSamples writes samples to a pushed track until the push ends
+func writeSamples(push *pusher.Pusher, track *webrtc.TrackLocalStaticSample, interval time.Duration, sample func(n int) []byte) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for n := 0; ; n++ {
+		select {
+		case <-ticker.C:
+		case <-push.Done():
+			return
+		}
+		if err := track.WriteSample(media.Sample{Data: sample(n), Duration: interval}); err != nil &&
+			!errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+	}
+}
+
+// --- Test Viewer ---
+
+// testViewer watches a room through a relay like a browser participant, counting received packets
+type testViewer struct {
+	Room string
+
+	host    host.Host
+	stream  network.Stream
+	safeBRW *common.SafeBufioRW
+	pc      *webrtc.PeerConnection
+
+	candidateMutex    sync.Mutex
+	answered          bool
+	pendingCandidates []webrtc.ICECandidateInit
+
+	videoPackets atomic.Int64
+	audioPackets atomic.Int64
+}
+
+// joinRoom joins a room through a relay as viewer, left when the test ends
+func joinRoom(t *testing.T, relay *testRelay, roomName string) *testViewer {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	addr, err := multiaddr.NewMultiaddr(relay.Addr)
+	if err != nil {
+		t.Fatalf("failed to parse relay address: %v", err)
+	}
+	relayInfo, err := peer.AddrInfoFromP2pAddr(addr)
+	if err != nil {
+		t.Fatalf("failed to get relay info: %v", err)
+	}
+	viewerHost, err := libp2p.New(
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Security(noise.ID, noise.New),
+		libp2p.NoListenAddrs,
+	)
+	if err != nil {
+		t.Fatalf("failed to create viewer host: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = viewerHost.Close()
+	})
+	if err = viewerHost.Connect(ctx, *relayInfo); err != nil {
+		t.Fatalf("failed to connect viewer to relay: %v", err)
+	}
+	stream, err := viewerHost.NewStream(ctx, relayInfo.ID, protocolStreamParticipant)
+	if err != nil {
+		t.Fatalf("failed to open participant stream: %v", err)
+	}
+	pc, err := newTestPeerConnection()
+	if err != nil {
+		t.Fatalf("failed to create viewer PeerConnection: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+
+	v := &testViewer{
+		Room:    roomName,
+		host:    viewerHost,
+		stream:  stream,
+		safeBRW: common.NewSafeBufioRW(bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))),
+		pc:      pc,
+	}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		counter := &v.audioPackets
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			counter = &v.videoPackets
+		}
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+			counter.Add(1)
+		}
+	})
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		v.candidateMutex.Lock()
+		defer v.candidateMutex.Unlock()
+		if !v.answered {
+			v.pendingCandidates = append(v.pendingCandidates, candidate.ToJSON())
+			return
+		}
+		v.sendCandidate(candidate.ToJSON())
+	})
+
+	roomData, err := json.Marshal(roomName)
+	if err != nil {
+		t.Fatalf("failed to marshal room name: %v", err)
+	}
+	if err = v.safeBRW.SendJSON(connections.NewMessageRaw("request-stream-room", roomData)); err != nil {
+		t.Fatalf("failed to request room: %v", err)
+	}
+	go v.handleMessages()
+	return v
+}
+
+// newTestPeerConnection creates a PeerConnection receiving any codec relays forward
+func newTestPeerConnection() (*webrtc.PeerConnection, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := common.RegisterCodecs(mediaEngine); err != nil {
+		return nil, err
+	}
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetIncludeLoopbackCandidate(true)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithSettingEngine(settingEngine))
+	return api.NewPeerConnection(webrtc.Configuration{SDPSemantics: webrtc.SDPSemanticsUnifiedPlan})
+}
+
+// handleMessages answers offers of the relay until the viewer leaves
+func (v *testViewer) handleMessages() {
+	iceHolder := make([]webrtc.ICECandidateInit, 0)
+	for {
+		data, err := v.safeBRW.Receive()
+		if err != nil {
+			return
+		}
+		var baseMsg connections.MessageBase
+		if err = json.Unmarshal(data, &baseMsg); err != nil {
+			continue
+		}
+
+		switch baseMsg.Type {
+		case "offer":
+			var offerMsg connections.MessageSDP
+			if err = json.Unmarshal(data, &offerMsg); err != nil {
+				continue
+			}
+			if err = v.pc.SetRemoteDescription(offerMsg.SDP); err != nil {
+				slog.Error("Failed to set remote description for test viewer", "room", v.Room, "err", err)
+				return
+			}
+			for _, heldIce := range iceHolder {
+				_ = v.pc.AddICECandidate(heldIce)
+			}
+			iceHolder = make([]webrtc.ICECandidateInit, 0)
+
+			answer, err := v.pc.CreateAnswer(nil)
+			if err != nil {
+				slog.Error("Failed to create answer for test viewer", "room", v.Room, "err", err)
+				return
+			}
+			if err = v.pc.SetLocalDescription(answer); err != nil {
+				slog.Error("Failed to set local description for test viewer", "room", v.Room, "err", err)
+				return
+			}
+			// Relays take candidates once they have the answer
+			v.candidateMutex.Lock()
+			err = v.safeBRW.SendJSON(connections.NewMessageSDP("answer", answer))
+			v.answered = true
+			for _, candidate := range v.pendingCandidates {
+				v.sendCandidate(candidate)
+			}
+			v.pendingCandidates = nil
+			v.candidateMutex.Unlock()
+			if err != nil {
+				return
+			}
+		case "ice-candidate":
+			var iceMsg connections.MessageICE
+			if err = json.Unmarshal(data, &iceMsg); err != nil {
+				continue
+			}
+			if v.pc.RemoteDescription() == nil {
+				iceHolder = append(iceHolder, iceMsg.Candidate)
+			} else {
+				_ = v.pc.AddICECandidate(iceMsg.Candidate)
+			}
+		}
+	}
+}
+
+// sendCandidate sends a local ICE candidate to the relay
+func (v *testViewer) sendCandidate(candidate webrtc.ICECandidateInit) {
+	if err := v.safeBRW.SendJSON(connections.NewMessageICE("ice-candidate", candidate)); err != nil {
+		slog.Error("Failed to send ICE candidate for test viewer", "room", v.Room, "err", err)
+	}
+}
+
+// waitMedia waits until the viewer received more video and audio packets than it had
+func (v *testViewer) waitMedia(t *testing.T) {
+	t.Helper()
+	video, audio := v.videoPackets.Load(), v.audioPackets.Load()
+	waitFor(t, "media of room "+v.Room, func() bool {
+		return v.videoPackets.Load() > video+10 && v.audioPackets.Load() > audio+10
+	})
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"testing"
+)
+
+// --- Mesh Scenarios ---
+// Relays run without mDNS, each scenario decides which relays are connected
+
+// TestPush checks a pushed room reaching a viewer of the same relay
+func TestPush(t *testing.T) {
+	relay := startRelay(t)
+	startPush(t, relay, "push")
+	waitRoomState(t, []*testRelay{relay}, "push", relay, true)
+
+	viewer := joinRoom(t, relay, "push")
+	viewer.waitMedia(t)
+}
+
+// TestMeshRequest checks a room pushed to one relay reaching a viewer of another through the mesh
+func TestMeshRequest(t *testing.T) {
+	relays := startRelays(t, 2)
+	owner, edge := relays[0], relays[1]
+	connect(t, owner, edge)
+
+	startPush(t, owner, "mesh")
+	waitRoomState(t, relays, "mesh", owner, true)
+
+	viewer := joinRoom(t, edge, "mesh")
+	viewer.waitMedia(t)
+
+	route, ok := edge.GetRoute("mesh")
+	if !ok {
+		t.Fatal("edge relay has no route for the room")
+	}
+	if route.UpstreamID() != owner.ID {
+		t.Fatalf("edge relay streams the room from %s, expected owner %s", route.UpstreamID(), owner.ID)
+	}
+	if !owner.StreamProtocol.isServing("mesh") {
+		t.Fatal("owner relay isn't serving the room to the mesh")
+	}
+}
+
+// TestPeerLoss checks relays dropping a lost relay and the rooms it owned
+func TestPeerLoss(t *testing.T) {
+	relays := startRelays(t, 3)
+	a, lost, c := relays[0], relays[1], relays[2]
+	connect(t, a, lost)
+	connect(t, c, lost)
+
+	startPush(t, lost, "lost")
+	waitRoomState(t, relays, "lost", lost, true)
+
+	lost.Close()
+	waitFor(t, "lost relay dropped from the mesh", func() bool {
+		for _, r := range []*testRelay{a, c} {
+			if r.LocalMeshPeers.Has(lost.ID) {
+				return false
+			}
+			if _, _, ok := roomState(r, "lost"); ok {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// TestRoomStateConvergence checks room states reaching every relay of a chain, including one joining late
+func TestRoomStateConvergence(t *testing.T) {
+	relays := startRelays(t, 4)
+	for i := 1; i < len(relays); i++ {
+		connect(t, relays[i-1], relays[i])
+	}
+	first, last := relays[0], relays[len(relays)-1]
+
+	firstPush := startPush(t, first, "first")
+	startPush(t, last, "last")
+	waitRoomState(t, relays, "first", first, true)
+	waitRoomState(t, relays, "last", last, true)
+
+	// Runner gone for good, the room goes offline once its reconnect grace passes
+	_ = firstPush.Close()
+	waitRoomState(t, relays, "first", first, false)
+
+	late := startRelay(t)
+	connect(t, late, last)
+	relays = append(relays, late)
+	waitRoomState(t, relays, "first", first, false)
+	waitRoomState(t, relays, "last", last, true)
+}
@@ -46,7 +46,9 @@ func (r *Relay) publishRelayMetrics(ctx context.Context) error {
 	// Check all peer latencies
 	r.checkAllPeerLatencies(ctx)
 
-	data, err := json.Marshal(r.RelayInfo)
+	info := r.RelayInfo
+	info.StateSequence = r.currentStateSequence()
+	data, err := json.Marshal(info)
 	if err != nil {
 		return fmt.Errorf("failed to marshal relay status: %w", err)
 	}
@@ -107,11 +109,8 @@ func (r *Relay) measureLatencyToPeer(ctx context.Context, peerID peer.ID) {
 
 		// Received ping result
 		if result.Error != nil {
-			slog.Warn("Latency check failed, removing peer from local peers map", "peer", peerID, "err", result.Error)
-			// Remove from MeshPeers if ping failed
-			if r.LocalMeshPeers.Has(peerID) {
-				r.LocalMeshPeers.Delete(peerID)
-			}
+			// Liveness is up to the failure detector, a single failed ping doesn't mean the peer is gone
+			slog.Warn("Latency check failed", "peer", peerID, "err", result.Error)
 			return
 		}
 
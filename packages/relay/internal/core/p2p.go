@@ -22,8 +22,9 @@ type networkNotifier struct {
 
 // Connected is called when a connection is established
 func (n *networkNotifier) Connected(net network.Network, conn network.Conn) {
-	if n.relay == nil {
-		n.relay.onPeerConnected(conn.RemotePeer())
+	// Joining relays start the handshake, the other side admits them when done
+	if n.relay != nil && conn.Stat().Direction == network.DirOutbound {
+		go n.relay.onPeerConnected(conn.RemotePeer())
 	}
 }
 
@@ -56,6 +57,9 @@ func (r *Relay) setupPubSub(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to subscribe to room state topic '%s': %w", roomStateTopicName, err)
 	}
+	if err = r.PubSub.RegisterTopicValidator(roomStateTopicName, r.validateRoomStateMessage); err != nil {
+		return fmt.Errorf("failed to register validator for room state topic '%s': %w", roomStateTopicName, err)
+	}
 	go r.handleRoomStateMessages(ctx, stateSub) // Handler in relay_state.go
 
 	// Relay Metrics Topic
@@ -67,8 +71,25 @@ func (r *Relay) setupPubSub(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to subscribe to relay metrics topic '%s': %w", relayMetricsTopicName, err)
 	}
+	if err = r.PubSub.RegisterTopicValidator(relayMetricsTopicName, r.validateRelayMetricsMessage); err != nil {
+		return fmt.Errorf("failed to register validator for relay metrics topic '%s': %w", relayMetricsTopicName, err)
+	}
 	go r.handleRelayMetricsMessages(ctx, metricsSub) // Handler in relay_state.go
 
+	// Relay Health Topic
+	r.pubTopicRelayHealth, err = r.PubSub.Join(relayHealthTopicName)
+	if err != nil {
+		return fmt.Errorf("failed to join relay health topic '%s': %w", relayHealthTopicName, err)
+	}
+	healthSub, err := r.pubTopicRelayHealth.Subscribe()
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to relay health topic '%s': %w", relayHealthTopicName, err)
+	}
+	if err = r.PubSub.RegisterTopicValidator(relayHealthTopicName, r.validateRelayHealthMessage); err != nil {
+		return fmt.Errorf("failed to register validator for relay health topic '%s': %w", relayHealthTopicName, err)
+	}
+	go r.handleRelayHealthMessages(ctx, healthSub) // Handler in relay_state.go
+
 	slog.Info("PubSub topics joined and subscriptions started")
 	return nil
 }
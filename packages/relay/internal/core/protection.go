@@ -0,0 +1,39 @@
+package core
+
+import (
+	"log/slog"
+	"relay/internal/common"
+)
+
+// --- Link Protection ---
+// Served relay links with loss get their streams protected with FEC and RED, see common.WebRTCAPI.ProtectLink.
+// Loss is taken from receiver reports of the receiving relay, the heavier the more FEC packets are sent
+
+// FEC packets per group of protected video packets, more as loss gets heavier
+const (
+	fecPacketsLight    = 1
+	fecPacketsModerate = 2
+	fecPacketsHeavy    = 3
+)
+
+// onLinkLoss updates the smoothed loss of a served relay link from a reported fraction lost (out of 256),
+// adjusting protection of the link to it
+func (conn *StreamConnection) onLinkLoss(webRTC *common.WebRTCAPI, fractionLost uint8) {
+	conn.lossMutex.Lock()
+	conn.loss += (float64(fractionLost)/256 - conn.loss) * linkLossSmoothing
+	loss := conn.loss
+	conn.lossMutex.Unlock()
+
+	fecPackets := 0
+	switch {
+	case loss >= linkLossHeavy:
+		fecPackets = fecPacketsHeavy
+	case loss >= linkLossModerate:
+		fecPackets = fecPacketsModerate
+	case loss >= linkLossProtect:
+		fecPackets = fecPacketsLight
+	}
+	if webRTC.ProtectLink(conn.pc, fecPackets) {
+		slog.Debug("Changed protection of relay link", "room", conn.room, "fec_packets", fecPackets, "loss", loss)
+	}
+}
@@ -0,0 +1,367 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// --- Protocol IDs ---
+const (
+	protocolHandshake = "/nestri-relay/handshake/1.0.0" // For admitting relays into the mesh
+)
+
+// --- Protocol Types ---
+
+// AdmissionProtocol decides which relays may join the mesh. Relays present approvals, signatures of
+// their relay ID by trust roots or existing mesh members, and get a new approval from every member admitting them.
+// Without configured trust roots admission is open, any relay completing the handshake is admitted
+type AdmissionProtocol struct {
+	relay         *Relay
+	trustRoots    map[peer.ID]bool
+	approvals     *common.SafeMap[string, string] // approver relay ID -> base64 signature approving us
+	approvalsPath string
+	admitted      *common.SafeMap[peer.ID, bool] // peer ID -> admitted through handshake
+}
+
+func NewAdmissionProtocol(relay *Relay) *AdmissionProtocol {
+	// NewRelay refuses to start with invalid trust roots
+	trustRoots, _ := parseTrustRoots(relay.Config.TrustRoots)
+	protocol := &AdmissionProtocol{
+		relay:      relay,
+		trustRoots: trustRoots,
+		approvals:  common.NewSafeMap[string, string](),
+		admitted:   common.NewSafeMap[peer.ID, bool](),
+	}
+
+	if len(protocol.trustRoots) == 0 {
+		slog.Warn("No trust roots configured, mesh admission is open to any relay")
+	}
+
+	if len(protocol.relay.Config.PersistDir) > 0 {
+		protocol.approvalsPath = protocol.relay.Config.PersistDir + "/approvals.json"
+		if err := protocol.loadApprovals(); err != nil {
+			slog.Error("Failed to load mesh approvals", "path", protocol.approvalsPath, "err", err)
+		}
+	}
+
+	protocol.relay.Host.SetStreamHandler(protocolHandshake, protocol.handleHandshake)
+
+	return protocol
+}
+
+// parseTrustRoots decodes the configured trust root relay IDs, skipping empty entries.
+// Any invalid entry is an error, a mistyped root must not leave admission open
+func parseTrustRoots(roots []string) (map[peer.ID]bool, error) {
+	trustRoots := make(map[peer.ID]bool)
+	for _, root := range roots {
+		root = strings.TrimSpace(root)
+		if len(root) == 0 {
+			continue
+		}
+		rootID, err := peer.Decode(root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust root %q: %w", root, err)
+		}
+		trustRoots[rootID] = true
+	}
+	return trustRoots, nil
+}
+
+// --- Protocol Stream Handlers ---
+
+// handleHandshake admits a relay joining through us, the joiner verifies our approvals first
+func (ap *AdmissionProtocol) handleHandshake(stream network.Stream) {
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+	joinerID := stream.Conn().RemotePeer()
+
+	var helloMsg gen.MeshMessage
+	if err := safeBRW.ReceiveProto(&helloMsg); err != nil {
+		slog.Error("Failed to receive handshake", "peer", joinerID, "err", err)
+		return
+	}
+	if helloMsg.GetHandshake().GetRelayId() != joinerID.String() {
+		slog.Error("Invalid handshake from peer", "peer", joinerID)
+		_ = stream.Reset()
+		return
+	}
+
+	// Present our approvals
+	if err := safeBRW.SendProto(ap.newHandshakeResponse(ap.approvals.Copy())); err != nil {
+		slog.Error("Failed to send handshake response", "peer", joinerID, "err", err)
+		return
+	}
+
+	var joinerMsg gen.MeshMessage
+	if err := safeBRW.ReceiveProto(&joinerMsg); err != nil {
+		slog.Debug("Joiner did not present approvals", "peer", joinerID, "err", err)
+		return
+	}
+	joinerResponse := joinerMsg.GetHandshakeResponse()
+	if joinerResponse == nil || joinerResponse.GetRelayId() != joinerID.String() {
+		slog.Error("Invalid handshake response from joiner", "peer", joinerID)
+		_ = stream.Reset()
+		return
+	}
+	if err := ap.verifyApprovals(joinerID, joinerResponse.GetApprovals()); err != nil {
+		slog.Warn("Refusing relay into mesh", "peer", joinerID, "err", err)
+		_ = stream.Reset()
+		return
+	}
+
+	// Approve the joiner ourselves, so it can join through relays trusting us
+	approval, err := ap.Approve(joinerID)
+	if err != nil {
+		slog.Error("Failed to approve joiner", "peer", joinerID, "err", err)
+		_ = stream.Reset()
+		return
+	}
+	// Admit before answering, joiner may use mesh protocols right after
+	ap.admit(joinerID)
+	if err = safeBRW.SendProto(ap.newHandshakeResponse(map[string]string{
+		ap.relay.ID.String(): approval,
+	})); err != nil {
+		slog.Error("Failed to send approval to joiner", "peer", joinerID, "err", err)
+	}
+}
+
+// --- Public Usable Methods ---
+
+// Handshake joins the mesh through a connected relay, admitting each other
+func (ap *AdmissionProtocol) Handshake(ctx context.Context, peerID peer.ID) error {
+	handshakeCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	stream, err := ap.relay.Host.NewStream(handshakeCtx, peerID, protocolHandshake)
+	if err != nil {
+		return fmt.Errorf("failed to create handshake stream: %w", err)
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	if err = safeBRW.SendProto(&gen.MeshMessage{
+		Type: &gen.MeshMessage_Handshake{Handshake: &gen.Handshake{
+			RelayId: ap.relay.ID.String(),
+		}},
+	}); err != nil {
+		return fmt.Errorf("failed to send handshake: %w", err)
+	}
+
+	// Make sure we're joining an approved mesh member before presenting ourselves
+	var memberMsg gen.MeshMessage
+	if err = safeBRW.ReceiveProto(&memberMsg); err != nil {
+		return fmt.Errorf("failed to receive handshake response: %w", err)
+	}
+	memberResponse := memberMsg.GetHandshakeResponse()
+	if memberResponse == nil || memberResponse.GetRelayId() != peerID.String() {
+		return errors.New("invalid handshake response")
+	}
+	if err = ap.verifyApprovals(peerID, memberResponse.GetApprovals()); err != nil {
+		_ = stream.Reset()
+		return fmt.Errorf("peer is not an approved mesh member: %w", err)
+	}
+
+	if err = safeBRW.SendProto(ap.newHandshakeResponse(ap.approvals.Copy())); err != nil {
+		return fmt.Errorf("failed to present approvals: %w", err)
+	}
+
+	var approvalMsg gen.MeshMessage
+	if err = safeBRW.ReceiveProto(&approvalMsg); err != nil {
+		return fmt.Errorf("mesh member refused us: %w", err)
+	}
+	for approver, signature := range approvalMsg.GetHandshakeResponse().GetApprovals() {
+		if approver != peerID.String() {
+			continue
+		}
+		if err = ap.addApproval(peerID, signature); err != nil {
+			slog.Error("Failed to store approval from mesh member", "peer", peerID, "err", err)
+		}
+	}
+
+	ap.admit(peerID)
+	return nil
+}
+
+// EnsureAdmitted makes sure a relay and us are admitted to each other, before using mesh protocols with it
+func (ap *AdmissionProtocol) EnsureAdmitted(ctx context.Context, peerID peer.ID) error {
+	if ap.IsAdmitted(peerID) {
+		return nil
+	}
+	return ap.Handshake(ctx, peerID)
+}
+
+// IsAdmitted returns whether a peer is allowed to take part in the mesh
+func (ap *AdmissionProtocol) IsAdmitted(peerID peer.ID) bool {
+	if peerID == ap.relay.ID || len(ap.trustRoots) == 0 {
+		return true
+	}
+	return ap.admitted.Has(peerID)
+}
+
+// Approve signs an approval of given relay joining the mesh
+func (ap *AdmissionProtocol) Approve(peerID peer.ID) (string, error) {
+	privKey := ap.relay.Host.Peerstore().PrivKey(ap.relay.ID)
+	if privKey == nil {
+		return "", errors.New("missing private key for signing approvals")
+	}
+	return SignApproval(privKey, peerID)
+}
+
+// SignApproval signs an approval of given relay joining the mesh with a relay identity key
+func SignApproval(key crypto.PrivKey, peerID peer.ID) (string, error) {
+	signature, err := key.Sign(approvalBytes(peerID))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign approval: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// --- Helpers ---
+
+// approvalBytes returns the data signed by an approval of given relay
+func approvalBytes(peerID peer.ID) []byte {
+	return []byte("nestri-relay-approval:" + peerID.String())
+}
+
+// admit adds a relay which completed the handshake to mesh peers
+func (ap *AdmissionProtocol) admit(peerID peer.ID) {
+	if ap.admitted.Has(peerID) {
+		return
+	}
+	ap.admitted.Set(peerID, true)
+	ap.relay.onPeerAdmitted(peerID)
+}
+
+// forget drops the admission of a relay, it has to handshake again when reconnecting
+func (ap *AdmissionProtocol) forget(peerID peer.ID) {
+	if ap.admitted.Has(peerID) {
+		ap.admitted.Delete(peerID)
+	}
+}
+
+// isMember returns whether a relay may approve others
+func (ap *AdmissionProtocol) isMember(peerID peer.ID) bool {
+	return peerID == ap.relay.ID || ap.trustRoots[peerID] || ap.admitted.Has(peerID) || ap.relay.LocalMeshPeers.Has(peerID)
+}
+
+// verifyApprovals checks that a relay holds a valid approval by a trust root or mesh member
+func (ap *AdmissionProtocol) verifyApprovals(peerID peer.ID, approvals map[string]string) error {
+	if len(ap.trustRoots) == 0 || ap.trustRoots[peerID] {
+		return nil
+	}
+
+	for approver, signature := range approvals {
+		approverID, err := peer.Decode(approver)
+		if err != nil || approverID == peerID || !ap.isMember(approverID) {
+			continue
+		}
+		if err = verifyApproval(approverID, peerID, signature); err != nil {
+			slog.Debug("Invalid approval", "peer", peerID, "approver", approverID, "err", err)
+			continue
+		}
+		slog.Debug("Relay approved", "peer", peerID, "approver", approverID)
+		return nil
+	}
+	return errors.New("no valid approval by a trust root or mesh member")
+}
+
+// verifyApproval checks a single approval signature of approver for given relay
+func verifyApproval(approverID, peerID peer.ID, signature string) error {
+	signatureData, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode approval signature: %w", err)
+	}
+	pubKey, err := approverID.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to extract public key of approver: %w", err)
+	}
+	ok, err := pubKey.Verify(approvalBytes(peerID), signatureData)
+	if err != nil {
+		return fmt.Errorf("failed to verify approval signature: %w", err)
+	}
+	if !ok {
+		return errors.New("approval signature mismatch")
+	}
+	return nil
+}
+
+// newHandshakeResponse creates a handshake response message presenting given approvals
+func (ap *AdmissionProtocol) newHandshakeResponse(approvals map[string]string) *gen.MeshMessage {
+	return &gen.MeshMessage{
+		Type: &gen.MeshMessage_HandshakeResponse{HandshakeResponse: &gen.HandshakeResponse{
+			RelayId:   ap.relay.ID.String(),
+			Approvals: approvals,
+		}},
+	}
+}
+
+// addApproval stores a valid approval of us, persisting it for future handshakes
+func (ap *AdmissionProtocol) addApproval(approverID peer.ID, signature string) error {
+	if err := verifyApproval(approverID, ap.relay.ID, signature); err != nil {
+		return err
+	}
+	if existing, ok := ap.approvals.Get(approverID.String()); ok && existing == signature {
+		return nil
+	}
+	ap.approvals.Set(approverID.String(), signature)
+	return ap.saveApprovals()
+}
+
+// loadApprovals reads our approvals from persistent directory, if any
+func (ap *AdmissionProtocol) loadApprovals() error {
+	data, err := os.ReadFile(ap.approvalsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	approvals := make(map[string]string)
+	if err = json.Unmarshal(data, &approvals); err != nil {
+		return fmt.Errorf("failed to unmarshal approvals: %w", err)
+	}
+	for approver, signature := range approvals {
+		ap.approvals.Set(approver, signature)
+	}
+	slog.Info("Loaded mesh approvals", "path", ap.approvalsPath, "count", len(approvals))
+	return nil
+}
+
+// saveApprovals writes our approvals to persistent directory
+func (ap *AdmissionProtocol) saveApprovals() error {
+	if len(ap.approvalsPath) == 0 {
+		return nil
+	}
+	data, err := json.MarshalIndent(ap.approvals.Copy(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal approvals: %w", err)
+	}
+	if err = os.WriteFile(ap.approvalsPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to save approvals to %s: %w", ap.approvalsPath, err)
+	}
+	return nil
+}
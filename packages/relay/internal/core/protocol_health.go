@@ -0,0 +1,447 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// --- Protocol IDs ---
+const (
+	protocolHeartbeat = "/nestri-relay/heartbeat/1.0.0" // For direct and indirect liveness probes between relays
+)
+
+// --- Protocol Types ---
+
+// suspicion tracks the relays suspecting a relay of being dead
+type suspicion struct {
+	since      time.Time
+	suspecters map[peer.ID]bool
+}
+
+// HealthProtocol is a SWIM-style failure detector. Each round one mesh peer is probed directly,
+// failing that through other peers. Unreachable peers are suspected mesh-wide, and declared dead
+// once enough relays agree and the suspected relay didn't refute in time
+type HealthProtocol struct {
+	relay *Relay
+
+	mutex      sync.Mutex
+	suspicions map[peer.ID]*suspicion // peer ID -> relays suspecting it
+	probeOrder []peer.ID              // shuffled peers left to probe this cycle
+}
+
+func NewHealthProtocol(relay *Relay) *HealthProtocol {
+	protocol := &HealthProtocol{
+		relay:      relay,
+		suspicions: make(map[peer.ID]*suspicion),
+	}
+
+	protocol.relay.Host.SetStreamHandler(protocolHeartbeat, protocol.handleHeartbeat)
+
+	return protocol
+}
+
+// --- Protocol Stream Handlers ---
+
+// handleHeartbeat answers a direct probe, or probes the given relay on behalf of the requester
+func (hp *HealthProtocol) handleHeartbeat(stream network.Stream) {
+	if !hp.relay.AdmissionProtocol.IsAdmitted(stream.Conn().RemotePeer()) {
+		slog.Warn("Refusing probe from non-admitted peer", "peer", stream.Conn().RemotePeer())
+		_ = stream.Reset()
+		return
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(indirectProbeTimeout))
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	var reqMsg gen.MeshMessage
+	if err := safeBRW.ReceiveProto(&reqMsg); err != nil {
+		slog.Debug("Failed to receive probe", "peer", stream.Conn().RemotePeer(), "err", err)
+		return
+	}
+
+	var response *gen.MeshMessage
+	switch msgType := reqMsg.GetType().(type) {
+	case *gen.MeshMessage_Heartbeat:
+		response = hp.newHeartbeat()
+	case *gen.MeshMessage_SuspectRelay:
+		// Indirect probe, check the relay for the requester
+		targetID, err := peer.Decode(msgType.SuspectRelay.GetRelayId())
+		if err != nil {
+			slog.Error("Invalid relay ID in indirect probe request", "peer", stream.Conn().RemotePeer(), "err", err)
+			_ = stream.Reset()
+			return
+		}
+		if err = hp.Probe(context.Background(), targetID, heartbeatTimeout); err != nil {
+			response = &gen.MeshMessage{
+				Type: &gen.MeshMessage_SuspectRelay{SuspectRelay: &gen.SuspectRelay{
+					RelayId: targetID.String(),
+					Reason:  err.Error(),
+				}},
+			}
+		} else {
+			response = &gen.MeshMessage{
+				Type: &gen.MeshMessage_Heartbeat{Heartbeat: &gen.Heartbeat{
+					RelayId:   targetID.String(),
+					Timestamp: timestamppb.Now(),
+				}},
+			}
+		}
+	default:
+		slog.Warn("Unexpected message on heartbeat stream", "peer", stream.Conn().RemotePeer(), "type", fmt.Sprintf("%T", msgType))
+		_ = stream.Reset()
+		return
+	}
+
+	if err := safeBRW.SendProto(response); err != nil {
+		slog.Debug("Failed to send probe response", "peer", stream.Conn().RemotePeer(), "err", err)
+	}
+}
+
+// --- Public Usable Methods ---
+
+// Probe checks directly whether a relay is alive
+func (hp *HealthProtocol) Probe(ctx context.Context, peerID peer.ID, timeout time.Duration) error {
+	response, err := hp.exchange(ctx, peerID, hp.newHeartbeat(), timeout)
+	if err != nil {
+		return err
+	}
+	if response.GetHeartbeat().GetRelayId() != peerID.String() {
+		return errors.New("unexpected probe response")
+	}
+	return nil
+}
+
+// ProbeIndirect asks a helper relay to probe the target relay for us
+func (hp *HealthProtocol) ProbeIndirect(ctx context.Context, helperID, targetID peer.ID) error {
+	response, err := hp.exchange(ctx, helperID, &gen.MeshMessage{
+		Type: &gen.MeshMessage_SuspectRelay{SuspectRelay: &gen.SuspectRelay{
+			RelayId: targetID.String(),
+			Reason:  "direct probe failed",
+		}},
+	}, indirectProbeTimeout)
+	if err != nil {
+		return fmt.Errorf("indirect probe through %s failed: %w", helperID, err)
+	}
+	if suspect := response.GetSuspectRelay(); suspect != nil {
+		return fmt.Errorf("indirect probe through %s failed: %s", helperID, suspect.GetReason())
+	}
+	if response.GetHeartbeat().GetRelayId() != targetID.String() {
+		return fmt.Errorf("unexpected indirect probe response from %s", helperID)
+	}
+	return nil
+}
+
+// --- Failure Detection ---
+
+// periodicProbe runs the probe rounds and expires suspicions until the context is done
+func (hp *HealthProtocol) periodicProbe(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping failure detector")
+			return
+		case <-ticker.C:
+			if target, ok := hp.nextProbeTarget(); ok {
+				go hp.probeRound(ctx, target)
+			}
+			hp.checkSuspicions()
+		}
+	}
+}
+
+// nextProbeTarget returns the next peer to probe, cycling through peers in random order
+func (hp *HealthProtocol) nextProbeTarget() (peer.ID, bool) {
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	for {
+		if len(hp.probeOrder) == 0 {
+			hp.probeOrder = hp.relay.LocalMeshPeers.Keys()
+			if len(hp.probeOrder) == 0 {
+				return "", false
+			}
+			rand.Shuffle(len(hp.probeOrder), func(i, j int) {
+				hp.probeOrder[i], hp.probeOrder[j] = hp.probeOrder[j], hp.probeOrder[i]
+			})
+		}
+
+		target := hp.probeOrder[0]
+		hp.probeOrder = hp.probeOrder[1:]
+		// Skip peers which left since the cycle started
+		if hp.relay.LocalMeshPeers.Has(target) {
+			return target, true
+		}
+	}
+}
+
+// probeRound probes a peer directly, then indirectly, and suspects it if both fail
+func (hp *HealthProtocol) probeRound(ctx context.Context, target peer.ID) {
+	err := hp.Probe(ctx, target, heartbeatTimeout)
+	if err == nil {
+		return
+	}
+	slog.Debug("Direct probe failed, probing indirectly", "peer", target, "err", err)
+
+	// Any helper reaching the target is enough
+	helpers := hp.indirectProbeHelpers(target)
+	results := make(chan error, len(helpers))
+	for _, helper := range helpers {
+		go func(helperID peer.ID) {
+			results <- hp.ProbeIndirect(ctx, helperID, target)
+		}(helper)
+	}
+	for range helpers {
+		if indirectErr := <-results; indirectErr == nil {
+			slog.Debug("Indirect probe succeeded, peer is alive", "peer", target)
+			return
+		} else {
+			slog.Debug("Indirect probe failed", "peer", target, "err", indirectErr)
+		}
+	}
+
+	hp.suspect(ctx, target, err.Error())
+}
+
+// indirectProbeHelpers picks random peers other than target to probe through
+func (hp *HealthProtocol) indirectProbeHelpers(target peer.ID) []peer.ID {
+	candidates := make([]peer.ID, 0)
+	for _, peerID := range hp.relay.LocalMeshPeers.Keys() {
+		if peerID != target && hp.relay.hasConnectedPeer(peerID) {
+			candidates = append(candidates, peerID)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > indirectProbeCount {
+		candidates = candidates[:indirectProbeCount]
+	}
+	return candidates
+}
+
+// suspect records our own suspicion of a relay and spreads it through the mesh
+func (hp *HealthProtocol) suspect(ctx context.Context, target peer.ID, reason string) {
+	slog.Warn("Suspecting mesh peer of being dead", "peer", target, "reason", reason)
+	hp.addSuspicion(target, hp.relay.ID)
+
+	if err := hp.relay.publishHealthMessage(ctx, &gen.MeshMessage{
+		Type: &gen.MeshMessage_SuspectRelay{SuspectRelay: &gen.SuspectRelay{
+			RelayId: target.String(),
+			Reason:  reason,
+		}},
+	}); err != nil {
+		slog.Error("Failed to publish relay suspicion", "peer", target, "err", err)
+	}
+}
+
+// addSuspicion records a relay suspecting target, starting a new suspicion if needed
+func (hp *HealthProtocol) addSuspicion(target, suspecter peer.ID) {
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	s, ok := hp.suspicions[target]
+	if !ok {
+		s = &suspicion{
+			since:      time.Now(),
+			suspecters: make(map[peer.ID]bool),
+		}
+		hp.suspicions[target] = s
+	}
+	s.suspecters[suspecter] = true
+}
+
+// clearSuspicion drops the suspicion of a relay, returns whether there was one
+func (hp *HealthProtocol) clearSuspicion(target peer.ID) bool {
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	if _, ok := hp.suspicions[target]; !ok {
+		return false
+	}
+	delete(hp.suspicions, target)
+	return true
+}
+
+// isSuspected returns whether a relay is currently suspected
+func (hp *HealthProtocol) isSuspected(target peer.ID) bool {
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	_, ok := hp.suspicions[target]
+	return ok
+}
+
+// suspectedByQuorum returns whether enough relays suspect target to declare it dead
+func (hp *HealthProtocol) suspectedByQuorum(target peer.ID) bool {
+	quorum := hp.quorum(target)
+
+	hp.mutex.Lock()
+	defer hp.mutex.Unlock()
+
+	s, ok := hp.suspicions[target]
+	return ok && len(s.suspecters) >= quorum
+}
+
+// checkSuspicions declares suspected relays dead once the suspicion timed out and a quorum of relays agrees.
+// Suspicions without agreement expire, as the relay is reachable by most of the mesh
+func (hp *HealthProtocol) checkSuspicions() {
+	dead := make([]peer.ID, 0)
+	hp.mutex.Lock()
+	for target, s := range hp.suspicions {
+		elapsed := time.Since(s.since)
+		if elapsed < suspicionTimeout {
+			continue
+		}
+		if len(s.suspecters) >= hp.quorum(target) {
+			dead = append(dead, target)
+			delete(hp.suspicions, target)
+		} else if elapsed >= 2*suspicionTimeout {
+			slog.Info("Suspicion expired without mesh agreement", "peer", target, "suspecters", len(s.suspecters))
+			delete(hp.suspicions, target)
+		}
+	}
+	hp.mutex.Unlock()
+
+	for _, target := range dead {
+		if err := hp.relay.publishHealthMessage(context.Background(), &gen.MeshMessage{
+			Type: &gen.MeshMessage_Disconnect{Disconnect: &gen.Disconnect{
+				RelayId: target.String(),
+				Reason:  "suspicion confirmed by mesh",
+			}},
+		}); err != nil {
+			slog.Error("Failed to publish relay disconnect", "peer", target, "err", err)
+		}
+		hp.relay.onRelayDead(target, "suspicion confirmed by mesh")
+	}
+}
+
+// quorum returns the amount of relays which must suspect target before it's declared dead.
+// Majority of known relays except target, counting ourselves
+func (hp *HealthProtocol) quorum(target peer.ID) int {
+	members := 1
+	for _, peerID := range hp.relay.LocalMeshPeers.Keys() {
+		if peerID != target {
+			members++
+		}
+	}
+	return members/2 + 1
+}
+
+// onHealthMessage handles a failure detector message published by another relay
+func (hp *HealthProtocol) onHealthMessage(ctx context.Context, from peer.ID, msg *gen.MeshMessage) {
+	switch msgType := msg.GetType().(type) {
+	case *gen.MeshMessage_Heartbeat:
+		// Relays only refute suspicions of themselves
+		if msgType.Heartbeat.GetRelayId() != from.String() {
+			slog.Warn("Ignoring heartbeat published for another relay", "from", from, "relay_id", msgType.Heartbeat.GetRelayId())
+			return
+		}
+		if hp.clearSuspicion(from) {
+			slog.Info("Suspected mesh peer refuted suspicion", "peer", from)
+		}
+	case *gen.MeshMessage_SuspectRelay:
+		target, err := peer.Decode(msgType.SuspectRelay.GetRelayId())
+		if err != nil {
+			slog.Error("Invalid relay ID in suspicion", "from", from, "err", err)
+			return
+		}
+		if target == hp.relay.ID {
+			// We're alive, refute
+			slog.Info("Refuting suspicion of ourselves", "from", from, "reason", msgType.SuspectRelay.GetReason())
+			if err = hp.relay.publishHealthMessage(ctx, hp.newHeartbeat()); err != nil {
+				slog.Error("Failed to publish heartbeat refutation", "err", err)
+			}
+			return
+		}
+
+		alreadySuspected := hp.isSuspected(target)
+		hp.addSuspicion(target, from)
+		slog.Debug("Mesh peer suspects relay", "from", from, "peer", target, "reason", msgType.SuspectRelay.GetReason())
+		if !alreadySuspected && hp.relay.LocalMeshPeers.Has(target) {
+			// Confirm with our own probe, so agreement isn't reached by a single flaky link
+			go hp.probeRound(ctx, target)
+		}
+	case *gen.MeshMessage_Disconnect:
+		target, err := peer.Decode(msgType.Disconnect.GetRelayId())
+		if err != nil {
+			slog.Error("Invalid relay ID in disconnect", "from", from, "err", err)
+			return
+		}
+		if target == hp.relay.ID {
+			slog.Warn("Mesh declared us dead, refuting", "from", from, "reason", msgType.Disconnect.GetReason())
+			if err = hp.relay.publishHealthMessage(ctx, hp.newHeartbeat()); err != nil {
+				slog.Error("Failed to publish heartbeat refutation", "err", err)
+			}
+			return
+		}
+		// Relays may announce leaving themselves, others must be suspected by a quorum here too.
+		// A single relay publishing both the suspicion and the disconnect is not mesh agreement
+		if target != from && !hp.suspectedByQuorum(target) {
+			slog.Warn("Ignoring disconnect of relay without quorum of suspicion", "from", from, "peer", target)
+			return
+		}
+		hp.clearSuspicion(target)
+		hp.relay.onRelayDead(target, msgType.Disconnect.GetReason())
+	default:
+		slog.Warn("Unexpected message type on relay health topic", "from", from, "type", fmt.Sprintf("%T", msgType))
+	}
+}
+
+// --- Helpers ---
+
+// newHeartbeat creates a heartbeat message for ourselves
+func (hp *HealthProtocol) newHeartbeat() *gen.MeshMessage {
+	return &gen.MeshMessage{
+		Type: &gen.MeshMessage_Heartbeat{Heartbeat: &gen.Heartbeat{
+			RelayId:   hp.relay.ID.String(),
+			Timestamp: timestamppb.Now(),
+		}},
+	}
+}
+
+// exchange sends a single message to a peer over heartbeat protocol and returns its response
+func (hp *HealthProtocol) exchange(ctx context.Context, peerID peer.ID, msg proto.Message, timeout time.Duration) (*gen.MeshMessage, error) {
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stream, err := hp.relay.Host.NewStream(probeCtx, peerID, protocolHeartbeat)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create heartbeat stream: %w", err)
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(timeout))
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	if err = safeBRW.SendProto(msg); err != nil {
+		return nil, fmt.Errorf("failed to send probe: %w", err)
+	}
+	var response gen.MeshMessage
+	if err = safeBRW.ReceiveProto(&response); err != nil {
+		return nil, fmt.Errorf("failed to receive probe response: %w", err)
+	}
+	return &response, nil
+}
@@ -0,0 +1,276 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"relay/internal/common"
+	"relay/internal/connections"
+	"relay/internal/shared"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Protocol IDs ---
+const (
+	protocolStreamParticipant = "/nestri-relay/stream-participant/1.0.0" // For viewers (browsers) joining a room
+)
+
+// --- Protocol Types ---
+
+// ParticipantProtocol deals with viewer signaling, each stream is a single Participant
+type ParticipantProtocol struct {
+	relay *Relay
+}
+
+func NewParticipantProtocol(relay *Relay) *ParticipantProtocol {
+	protocol := &ParticipantProtocol{
+		relay: relay,
+	}
+
+	protocol.relay.Host.SetStreamHandler(protocolStreamParticipant, protocol.handleParticipantStream)
+
+	return protocol
+}
+
+// --- Protocol Stream Handlers ---
+
+// handleParticipantStream manages signaling of a single viewer for its whole lifetime
+func (pp *ParticipantProtocol) handleParticipantStream(stream network.Stream) {
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	var room *shared.Room
+	var participant *shared.Participant
+	defer func() {
+		pp.removeParticipant(room, participant)
+		_ = stream.Close()
+	}()
+
+	iceHolder := make([]webrtc.ICECandidateInit, 0)
+	for {
+		data, err := safeBRW.Receive()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, network.ErrReset) {
+				slog.Debug("Participant stream closed by peer", "peer", stream.Conn().RemotePeer())
+				return
+			}
+
+			slog.Error("Failed to receive data for participant stream", "err", err)
+			_ = stream.Reset()
+
+			return
+		}
+
+		var baseMsg connections.MessageBase
+		if err = json.Unmarshal(data, &baseMsg); err != nil {
+			slog.Error("Failed to unmarshal base message for participant stream", "err", err)
+			continue
+		}
+
+		switch baseMsg.Type {
+		case "request-stream-room":
+			if participant != nil {
+				slog.Warn("Participant already joined a room, ignoring request", "participant", participant.ID, "room", room.Name)
+				continue
+			}
+
+			var rawMsg connections.MessageRaw
+			if err = json.Unmarshal(data, &rawMsg); err != nil {
+				slog.Error("Failed to unmarshal raw message for participant room request", "err", err)
+				continue
+			}
+
+			var roomName string
+			if err = json.Unmarshal(rawMsg.Data, &roomName); err != nil {
+				slog.Error("Failed to unmarshal room name from raw message", "err", err)
+				continue
+			}
+			if len(roomName) == 0 {
+				slog.Error("Participant requested a room with empty name", "peer", stream.Conn().RemotePeer())
+				continue
+			}
+
+			slog.Info("Received participant request for room", "room", roomName, "peer", stream.Conn().RemotePeer())
+			if err = pp.relay.checkRoomCodecs(roomName); err != nil {
+				slog.Warn("Rejecting participant request for room", "room", roomName, "peer", stream.Conn().RemotePeer(), "err", err)
+				sendStreamError(safeBRW, "request-stream-error", roomName, err)
+				return
+			}
+			room = pp.getOrCreateRoom(roomName)
+
+			participant, err = pp.createParticipant(room, safeBRW)
+			if err != nil {
+				slog.Error("Failed to create participant", "room", roomName, "err", err)
+				pp.releaseRoom(room)
+				_ = stream.Reset()
+				return
+			}
+			room.AddParticipant(participant)
+
+			if !room.IsOnline() {
+				slog.Debug("Room is offline, participant is waiting for tracks", "room", room.Name, "participant", participant.ID)
+				if err = room.SignalParticipantOffline(participant); err != nil {
+					slog.Error("Failed to signal participant offline", "room", room.Name, "participant", participant.ID, "err", err)
+				}
+				continue
+			}
+
+			if err = room.SignalParticipantWithTracks(participant); err != nil {
+				slog.Error("Failed to signal participant with tracks", "room", room.Name, "participant", participant.ID, "err", err)
+				continue
+			}
+			slog.Debug("Sent offer to participant", "room", room.Name, "participant", participant.ID)
+		case "ice-candidate":
+			var iceMsg connections.MessageICE
+			if err = json.Unmarshal(data, &iceMsg); err != nil {
+				slog.Error("Failed to unmarshal ICE candidate for participant", "err", err)
+				continue
+			}
+			if participant != nil && participant.PeerConnection.RemoteDescription() != nil {
+				if err = participant.PeerConnection.AddICECandidate(iceMsg.Candidate); err != nil {
+					slog.Error("Failed to add ICE candidate for participant", "participant", participant.ID, "err", err)
+				}
+				for _, heldIce := range iceHolder {
+					if err = participant.PeerConnection.AddICECandidate(heldIce); err != nil {
+						slog.Error("Failed to add held ICE candidate for participant", "participant", participant.ID, "err", err)
+					}
+				}
+				// Clear the held candidates
+				iceHolder = make([]webrtc.ICECandidateInit, 0)
+			} else {
+				// Hold the candidate until remote description is set
+				iceHolder = append(iceHolder, iceMsg.Candidate)
+			}
+		case "answer":
+			if participant == nil {
+				slog.Warn("Received answer from participant without joined room")
+				continue
+			}
+
+			var answerMsg connections.MessageSDP
+			if err = json.Unmarshal(data, &answerMsg); err != nil {
+				slog.Error("Failed to unmarshal answer from participant", "participant", participant.ID, "err", err)
+				continue
+			}
+			if err = participant.PeerConnection.SetRemoteDescription(answerMsg.SDP); err != nil {
+				slog.Error("Failed to set remote description for participant", "participant", participant.ID, "err", err)
+				continue
+			}
+			// Viewers that can't decode the room codecs would only get a black screen
+			if err = common.CheckRemoteCodecs(participant.PeerConnection); err != nil {
+				slog.Warn("Rejecting participant", "room", room.Name, "participant", participant.ID, "err", err)
+				sendStreamError(safeBRW, "request-stream-error", room.Name, err)
+				return
+			}
+			slog.Debug("Set remote description for participant", "room", room.Name, "participant", participant.ID)
+		default:
+			slog.Warn("Unknown participant signaling message type", "type", baseMsg.Type)
+		}
+	}
+}
+
+// --- Helpers ---
+
+// getOrCreateRoom returns a local room by name, mirroring and requesting a remote one or creating a new local one as needed
+func (pp *ParticipantProtocol) getOrCreateRoom(roomName string) *shared.Room {
+	room := pp.relay.GetRoomByName(roomName)
+	if room == nil {
+		remoteRoom := pp.relay.GetRemoteRoomByName(roomName)
+		if remoteRoom == nil {
+			// Nobody hosts the room yet, wait locally for a push
+			return pp.relay.CreateRoom(roomName)
+		}
+		room = pp.relay.CreateRemoteRoom(*remoteRoom)
+	}
+
+	// Request the stream from owner if we're mirroring a room that isn't streaming to us yet
+	if room.GetOwnerID() != pp.relay.ID && !room.IsOnline() && !pp.relay.StreamProtocol.isRequested(room.Name) {
+		slog.Debug("Requesting remote room stream for participant", "room", room.Name, "owner_id", room.GetOwnerID())
+		if err := pp.relay.requestRoomStream(context.Background(), room, ""); err != nil {
+			slog.Error("Failed to request stream for participant room", "room", room.Name, "owner_id", room.GetOwnerID(), "err", err)
+		}
+	}
+
+	return room
+}
+
+// createParticipant creates a Participant with PeerConnection and DataChannel set up for the given room
+func (pp *ParticipantProtocol) createParticipant(room *shared.Room, safeBRW *common.SafeBufioRW) (*shared.Participant, error) {
+	participant, err := shared.NewParticipant(safeBRW)
+	if err != nil {
+		return nil, err
+	}
+
+	participant.PeerConnection, err = pp.relay.WebRTC.CreatePeerConnection(func() {
+		slog.Info("PeerConnection closed for participant", "room", room.Name, "participant", participant.ID)
+		pp.removeParticipant(room, participant)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// DataChannel setup
+	settingOrdered := true
+	settingMaxRetransmits := uint16(2)
+	dc, err := participant.PeerConnection.CreateDataChannel("data", &webrtc.DataChannelInit{
+		Ordered:        &settingOrdered,
+		MaxRetransmits: &settingMaxRetransmits,
+	})
+	if err != nil {
+		_ = participant.Close()
+		return nil, err
+	}
+	participant.DataChannel = connections.NewNestriDataChannel(dc)
+
+	participant.DataChannel.RegisterOnOpen(func() {
+		slog.Debug("DataChannel opened for participant", "room", room.Name, "participant", participant.ID)
+	})
+	participant.DataChannel.RegisterOnClose(func() {
+		slog.Debug("DataChannel closed for participant", "room", room.Name, "participant", participant.ID)
+	})
+	participant.DataChannel.RegisterMessageCallback("input", func(data []byte) {
+		if err := pp.relay.StreamProtocol.sendUpstream(room, data); err != nil {
+			slog.Error("Failed to forward input message from participant to upstream room", "room", room.Name, "err", err)
+		}
+	})
+
+	// ICE Candidate handling
+	participant.PeerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+
+		if err := safeBRW.SendJSON(connections.NewMessageICE("ice-candidate", candidate.ToJSON())); err != nil {
+			slog.Error("Failed to send ICE candidate message to participant", "participant", participant.ID, "err", err)
+		}
+	})
+
+	return participant, nil
+}
+
+// removeParticipant tears down a participant and cleans up the room if it's no longer needed
+func (pp *ParticipantProtocol) removeParticipant(room *shared.Room, participant *shared.Participant) {
+	// Only the call actually removing the participant closes it
+	if room == nil || participant == nil || !room.RemoveParticipantByID(participant.ID) {
+		return
+	}
+
+	if err := participant.Close(); err != nil {
+		slog.Error("Failed to close participant PeerConnection", "participant", participant.ID, "err", err)
+	}
+	slog.Info("Participant left room", "room", room.Name, "participant", participant.ID)
+	pp.releaseRoom(room)
+}
+
+// releaseRoom deletes a room left without participants, mirrored rooms and rooms nobody is pushing to
+// are not needed without them
+func (pp *ParticipantProtocol) releaseRoom(room *shared.Room) {
+	if room.GetOwnerID() != pp.relay.ID || !pp.relay.StreamProtocol.incomingConns.Has(room.Name) {
+		pp.relay.DeleteRoomIfEmpty(room)
+	}
+}
@@ -0,0 +1,221 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"relay/internal/common"
+	"relay/internal/connections"
+	"relay/internal/shared"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// --- Protocol IDs ---
+const (
+	protocolRoomRecording = "/nestri-relay/room-recording/1.0.0" // For starting and stopping recordings and captures of a room
+)
+
+// --- Protocol Types ---
+
+// recordingResponse is the answer to a recording request
+type recordingResponse struct {
+	Room  string `json:"room"`
+	Path  string `json:"path,omitempty"`  // Recording description or capture file, only filled in on success
+	Error string `json:"error,omitempty"` // Only filled in on failure
+}
+
+// RecordingProtocol deals with recording rooms to disk, on request of mesh relays or the node pushing the room.
+// Besides playable recordings, the raw upstream packets of a room can be captured for debugging
+type RecordingProtocol struct {
+	relay     *Relay
+	recorders *common.SafeMap[string, *shared.Recorder] // room name -> active recording
+	captures  *common.SafeMap[string, *shared.Capture]  // room name -> active packet capture
+}
+
+func NewRecordingProtocol(relay *Relay) *RecordingProtocol {
+	protocol := &RecordingProtocol{
+		relay:     relay,
+		recorders: common.NewSafeMap[string, *shared.Recorder](),
+		captures:  common.NewSafeMap[string, *shared.Capture](),
+	}
+
+	protocol.relay.Host.SetStreamHandler(protocolRoomRecording, protocol.handleRecording)
+
+	return protocol
+}
+
+// --- Protocol Stream Handlers ---
+
+// handleRecording starts or stops recording or capturing a room
+func (rp *RecordingProtocol) handleRecording(stream network.Stream) {
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(recordingRequestTimeout))
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+	requesterID := stream.Conn().RemotePeer()
+
+	var rawMsg connections.MessageRaw
+	if err := safeBRW.ReceiveJSON(&rawMsg); err != nil {
+		slog.Error("Failed to receive recording request", "peer", requesterID, "err", err)
+		return
+	}
+	var roomName string
+	if err := json.Unmarshal(rawMsg.Data, &roomName); err != nil {
+		slog.Error("Failed to unmarshal room name from recording request", "peer", requesterID, "err", err)
+		_ = stream.Reset()
+		return
+	}
+
+	// Recordings hold player sessions, only the mesh and whoever streams the room may control them
+	var err error
+	response := recordingResponse{Room: roomName}
+	if !rp.relay.AdmissionProtocol.IsAdmitted(requesterID) && !rp.relay.StreamProtocol.isPushing(roomName, requesterID) {
+		err = errors.New("not allowed to control recordings of this room")
+	} else {
+		switch rawMsg.Type {
+		case "recording-start":
+			response.Path, err = rp.StartRecording(roomName)
+		case "recording-stop":
+			response.Path, err = rp.StopRecording(roomName)
+		case "capture-start":
+			response.Path, err = rp.StartCapture(roomName)
+		case "capture-stop":
+			response.Path, err = rp.StopCapture(roomName)
+		default:
+			err = fmt.Errorf("unknown recording request type: %s", rawMsg.Type)
+		}
+	}
+
+	msgType := "recording-ok"
+	if err != nil {
+		slog.Warn("Refusing recording request", "room", roomName, "peer", requesterID, "type", rawMsg.Type, "err", err)
+		msgType = "recording-error"
+		response.Error = err.Error()
+	}
+	responseData, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("Failed to marshal recording response", "room", roomName, "err", err)
+		return
+	}
+	if err = safeBRW.SendJSON(connections.NewMessageRaw(msgType, responseData)); err != nil {
+		slog.Error("Failed to send recording response", "room", roomName, "peer", requesterID, "err", err)
+	}
+}
+
+// --- Helpers ---
+
+// isRecording checks if a room is being recorded
+func (rp *RecordingProtocol) isRecording(roomName string) bool {
+	return rp.recorders.Has(roomName)
+}
+
+// capture returns the active packet capture of a room, nil if not captured
+func (rp *RecordingProtocol) capture(roomName string) *shared.Capture {
+	if capture, ok := rp.captures.Get(roomName); ok {
+		return capture
+	}
+	return nil
+}
+
+// stopAllOnDone finishes all recordings and captures once the context is done
+func (rp *RecordingProtocol) stopAllOnDone(ctx context.Context) {
+	<-ctx.Done()
+	for roomName := range rp.recorders.Copy() {
+		if _, err := rp.StopRecording(roomName); err != nil {
+			slog.Error("Failed to stop recording on shutdown", "room", roomName, "err", err)
+		}
+	}
+	for roomName := range rp.captures.Copy() {
+		if _, err := rp.StopCapture(roomName); err != nil {
+			slog.Error("Failed to stop capture on shutdown", "room", roomName, "err", err)
+		}
+	}
+}
+
+// --- Public Usable Methods ---
+
+// StartRecording starts recording a room into the persist directory, getting the room stream like a participant would.
+// Returns the path of the recording description
+func (rp *RecordingProtocol) StartRecording(roomName string) (string, error) {
+	persistDir := rp.relay.Config.PersistDir
+	if len(persistDir) == 0 {
+		return "", errors.New("recording needs a persist directory")
+	}
+	if recorder, ok := rp.recorders.Get(roomName); ok {
+		return recorder.Path(), nil
+	}
+	if err := rp.relay.checkRoomCodecs(roomName); err != nil {
+		return "", err
+	}
+
+	room := rp.relay.ParticipantProtocol.getOrCreateRoom(roomName)
+	recorder, err := shared.NewRecorder(room, filepath.Join(persistDir, "recordings"), rp.relay.ID.String())
+	if err != nil {
+		rp.relay.DeleteRoomIfEmpty(room)
+		return "", err
+	}
+	rp.recorders.Set(roomName, recorder)
+	return recorder.Path(), nil
+}
+
+// StopRecording stops recording a room, returning the path of the recording description
+func (rp *RecordingProtocol) StopRecording(roomName string) (string, error) {
+	recorder, ok := rp.recorders.Get(roomName)
+	if !ok {
+		return "", fmt.Errorf("room %s is not being recorded", roomName)
+	}
+	rp.recorders.Delete(roomName)
+	recorder.Stop()
+
+	// Mirrored rooms may not be needed without the recording
+	if recorder.Room.GetOwnerID() != rp.relay.ID || !rp.relay.StreamProtocol.incomingConns.Has(roomName) {
+		rp.relay.DeleteRoomIfEmpty(recorder.Room)
+	}
+	return recorder.Path(), nil
+}
+
+// StartCapture starts capturing the packets this relay receives for a room into the persist directory.
+// Unlike recordings, captures don't get the room stream, only what comes in for pushes and receivers is captured.
+// Returns the path of the capture file
+func (rp *RecordingProtocol) StartCapture(roomName string) (string, error) {
+	persistDir := rp.relay.Config.PersistDir
+	if len(persistDir) == 0 {
+		return "", errors.New("capturing needs a persist directory")
+	}
+	if capture, ok := rp.captures.Get(roomName); ok {
+		return capture.Path(), nil
+	}
+
+	capture, err := shared.NewCapture(roomName, filepath.Join(persistDir, "captures"), rp.relay.ID.String())
+	if err != nil {
+		return "", err
+	}
+	rp.captures.Set(roomName, capture)
+	// Captures are only useful from a keyframe on
+	if room := rp.relay.GetRoomByName(roomName); room != nil {
+		room.RequestKeyframe("")
+	}
+	return capture.Path(), nil
+}
+
+// StopCapture stops capturing a room, returning the path of the capture file
+func (rp *RecordingProtocol) StopCapture(roomName string) (string, error) {
+	capture, ok := rp.captures.Get(roomName)
+	if !ok {
+		return "", fmt.Errorf("room %s is not being captured", roomName)
+	}
+	rp.captures.Delete(roomName)
+	if err := capture.Close(); err != nil {
+		return "", fmt.Errorf("failed to finish capture: %w", err)
+	}
+	return capture.Path(), nil
+}
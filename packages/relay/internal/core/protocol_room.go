@@ -0,0 +1,163 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"relay/internal/common"
+	"relay/internal/connections"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// --- Protocol IDs ---
+const (
+	protocolRoomClaim = "/nestri-relay/room-claim/1.0.0" // For taking over ownership of a room from its current owner relay
+)
+
+// --- Protocol Types ---
+
+// RoomClaimDeniedError is returned when the owner of a room refuses to hand it over
+type RoomClaimDeniedError struct {
+	Room    string
+	OwnerID peer.ID
+	Reason  string
+}
+
+func (e *RoomClaimDeniedError) Error() string {
+	return fmt.Sprintf("claim of room %s denied by owner %s: %s", e.Room, e.OwnerID, e.Reason)
+}
+
+// roomClaimResponse is the answer of the owner relay to a claim
+type roomClaimResponse struct {
+	Room   string `json:"room"`
+	Reason string `json:"reason,omitempty"` // Only filled in when denied
+}
+
+// RoomProtocol deals with room ownership handover between relays
+type RoomProtocol struct {
+	relay *Relay
+}
+
+func NewRoomProtocol(relay *Relay) *RoomProtocol {
+	protocol := &RoomProtocol{
+		relay: relay,
+	}
+
+	protocol.relay.Host.SetStreamHandler(protocolRoomClaim, protocol.handleRoomClaim)
+
+	return protocol
+}
+
+// --- Protocol Stream Handlers ---
+
+// handleRoomClaim hands over an owned room to the claiming relay, unless the room is still being pushed to us
+func (rp *RoomProtocol) handleRoomClaim(stream network.Stream) {
+	if !rp.relay.AdmissionProtocol.IsAdmitted(stream.Conn().RemotePeer()) {
+		slog.Warn("Refusing room claim from non-admitted peer", "peer", stream.Conn().RemotePeer())
+		_ = stream.Reset()
+		return
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(roomClaimTimeout))
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+	claimerID := stream.Conn().RemotePeer()
+
+	var rawMsg connections.MessageRaw
+	if err := safeBRW.ReceiveJSON(&rawMsg); err != nil {
+		slog.Error("Failed to receive room claim", "peer", claimerID, "err", err)
+		return
+	}
+	if rawMsg.Type != "claim-room" {
+		slog.Error("Unexpected message on room claim stream", "peer", claimerID, "type", rawMsg.Type)
+		_ = stream.Reset()
+		return
+	}
+	var roomName string
+	if err := json.Unmarshal(rawMsg.Data, &roomName); err != nil {
+		slog.Error("Failed to unmarshal room name from room claim", "peer", claimerID, "err", err)
+		_ = stream.Reset()
+		return
+	}
+
+	msgType := "claim-room-ok"
+	response := roomClaimResponse{Room: roomName}
+	if err := rp.relay.handOverRoom(roomName, claimerID); err != nil {
+		slog.Warn("Refusing room claim", "room", roomName, "peer", claimerID, "err", err)
+		msgType = "claim-room-denied"
+		response.Reason = err.Error()
+	} else {
+		slog.Info("Handed over room to claiming relay", "room", roomName, "peer", claimerID)
+	}
+
+	responseData, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("Failed to marshal room claim response", "room", roomName, "err", err)
+		return
+	}
+	if err = safeBRW.SendJSON(connections.NewMessageRaw(msgType, responseData)); err != nil {
+		slog.Error("Failed to send room claim response", "room", roomName, "peer", claimerID, "err", err)
+	}
+}
+
+// --- Public Usable Methods ---
+
+// ClaimRoom asks the owner relay of a room to hand it over to us
+func (rp *RoomProtocol) ClaimRoom(ctx context.Context, roomName string, ownerID peer.ID) error {
+	if err := rp.relay.AdmissionProtocol.EnsureAdmitted(ctx, ownerID); err != nil {
+		return fmt.Errorf("failed to join mesh through owner relay: %w", err)
+	}
+
+	claimCtx, cancel := context.WithTimeout(ctx, roomClaimTimeout)
+	defer cancel()
+
+	stream, err := rp.relay.Host.NewStream(claimCtx, ownerID, protocolRoomClaim)
+	if err != nil {
+		return fmt.Errorf("failed to create room claim stream: %w", err)
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(roomClaimTimeout))
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	roomData, err := json.Marshal(roomName)
+	if err != nil {
+		return fmt.Errorf("failed to marshal room name: %w", err)
+	}
+	if err = safeBRW.SendJSON(connections.NewMessageRaw("claim-room", roomData)); err != nil {
+		return fmt.Errorf("failed to send room claim: %w", err)
+	}
+
+	var rawMsg connections.MessageRaw
+	if err = safeBRW.ReceiveJSON(&rawMsg); err != nil {
+		return fmt.Errorf("failed to receive room claim response: %w", err)
+	}
+	var response roomClaimResponse
+	if err = json.Unmarshal(rawMsg.Data, &response); err != nil {
+		return fmt.Errorf("failed to unmarshal room claim response: %w", err)
+	}
+
+	switch rawMsg.Type {
+	case "claim-room-ok":
+		return nil
+	case "claim-room-denied":
+		return &RoomClaimDeniedError{
+			Room:    roomName,
+			OwnerID: ownerID,
+			Reason:  response.Reason,
+		}
+	default:
+		return fmt.Errorf("unexpected room claim response type: %s", rawMsg.Type)
+	}
+}
@@ -0,0 +1,166 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"relay/internal/common"
+	gen "relay/internal/proto"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// --- Protocol IDs ---
+const (
+	protocolStateSync = "/nestri-relay/state-sync/1.0.0" // For recovering missed room state updates from their origin relay
+)
+
+// --- Protocol Types ---
+
+// StateProtocol deals with retransmission of room state updates between relays
+type StateProtocol struct {
+	relay    *Relay
+	inFlight *common.SafeMap[peer.ID, bool] // peer ID -> retransmission request in progress
+}
+
+func NewStateProtocol(relay *Relay) *StateProtocol {
+	protocol := &StateProtocol{
+		relay:    relay,
+		inFlight: common.NewSafeMap[peer.ID, bool](),
+	}
+
+	protocol.relay.Host.SetStreamHandler(protocolStateSync, protocol.handleStateSync)
+
+	return protocol
+}
+
+// --- Protocol Stream Handlers ---
+
+// handleStateSync answers a retransmission request with our latest state update
+func (stp *StateProtocol) handleStateSync(stream network.Stream) {
+	if !stp.relay.AdmissionProtocol.IsAdmitted(stream.Conn().RemotePeer()) {
+		slog.Warn("Refusing state sync from non-admitted peer", "peer", stream.Conn().RemotePeer())
+		_ = stream.Reset()
+		return
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(stateSyncTimeout))
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	var reqMsg gen.MeshMessage
+	if err := safeBRW.ReceiveProto(&reqMsg); err != nil {
+		slog.Error("Failed to receive retransmission request", "peer", stream.Conn().RemotePeer(), "err", err)
+		return
+	}
+	request := reqMsg.GetRetransmissionRequest()
+	if request == nil {
+		slog.Error("Unexpected message on state sync stream", "peer", stream.Conn().RemotePeer())
+		_ = stream.Reset()
+		return
+	}
+
+	// Our updates are full snapshots, the latest one answers any requested sequence number
+	update, err := stp.relay.latestStateUpdate(context.Background())
+	if err != nil {
+		slog.Error("Failed to get latest state update for retransmission", "err", err)
+		_ = stream.Reset()
+		return
+	}
+	slog.Debug("Retransmitting room state update", "peer", request.GetRelayId(), "requested", request.GetSequenceNumber(), "sequence", update.GetSequenceNumber())
+
+	if err = safeBRW.SendProto(&gen.MeshMessage{
+		Type: &gen.MeshMessage_Retransmission{Retransmission: &gen.Retransmission{
+			RelayId:     stp.relay.ID.String(),
+			StateUpdate: update,
+		}},
+	}); err != nil {
+		slog.Error("Failed to send retransmission", "peer", stream.Conn().RemotePeer(), "err", err)
+		return
+	}
+
+	var ackMsg gen.MeshMessage
+	if err = safeBRW.ReceiveProto(&ackMsg); err != nil {
+		if !errors.Is(err, io.EOF) {
+			slog.Warn("Failed to receive retransmission ack", "peer", stream.Conn().RemotePeer(), "err", err)
+		}
+		return
+	}
+	if ack := ackMsg.GetAck(); ack != nil {
+		slog.Debug("Retransmission acknowledged", "peer", ack.GetRelayId(), "sequence", ack.GetSequenceNumber())
+	}
+}
+
+// --- Public Usable Methods ---
+
+// RequestRetransmission recovers a missed room state update from the relay that published it
+func (stp *StateProtocol) RequestRetransmission(ctx context.Context, peerID peer.ID, sequence uint64) {
+	if _, loaded := stp.inFlight.LoadOrStore(peerID, true); loaded {
+		return
+	}
+	defer stp.inFlight.Delete(peerID)
+
+	if err := stp.requestRetransmission(ctx, peerID, sequence); err != nil {
+		slog.Error("Failed to recover room state update", "peer", peerID, "sequence", sequence, "err", err)
+	}
+}
+
+func (stp *StateProtocol) requestRetransmission(ctx context.Context, peerID peer.ID, sequence uint64) error {
+	if err := stp.relay.AdmissionProtocol.EnsureAdmitted(ctx, peerID); err != nil {
+		return fmt.Errorf("failed to join mesh through relay: %w", err)
+	}
+
+	syncCtx, cancel := context.WithTimeout(ctx, stateSyncTimeout)
+	defer cancel()
+
+	stream, err := stp.relay.Host.NewStream(syncCtx, peerID, protocolStateSync)
+	if err != nil {
+		return fmt.Errorf("failed to create state sync stream: %w", err)
+	}
+	defer func() {
+		_ = stream.Close()
+	}()
+	_ = stream.SetDeadline(time.Now().Add(stateSyncTimeout))
+
+	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	safeBRW := common.NewSafeBufioRW(brw)
+
+	if err = safeBRW.SendProto(&gen.MeshMessage{
+		Type: &gen.MeshMessage_RetransmissionRequest{RetransmissionRequest: &gen.RetransmissionRequest{
+			RelayId:        stp.relay.ID.String(),
+			SequenceNumber: sequence,
+		}},
+	}); err != nil {
+		return fmt.Errorf("failed to send retransmission request: %w", err)
+	}
+
+	var respMsg gen.MeshMessage
+	if err = safeBRW.ReceiveProto(&respMsg); err != nil {
+		return fmt.Errorf("failed to receive retransmission: %w", err)
+	}
+	retransmission := respMsg.GetRetransmission()
+	if retransmission == nil || retransmission.GetStateUpdate() == nil {
+		return errors.New("unexpected response to retransmission request")
+	}
+	if retransmission.GetRelayId() != peerID.String() {
+		return fmt.Errorf("retransmission relay ID mismatch: %s", retransmission.GetRelayId())
+	}
+
+	update := retransmission.GetStateUpdate()
+	stp.relay.onStateUpdate(peerID, update)
+
+	return safeBRW.SendProto(&gen.MeshMessage{
+		Type: &gen.MeshMessage_Ack{Ack: &gen.Ack{
+			RelayId:        stp.relay.ID.String(),
+			SequenceNumber: update.GetSequenceNumber(),
+		}},
+	})
+}
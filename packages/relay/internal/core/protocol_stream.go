@@ -10,12 +10,20 @@ import (
 	"log/slog"
 	"relay/internal/common"
 	"relay/internal/connections"
+	gen "relay/internal/proto"
 	"relay/internal/shared"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
 )
 
 // TODO:s
@@ -33,24 +41,82 @@ const (
 
 // StreamConnection is a connection between two relays for stream protocol
 type StreamConnection struct {
-	pc  *webrtc.PeerConnection
-	ndc *connections.NestriDataChannel
+	pc   *webrtc.PeerConnection
+	room string  // Name of the served room, for served streams
+	peer peer.ID // Pushing peer, for pushed streams
+
+	signal *common.SafeBufioRW                           // Signaling stream of the pushing peer, for pushed streams
+	ndc    atomic.Pointer[connections.NestriDataChannel] // DataChannel to the other relay, set once created and read from feedback goroutines
+
+	// Bandwidth of served streams
+	forwarder       *shared.LayerForwarder // Video layer forwarder of the receiving relay, nil without simulcast
+	transportCC     atomic.Bool            // Whether the receiving relay sends TWCC feedback
+	reportedBitrate atomic.Uint64          // Target bitrate reported by the receiving relay for its own receivers
+
+	// Protection of served streams
+	lossMutex sync.Mutex
+	loss      float64 // Smoothed fraction of packets lost on the link
+}
+
+// servedKey identifies a served stream, a relay may request several rooms from us
+type servedKey struct {
+	peer peer.ID
+	room string
+}
+
+// streamSubscription is a stream request from another relay for a room that is offline
+type streamSubscription struct {
+	stream  network.Stream
+	safeBRW *common.SafeBufioRW
+}
+
+// pushRedirect points a pushing node to the relay owning the room
+type pushRedirect struct {
+	Room    string   `json:"room"`
+	RelayID string   `json:"relay_id"`
+	Addrs   []string `json:"addrs"`
+}
+
+// streamError tells why a stream push or request was refused
+type streamError struct {
+	Room  string `json:"room"`
+	Error string `json:"error"`
 }
 
 // StreamProtocol deals with meshed stream forwarding
 type StreamProtocol struct {
 	relay          *Relay
-	servedConns    *common.SafeMap[peer.ID, *StreamConnection] // peer ID -> StreamConnection (for served streams)
-	incomingConns  *common.SafeMap[string, *StreamConnection]  // room name -> StreamConnection (for incoming pushed streams)
-	requestedConns *common.SafeMap[string, *StreamConnection]  // room name -> StreamConnection (for requested streams from other relays)
+	servedConns    *common.SafeMap[servedKey, *StreamConnection] // peer ID and room name -> StreamConnection (for served streams)
+	incomingConns  *common.SafeMap[string, *StreamConnection]    // room name -> StreamConnection (for incoming pushed streams)
+	requestedConns *common.SafeMap[string, *StreamConnection]    // room name -> StreamConnection (for requested streams from other relays)
+	pendingConns   *common.SafeMap[string, bool]                 // room name -> true, while a stream request waits for its offer
+	pushedTracks   *common.SafeMap[string, *pushedTrack]         // room name and track kind -> local track fed by pushes
+
+	trackRewriters *common.SafeMap[*webrtc.TrackLocalStaticRTP, *common.RTPRewriter] // local track -> rewriter of packets forwarded to it
+	trackTaps      *common.SafeMap[*webrtc.TrackLocalStaticRTP, *common.TrackTaps]   // local track -> in-process receivers of it
+
+	waitersMutex  sync.Mutex
+	onlineWaiters map[string][]chan struct{}       // room name -> requests waiting for the room to come online
+	subscriptions map[string][]*streamSubscription // room name -> relays waiting for the room to come online
+
+	keyframeMutex   sync.Mutex
+	keyframeSources map[string]map[string]*keyframeSource // room name -> RID -> upstream video track
 }
 
 func NewStreamProtocol(relay *Relay) *StreamProtocol {
 	protocol := &StreamProtocol{
 		relay:          relay,
-		servedConns:    common.NewSafeMap[peer.ID, *StreamConnection](),
+		servedConns:    common.NewSafeMap[servedKey, *StreamConnection](),
 		incomingConns:  common.NewSafeMap[string, *StreamConnection](),
 		requestedConns: common.NewSafeMap[string, *StreamConnection](),
+		pendingConns:   common.NewSafeMap[string, bool](),
+		pushedTracks:   common.NewSafeMap[string, *pushedTrack](),
+		trackRewriters: common.NewSafeMap[*webrtc.TrackLocalStaticRTP, *common.RTPRewriter](),
+		trackTaps:      common.NewSafeMap[*webrtc.TrackLocalStaticRTP, *common.TrackTaps](),
+		onlineWaiters:  make(map[string][]chan struct{}),
+		subscriptions:  make(map[string][]*streamSubscription),
+
+		keyframeSources: make(map[string]map[string]*keyframeSource),
 	}
 
 	protocol.relay.Host.SetStreamHandler(protocolStreamRequest, protocol.handleStreamRequest)
@@ -63,9 +129,17 @@ func NewStreamProtocol(relay *Relay) *StreamProtocol {
 
 // handleStreamRequest manages a request from another relay for a stream hosted locally
 func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
+	if !sp.relay.AdmissionProtocol.IsAdmitted(stream.Conn().RemotePeer()) {
+		slog.Warn("Refusing stream request from non-admitted peer", "peer", stream.Conn().RemotePeer())
+		_ = stream.Reset()
+		return
+	}
+
 	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
 	safeBRW := common.NewSafeBufioRW(brw)
+	defer sp.unsubscribe(stream)
 
+	var requested servedKey // stream served over this request, answer and candidates are for it
 	iceHolder := make([]webrtc.ICECandidateInit, 0)
 	for {
 		data, err := safeBRW.Receive()
@@ -102,12 +176,17 @@ func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
 			}
 
 			slog.Info("Received stream request for room", "room", roomName)
+			requested = servedKey{peer: stream.Conn().RemotePeer(), room: roomName}
 			room := sp.relay.GetRoomByName(roomName)
-			if room == nil || !room.IsOnline() || room.OwnerID != sp.relay.ID {
-				// TODO: Allow forward requests to other relays from here?
-				slog.Debug("Cannot provide stream for nil, offline or non-owned room", "room", roomName, "is_online", room != nil && room.IsOnline(), "is_owner", room != nil && room.OwnerID == sp.relay.ID)
+			if room == nil || !room.IsOnline() {
+				// Not streaming here, forward the stream from upstream if the room is online elsewhere
+				room = sp.transitRoom(roomName, stream.Conn().RemotePeer())
+			}
+			if room == nil {
+				slog.Debug("Cannot provide stream for nil or offline room yet, subscribing requester", "room", roomName)
+				// Offer is sent once the room comes online
+				sp.subscribe(roomName, stream, safeBRW)
 				// Respond with "request-stream-offline" message with room name
-				// TODO: Store the peer and send "online" message when the room comes online
 				roomNameData, err := json.Marshal(roomName)
 				if err != nil {
 					slog.Error("Failed to marshal room name for request stream offline", "room", roomName, "err", err)
@@ -123,100 +202,17 @@ func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
 				continue
 			}
 
-			pc, err := common.CreatePeerConnection(func() {
-				slog.Info("PeerConnection closed for requested stream", "room", roomName)
-				// Cleanup the stream connection
-				if ok := sp.servedConns.Has(stream.Conn().RemotePeer()); ok {
-					sp.servedConns.Delete(stream.Conn().RemotePeer())
-				}
-			})
-			if err != nil {
-				slog.Error("Failed to create PeerConnection for requested stream", "room", roomName, "err", err)
-				continue
-			}
-
-			// Add tracks
-			if room.AudioTrack != nil {
-				if _, err = pc.AddTrack(room.AudioTrack); err != nil {
-					slog.Error("Failed to add audio track for requested stream", "room", roomName, "err", err)
-					continue
-				}
-			}
-			if room.VideoTrack != nil {
-				if _, err = pc.AddTrack(room.VideoTrack); err != nil {
-					slog.Error("Failed to add video track for requested stream", "room", roomName, "err", err)
-					continue
-				}
-			}
-
-			// DataChannel setup
-			settingOrdered := true
-			settingMaxRetransmits := uint16(2)
-			dc, err := pc.CreateDataChannel("relay-data", &webrtc.DataChannelInit{
-				Ordered:        &settingOrdered,
-				MaxRetransmits: &settingMaxRetransmits,
-			})
-			if err != nil {
-				slog.Error("Failed to create DataChannel for requested stream", "room", roomName, "err", err)
+			if err = sp.serveRoom(stream, safeBRW, room); err != nil {
+				slog.Error("Failed to serve requested stream", "room", roomName, "err", err)
 				continue
 			}
-			ndc := connections.NewNestriDataChannel(dc)
-
-			ndc.RegisterOnOpen(func() {
-				slog.Debug("Relay DataChannel opened for requested stream", "room", roomName)
-			})
-			ndc.RegisterOnClose(func() {
-				slog.Debug("Relay DataChannel closed for requested stream", "room", roomName)
-			})
-			ndc.RegisterMessageCallback("input", func(data []byte) {
-				if room.DataChannel != nil {
-					if err = room.DataChannel.SendBinary(data); err != nil {
-						slog.Error("Failed to forward input message from mesh to upstream room", "room", roomName, "err", err)
-					}
-				}
-			})
-
-			// ICE Candidate handling
-			pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-				if candidate == nil {
-					return
-				}
-
-				if err = safeBRW.SendJSON(connections.NewMessageICE("ice-candidate", candidate.ToJSON())); err != nil {
-					slog.Error("Failed to send ICE candidate message for requested stream", "room", roomName, "err", err)
-					return
-				}
-			})
-
-			// Create offer
-			offer, err := pc.CreateOffer(nil)
-			if err != nil {
-				slog.Error("Failed to create offer for requested stream", "room", roomName, "err", err)
-				continue
-			}
-			if err = pc.SetLocalDescription(offer); err != nil {
-				slog.Error("Failed to set local description for requested stream", "room", roomName, "err", err)
-				continue
-			}
-			if err = safeBRW.SendJSON(connections.NewMessageSDP("offer", offer)); err != nil {
-				slog.Error("Failed to send offer for requested stream", "room", roomName, "err", err)
-				continue
-			}
-
-			// Store the connection
-			sp.servedConns.Set(stream.Conn().RemotePeer(), &StreamConnection{
-				pc:  pc,
-				ndc: ndc,
-			})
-
-			slog.Debug("Sent offer for requested stream")
 		case "ice-candidate":
 			var iceMsg connections.MessageICE
 			if err := json.Unmarshal(data, &iceMsg); err != nil {
 				slog.Error("Failed to unmarshal ICE message", "err", err)
 				continue
 			}
-			if conn, ok := sp.servedConns.Get(stream.Conn().RemotePeer()); ok && conn.pc.RemoteDescription() != nil {
+			if conn, ok := sp.servedConns.Get(requested); ok && conn.pc.RemoteDescription() != nil {
 				if err := conn.pc.AddICECandidate(iceMsg.Candidate); err != nil {
 					slog.Error("Failed to add ICE candidate", "err", err)
 				}
@@ -237,12 +233,20 @@ func (sp *StreamProtocol) handleStreamRequest(stream network.Stream) {
 				slog.Error("Failed to unmarshal answer from signaling message", "err", err)
 				continue
 			}
-			if conn, ok := sp.servedConns.Get(stream.Conn().RemotePeer()); ok {
+			if conn, ok := sp.servedConns.Get(requested); ok {
 				if err := conn.pc.SetRemoteDescription(answerMsg.SDP); err != nil {
 					slog.Error("Failed to set remote description for answer", "err", err)
 					continue
 				}
 				slog.Debug("Set remote description for answer")
+				// Relays that can't forward the room codecs get nothing out of the stream
+				if err := common.CheckRemoteCodecs(conn.pc); err != nil {
+					slog.Error("Rejecting stream request", "room", conn.room, "peer", stream.Conn().RemotePeer(), "err", err)
+					sendStreamError(safeBRW, "request-stream-error", conn.room, err)
+					if err = conn.pc.Close(); err != nil {
+						slog.Error("Failed to close rejected requested stream", "room", conn.room, "err", err)
+					}
+				}
 			} else {
 				slog.Warn("Received answer without active PeerConnection")
 			}
@@ -271,26 +275,54 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 		return fmt.Errorf("failed to send room request: %w", err)
 	}
 
-	pc, err := common.CreatePeerConnection(func() {
+	var pc *webrtc.PeerConnection
+	pc, err = sp.relay.WebRTC.CreatePeerConnection(func() {
 		slog.Info("Relay PeerConnection closed for requested stream", "room", room.Name)
 		_ = stream.Close() // ignore error as may be closed already
-		// Cleanup the stream connection
-		if ok := sp.requestedConns.Has(room.Name); ok {
+		// Cleanup the stream connection, unless already replaced by a newer one
+		if conn, ok := sp.requestedConns.Get(room.Name); ok && conn.pc == pc {
 			sp.requestedConns.Delete(room.Name)
 		}
+		if room.GetPeerConnection() == pc {
+			if sp.relay.MeshRoutes.Has(room.Name) {
+				sp.relay.MeshRoutes.Delete(room.Name)
+			}
+			// Upstream is gone while the stream may still be in use, get it from elsewhere
+			go sp.relay.reestablishStream(room)
+		}
 	})
 	if err != nil {
 		_ = stream.Close()
 		return fmt.Errorf("failed to create PeerConnection: %w", err)
 	}
+	room.SetPeerConnection(pc)
 
 	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-		localTrack, _ := webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), "relay-"+room.Name+"-"+track.Kind().String())
 		slog.Debug("Received track for requested stream", "room", room.Name, "track_kind", track.Kind().String())
 
-		room.SetTrack(track.Kind(), localTrack)
+		// Keep feeding the existing local track after an upstream change, so receivers don't need to renegotiate
+		localTrack := room.GetTrack(track.Kind())
+		if localTrack == nil || !strings.EqualFold(localTrack.Codec().MimeType, track.Codec().MimeType) {
+			localTrack, _ = webrtc.NewTrackLocalStaticRTP(track.Codec().RTPCodecCapability, track.ID(), "relay-"+room.Name+"-"+track.Kind().String())
+			room.SetTrack(track.Kind(), localTrack)
+		} else {
+			slog.Debug("Reusing local track for new upstream", "room", room.Name, "track_kind", track.Kind().String())
+			sp.rewriterFor(localTrack).SwitchSource()
+		}
+		rewriter := sp.rewriterFor(localTrack)
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			sp.setKeyframeSource(room.Name, "", pc, track.SSRC())
+			// Packets lost on the link are recovered from FEC and read from the track like received ones
+			if err := sp.relay.WebRTC.ReceiveFEC(pc, track); err != nil {
+				slog.Error("Failed to receive FEC for requested stream", "room", room.Name, "err", err)
+			}
+		}
 
+		go sp.readUpstreamRTCP(room.Name, track, receiver)
 		go func() {
+			if track.Kind() == webrtc.RTPCodecTypeVideo {
+				defer sp.removeKeyframeSource(room.Name, "", pc)
+			}
 			for {
 				rtpPacket, _, err := track.ReadRTP()
 				if err != nil {
@@ -299,8 +331,14 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 					}
 					break
 				}
+				if capture := sp.relay.RecordingProtocol.capture(room.Name); capture != nil {
+					capture.WriteRTP(track, rtpPacket)
+				}
+
+				// Continue sequence numbers and timestamps of previous upstreams
+				rewriter.Rewrite(rtpPacket)
 
-				err = localTrack.WriteRTP(rtpPacket)
+				err = sp.WriteRTP(localTrack, rtpPacket)
 				if err != nil && !errors.Is(err, io.ErrClosedPipe) {
 					slog.Error("Failed to write RTP to local track for requested stream room", "room", room.Name, "err", err)
 					break
@@ -320,12 +358,11 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 
 		// Set the DataChannel in the requestedConns map
 		if conn, ok := sp.requestedConns.Get(room.Name); ok {
-			conn.ndc = ndc
+			conn.ndc.Store(ndc)
 		} else {
-			sp.requestedConns.Set(room.Name, &StreamConnection{
-				pc:  pc,
-				ndc: ndc,
-			})
+			conn = &StreamConnection{pc: pc}
+			conn.ndc.Store(ndc)
+			sp.requestedConns.Set(room.Name, conn)
 		}
 
 		// We do not handle any messages from upstream here
@@ -347,6 +384,20 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 
 	// Handle incoming messages (offer and candidates)
 	go func() {
+		defer func() {
+			if pc.RemoteDescription() != nil {
+				return
+			}
+			// Request ended without an offer, it may be sent again
+			slog.Debug("Stream request ended before an offer", "room", room.Name)
+			sp.pendingConns.Delete(room.Name)
+			if room.GetPeerConnection() == pc {
+				room.SetPeerConnection(nil)
+			}
+			if err := pc.Close(); err != nil {
+				slog.Error("Failed to close PeerConnection of ended stream request", "room", room.Name, "err", err)
+			}
+		}()
 		iceHolder := make([]webrtc.ICECandidateInit, 0)
 
 		for {
@@ -392,13 +443,32 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 					// Hold the candidate until remote description is set
 					iceHolder = append(iceHolder, iceMsg.Candidate)
 				}
+			case "request-stream-error":
+				var rawMsg connections.MessageRaw
+				if err = json.Unmarshal(data, &rawMsg); err != nil {
+					slog.Error("Failed to unmarshal error for requested stream", "room", room.Name, "err", err)
+					continue
+				}
+				var streamErr streamError
+				if err = json.Unmarshal(rawMsg.Data, &streamErr); err != nil {
+					slog.Error("Failed to unmarshal error from raw message", "room", room.Name, "err", err)
+					continue
+				}
+				slog.Error("Upstream refused requested stream", "room", room.Name, "err", streamErr.Error)
+				_ = stream.Close()
+				return
 			case "offer":
 				var offerMsg connections.MessageSDP
 				if err = json.Unmarshal(data, &offerMsg); err != nil {
 					slog.Error("Failed to unmarshal offer for requested stream", "room", room.Name, "err", err)
 					continue
 				}
-				if err = pc.SetRemoteDescription(offerMsg.SDP); err != nil {
+				offer, err := common.WithoutFECSources(offerMsg.SDP)
+				if err != nil {
+					slog.Error("Failed to read offer for requested stream", "room", room.Name, "err", err)
+					continue
+				}
+				if err = pc.SetRemoteDescription(offer); err != nil {
 					slog.Error("Failed to set remote description for requested stream", "room", room.Name, "err", err)
 					continue
 				}
@@ -425,13 +495,18 @@ func (sp *StreamProtocol) requestStream(stream network.Stream, room *shared.Room
 					continue
 				}
 
-				// Store the connection
-				sp.requestedConns.Set(room.Name, &StreamConnection{
-					pc:  pc,
-					ndc: nil,
-				})
+				// Store the connection, the request isn't pending anymore
+				if conn, ok := sp.requestedConns.Get(room.Name); !ok || conn.pc != pc {
+					sp.requestedConns.Set(room.Name, &StreamConnection{
+						pc: pc,
+					})
+				}
+				sp.pendingConns.Delete(room.Name)
 
 				slog.Debug("Sent answer for requested stream", "room", room.Name)
+			case "request-stream-offline":
+				// Serving relay sends the offer once the room comes online, keep waiting
+				slog.Debug("Requested room stream is offline, waiting for it to come online", "room", room.Name)
 			default:
 				slog.Warn("Unknown signaling message type", "room", room.Name, "type", baseMsg.Type)
 			}
@@ -484,20 +559,34 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 
 			slog.Info("Received stream push request for room", "room", roomName)
 
-			room = sp.relay.GetRoomByName(roomName)
-			if room != nil {
-				if room.OwnerID != sp.relay.ID {
-					slog.Error("Cannot push a stream to non-owned room", "room", room.Name, "owner_id", room.OwnerID)
-					continue
+			// Room names are unique in mesh, make sure we own the room before accepting the push
+			claimedRoom, err := sp.relay.ClaimRoom(context.Background(), roomName)
+			if err != nil {
+				slog.Error("Failed to claim room for stream push", "room", roomName, "err", err)
+				var deniedErr *RoomClaimDeniedError
+				if errors.As(err, &deniedErr) {
+					sp.redirectPush(safeBRW, roomName, deniedErr.OwnerID)
+				} else {
+					sendStreamError(safeBRW, "push-stream-error", roomName, err)
 				}
-				if room.IsOnline() {
-					slog.Error("Cannot push a stream to already online room", "room", room.Name)
+				continue
+			}
+			// Runner reconnecting to its room replaces the previous push, room tracks are kept for the new one.
+			// Other nodes may only take over a push that has dropped
+			if conn, ok := sp.incomingConns.Get(claimedRoom.Name); ok {
+				if conn.peer != stream.Conn().RemotePeer() && !conn.pushDropped() {
+					slog.Warn("Refusing stream push to room pushed by another node", "room", claimedRoom.Name,
+						"peer", stream.Conn().RemotePeer(), "pushing_peer", conn.peer)
+					sendStreamError(safeBRW, "push-stream-error", claimedRoom.Name, errors.New("room is pushed by another node"))
 					continue
 				}
-			} else {
-				// Create a new room if it doesn't exist
-				room = sp.relay.CreateRoom(roomName)
+				slog.Info("Replacing previous stream push of room", "room", claimedRoom.Name)
+				sp.incomingConns.Delete(claimedRoom.Name)
+				if err = conn.pc.Close(); err != nil {
+					slog.Error("Failed to close previous pushed stream", "room", claimedRoom.Name, "err", err)
+				}
 			}
+			room = claimedRoom
 
 			// Respond with an OK with the room name
 			roomData, err := json.Marshal(room.Name)
@@ -539,6 +628,12 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 				slog.Error("Received offer without room set for stream push")
 				continue
 			}
+			// Room may have been yielded to a relay with a newer claim since accepting the push
+			if ownerID := room.GetOwnerID(); ownerID != sp.relay.ID {
+				slog.Warn("Room of stream push is owned by another relay now", "room", room.Name, "owner_id", ownerID)
+				sp.redirectPush(safeBRW, room.Name, ownerID)
+				continue
+			}
 
 			var offerMsg connections.MessageSDP
 			if err = json.Unmarshal(data, &offerMsg); err != nil {
@@ -547,10 +642,11 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 			}
 
 			// Create PeerConnection for the incoming stream
-			pc, err := common.CreatePeerConnection(func() {
+			var pc *webrtc.PeerConnection
+			pc, err = sp.relay.WebRTC.CreatePeerConnection(func() {
 				slog.Info("PeerConnection closed for pushed stream", "room", room.Name)
-				// Cleanup the stream connection
-				if ok := sp.incomingConns.Has(room.Name); ok {
+				// Cleanup the stream connection, unless already replaced by a reconnected push
+				if conn, ok := sp.incomingConns.Get(room.Name); ok && conn.pc == pc {
 					sp.incomingConns.Delete(room.Name)
 				}
 			})
@@ -561,22 +657,26 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 
 			pc.OnDataChannel(func(dc *webrtc.DataChannel) {
 				// TODO: Is this the best way to handle DataChannel? Should we just use the map directly?
-				room.DataChannel = connections.NewNestriDataChannel(dc)
-				room.DataChannel.RegisterOnOpen(func() {
+				ndc := connections.NewNestriDataChannel(dc)
+				ndc.RegisterOnOpen(func() {
 					slog.Debug("DataChannel opened for pushed stream", "room", room.Name)
 				})
-				room.DataChannel.RegisterOnClose(func() {
+				ndc.RegisterOnClose(func() {
 					slog.Debug("DataChannel closed for pushed stream", "room", room.Name)
 				})
+				room.SetDataChannel(ndc)
 
 				// Set the DataChannel in the incomingConns map
 				if conn, ok := sp.incomingConns.Get(room.Name); ok {
-					conn.ndc = room.DataChannel
+					conn.ndc.Store(ndc)
 				} else {
-					sp.incomingConns.Set(room.Name, &StreamConnection{
-						pc:  pc,
-						ndc: room.DataChannel,
-					})
+					conn = &StreamConnection{
+						pc:     pc,
+						peer:   stream.Conn().RemotePeer(),
+						signal: safeBRW,
+					}
+					conn.ndc.Store(ndc)
+					sp.incomingConns.Set(room.Name, conn)
 				}
 			})
 
@@ -595,16 +695,21 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 			})
 
 			pc.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-				localTrack, err := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, remoteTrack.Kind().String(), fmt.Sprintf("nestri-%s-%s", room.Name, remoteTrack.Kind().String()))
+				slog.Debug("Received track for pushed stream", "room", room.Name, "track_kind", remoteTrack.Kind().String())
+
+				// Keep the room's local track across pushes, so participants and relays receiving it are not interrupted
+				pushed, feed, err := sp.attachPushedTrack(room, remoteTrack)
 				if err != nil {
 					slog.Error("Failed to create local track for pushed stream", "room", room.Name, "track_kind", remoteTrack.Kind().String(), "err", err)
 					return
 				}
-
-				slog.Debug("Received track for pushed stream", "room", room.Name, "track_kind", remoteTrack.Kind().String())
-
-				// Set track for Room
-				room.SetTrack(remoteTrack.Kind(), localTrack)
+				localTrack := pushed.local
+				rewriter := sp.rewriterFor(localTrack)
+				if remoteTrack.Kind() == webrtc.RTPCodecTypeVideo {
+					sp.setKeyframeSource(room.Name, pushed.rid, pc, remoteTrack.SSRC())
+					defer sp.removeKeyframeSource(room.Name, pushed.rid, pc)
+				}
+				go sp.readUpstreamRTCP(room.Name, remoteTrack, receiver)
 
 				// Prepare PlayoutDelayExtension so we don't need to recreate it for each packet
 				playoutExt := &rtp.PlayoutDelayExtension{
@@ -625,26 +730,40 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 						}
 						break
 					}
+					if capture := sp.relay.RecordingProtocol.capture(room.Name); capture != nil {
+						capture.WriteRTP(remoteTrack, rtpPacket)
+					}
 
 					// Use PlayoutDelayExtension for low latency, if set for this track kind
-					if extID, ok := common.GetExtension(remoteTrack.Kind(), common.ExtensionPlayoutDelay); ok {
+					if extID, ok := sp.relay.WebRTC.GetExtension(remoteTrack.Kind(), common.ExtensionPlayoutDelay); ok {
 						if err := rtpPacket.SetExtension(extID, playoutPayload); err != nil {
 							slog.Error("Failed to set PlayoutDelayExtension for room", "room", room.Name, "err", err)
 							continue
 						}
 					}
 
-					err = localTrack.WriteRTP(rtpPacket)
+					// Continue sequence numbers and timestamps of previous pushes
+					rewriter.Rewrite(rtpPacket)
+
+					err = sp.WriteRTP(localTrack, rtpPacket)
 					if err != nil && !errors.Is(err, io.ErrClosedPipe) {
 						slog.Error("Failed to write RTP to local track for room", "room", room.Name, "err", err)
 						break
 					}
+
+					// Simulcast layers also feed receivers with the layer selected for them
+					if len(pushed.rid) > 0 {
+						if layer := room.GetVideoLayer(pushed.rid); layer != nil {
+							layer.CountPacket(rtpPacket)
+							room.ForwardVideoLayer(pushed.rid, rtpPacket)
+						}
+					}
 				}
 
 				slog.Debug("Track closed for room", "room", room.Name, "track_kind", remoteTrack.Kind().String())
 
-				// Cleanup the track from the room
-				room.SetTrack(remoteTrack.Kind(), nil)
+				// Cleanup the track from the room, unless the runner reconnects in time
+				go sp.releasePushedTrack(room, remoteTrack.Kind(), pushed.rid, feed)
 			})
 
 			// Set the remote description
@@ -654,6 +773,16 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 			}
 			slog.Debug("Set remote description for pushed stream", "room", room.Name)
 
+			// Answer with the allowed codecs of the offered ones, most preferred first
+			if err = common.ApplyVideoCodecPolicy(pc, sp.relay.Config.VideoCodecs); err != nil {
+				slog.Error("Rejecting pushed stream", "room", room.Name, "err", err)
+				sendStreamError(safeBRW, "push-stream-error", room.Name, err)
+				if err = pc.Close(); err != nil {
+					slog.Error("Failed to close rejected pushed stream", "room", room.Name, "err", err)
+				}
+				continue
+			}
+
 			// Create an answer
 			answer, err := pc.CreateAnswer(nil)
 			if err != nil {
@@ -672,23 +801,498 @@ func (sp *StreamProtocol) handleStreamPush(stream network.Stream) {
 			}
 
 			// Store the connection
-			sp.incomingConns.Set(room.Name, &StreamConnection{
-				pc:  pc,
-				ndc: room.DataChannel, // if it exists, if not it will be set later
-			})
+			conn := &StreamConnection{
+				pc:     pc,
+				peer:   stream.Conn().RemotePeer(),
+				signal: safeBRW,
+			}
+			conn.ndc.Store(room.GetDataChannel()) // if it exists, if not it will be set later
+			sp.incomingConns.Set(room.Name, conn)
 			slog.Debug("Sent answer for pushed stream", "room", room.Name)
 		}
 	}
 }
 
+// --- Helpers ---
+
+// serveRoom sends an offer with the room tracks to a relay requesting the room stream
+func (sp *StreamProtocol) serveRoom(stream network.Stream, safeBRW *common.SafeBufioRW, room *shared.Room) error {
+	receiverID := "relay-" + stream.Conn().RemotePeer().String()
+	key := servedKey{peer: stream.Conn().RemotePeer(), room: room.Name}
+	var conn *StreamConnection
+	pc, err := sp.relay.WebRTC.CreatePeerConnection(func() {
+		slog.Info("PeerConnection closed for requested stream", "room", room.Name)
+		// Cleanup the stream connection, unless already replaced by a newer request
+		if served, ok := sp.servedConns.Get(key); ok && served == conn {
+			sp.servedConns.Delete(key)
+		}
+		room.RemoveLayerForwarder(receiverID)
+		// Rooms we only forward are not needed once nobody receives them
+		if room.GetOwnerID() != sp.relay.ID {
+			sp.relay.DeleteRoomIfEmpty(room)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create PeerConnection: %w", err)
+	}
+
+	conn = &StreamConnection{
+		pc:   pc,
+		room: room.Name,
+	}
+
+	// Add tracks
+	audioTrack, videoTrack := room.GetTrack(webrtc.RTPCodecTypeAudio), room.GetTrack(webrtc.RTPCodecTypeVideo)
+	if audioTrack != nil {
+		sender, err := pc.AddTrack(audioTrack)
+		if err != nil {
+			return fmt.Errorf("failed to add audio track: %w", err)
+		}
+		go readSenderRTCP(sp.relay.WebRTC, sender, room, conn, false)
+	}
+	if videoTrack != nil {
+		// Relays get their own video layer of simulcast rooms, picked by their bandwidth
+		conn.forwarder = room.LayerForwarder(receiverID)
+		if conn.forwarder != nil {
+			videoTrack = conn.forwarder.Track
+		}
+		sender, err := pc.AddTrack(videoTrack)
+		if err != nil {
+			return fmt.Errorf("failed to add video track: %w", err)
+		}
+		go readSenderRTCP(sp.relay.WebRTC, sender, room, conn, true)
+	}
+
+	// DataChannel setup
+	settingOrdered := true
+	settingMaxRetransmits := uint16(2)
+	dc, err := pc.CreateDataChannel("relay-data", &webrtc.DataChannelInit{
+		Ordered:        &settingOrdered,
+		MaxRetransmits: &settingMaxRetransmits,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create DataChannel: %w", err)
+	}
+	ndc := connections.NewNestriDataChannel(dc)
+	conn.ndc.Store(ndc)
+
+	ndc.RegisterOnOpen(func() {
+		slog.Debug("Relay DataChannel opened for requested stream", "room", room.Name)
+	})
+	ndc.RegisterOnClose(func() {
+		slog.Debug("Relay DataChannel closed for requested stream", "room", room.Name)
+	})
+	ndc.RegisterMessageCallback("input", func(data []byte) {
+		if err := sp.sendUpstream(room, data); err != nil {
+			slog.Error("Failed to forward input message from mesh to upstream room", "room", room.Name, "err", err)
+		}
+	})
+	ndc.RegisterMessageCallback("bitrate", func(data []byte) {
+		var msg gen.ProtoMessageBitrate
+		if err := proto.Unmarshal(data, &msg); err != nil {
+			slog.Error("Failed to decode bitrate message from mesh", "room", room.Name, "err", err)
+			return
+		}
+		conn.reportedBitrate.Store(msg.GetTargetBitrate())
+	})
+
+	// ICE Candidate handling
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+
+		if err := safeBRW.SendJSON(connections.NewMessageICE("ice-candidate", candidate.ToJSON())); err != nil {
+			slog.Error("Failed to send ICE candidate message for requested stream", "room", room.Name, "err", err)
+		}
+	})
+
+	// Store the connection before the offer, so the answer finds it
+	sp.servedConns.Set(key, conn)
+
+	// Create offer
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err = pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	if err = safeBRW.SendJSON(connections.NewMessageSDP("offer", offer)); err != nil {
+		return fmt.Errorf("failed to send offer: %w", err)
+	}
+
+	slog.Debug("Sent offer for requested stream", "room", room.Name, "peer", stream.Conn().RemotePeer())
+	return nil
+}
+
+// readSenderRTCP reads RTCP from receiver of a served track. Keyframe requests are passed upstream, video feedback
+// drives layer selection of layered rooms while the receiver sends no TWCC feedback, send-side estimates are used otherwise
+func readSenderRTCP(webRTC *common.WebRTCAPI, sender *webrtc.RTPSender, room *shared.Room, conn *StreamConnection, video bool) {
+	received := false
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if shared.HasTransportCC(packets) {
+			conn.transportCC.Store(true)
+		}
+		for _, packet := range packets {
+			if report, ok := packet.(*rtcp.ReceiverReport); ok {
+				for _, block := range report.Reports {
+					conn.onLinkLoss(webRTC, block.FractionLost)
+				}
+			}
+		}
+		// Relay joining mid-stream can't pass on decodable video until a keyframe, ask for one once it reports receiving
+		if video && (!received || shared.HasKeyframeRequest(packets)) {
+			received = true
+			rid := ""
+			if conn.forwarder != nil {
+				rid = conn.forwarder.Selected()
+			}
+			room.RequestKeyframe(rid)
+		}
+		if video && conn.forwarder != nil && !conn.transportCC.Load() {
+			conn.forwarder.HandleRTCP(packets)
+		}
+	}
+}
+
+// pushDropped checks if the node of a pushed stream lost its connection, it may be reconnecting from elsewhere
+func (conn *StreamConnection) pushDropped() bool {
+	switch conn.pc.ConnectionState() {
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+		return true
+	default:
+		return false
+	}
+}
+
+// updateBandwidth feeds the bandwidth estimate of a served relay to its video layer forwarder.
+// Returns the lower of the send-side estimate towards the relay and the target bitrate it reported, 0 if neither is known
+func (conn *StreamConnection) updateBandwidth(webRTC *common.WebRTCAPI) uint64 {
+	var estimate uint64
+	if conn.transportCC.Load() {
+		estimate = webRTC.TargetBitrate(conn.pc)
+	}
+	if reported := conn.reportedBitrate.Load(); reported > 0 && (estimate == 0 || reported < estimate) {
+		estimate = reported
+	}
+	if conn.forwarder != nil && estimate > 0 {
+		conn.forwarder.SetEstimate(estimate)
+	}
+	return estimate
+}
+
+// subscribe keeps a relay request for a room that is offline, it's served once the room comes online
+func (sp *StreamProtocol) subscribe(roomName string, stream network.Stream, safeBRW *common.SafeBufioRW) {
+	sp.waitersMutex.Lock()
+	defer sp.waitersMutex.Unlock()
+	for _, sub := range sp.subscriptions[roomName] {
+		if sub.stream == stream {
+			return
+		}
+	}
+	sp.subscriptions[roomName] = append(sp.subscriptions[roomName], &streamSubscription{
+		stream:  stream,
+		safeBRW: safeBRW,
+	})
+}
+
+// unsubscribe drops all subscriptions made over a closed stream request
+func (sp *StreamProtocol) unsubscribe(stream network.Stream) {
+	var emptied []string
+	sp.waitersMutex.Lock()
+	for roomName, subs := range sp.subscriptions {
+		subs = slices.DeleteFunc(subs, func(sub *streamSubscription) bool {
+			return sub.stream == stream
+		})
+		if len(subs) == 0 {
+			delete(sp.subscriptions, roomName)
+			emptied = append(emptied, roomName)
+		} else {
+			sp.subscriptions[roomName] = subs
+		}
+	}
+	sp.waitersMutex.Unlock()
+
+	// Rooms we were only getting for the subscribers are not needed anymore
+	for _, roomName := range emptied {
+		if room := sp.relay.GetRoomByName(roomName); room != nil && room.GetOwnerID() != sp.relay.ID {
+			sp.relay.DeleteRoomIfEmpty(room)
+		}
+	}
+}
+
+// hasSubscriptions checks if any relay waits for a room to come online
+func (sp *StreamProtocol) hasSubscriptions(roomName string) bool {
+	sp.waitersMutex.Lock()
+	defer sp.waitersMutex.Unlock()
+	return len(sp.subscriptions[roomName]) > 0
+}
+
+// transitRoom gets the stream of a room online elsewhere in the mesh from upstream, so it can be served
+// to the requesting relay from our own tracks. A single upstream stream is shared by all local receivers.
+// Returns nil if the room isn't online anywhere we know of, or upstream failed to provide it in time
+func (sp *StreamProtocol) transitRoom(roomName string, requesterID peer.ID) *shared.Room {
+	room := sp.relay.GetRoomByName(roomName)
+	if room != nil && room.GetOwnerID() == sp.relay.ID {
+		// Our own room, nobody is pushing to it yet
+		return nil
+	}
+	if room == nil {
+		remoteRoom := sp.relay.GetRemoteRoomByName(roomName)
+		if remoteRoom == nil || !remoteRoom.Online {
+			return nil
+		}
+		room = sp.relay.CreateRemoteRoom(*remoteRoom)
+	}
+	if room.GetOwnerID() == requesterID {
+		// Requester owns the room, it can't be provided through us
+		return nil
+	}
+
+	if !sp.isRequested(room.Name) {
+		slog.Debug("Requesting room stream from upstream to forward it", "room", room.Name, "owner_id", room.GetOwnerID(), "requester", requesterID)
+		if err := sp.relay.requestRoomStream(context.Background(), room, requesterID); err != nil {
+			slog.Error("Failed to request room stream to forward", "room", room.Name, "owner_id", room.GetOwnerID(), "err", err)
+			sp.relay.DeleteRoomIfEmpty(room)
+			return nil
+		}
+	}
+
+	if !sp.waitRoomOnline(room, transitStreamTimeout) {
+		// Keep the room, requester gets subscribed and served if upstream provides the stream later
+		slog.Warn("Upstream did not provide room stream in time", "room", room.Name, "owner_id", room.GetOwnerID())
+		return nil
+	}
+	return room
+}
+
+// sendUpstream sends a DataChannel message upstream, to the pushing node of a room or to the relay we get the room stream from
+func (sp *StreamProtocol) sendUpstream(room *shared.Room, data []byte) error {
+	if ndc := room.GetDataChannel(); ndc != nil {
+		return ndc.SendBinary(data)
+	}
+	if conn, ok := sp.requestedConns.Get(room.Name); ok {
+		if ndc := conn.ndc.Load(); ndc != nil {
+			return ndc.SendBinary(data)
+		}
+	}
+	return nil
+}
+
+// waitRoomOnline blocks until the room is online or timeout passes, returns whether it came online
+func (sp *StreamProtocol) waitRoomOnline(room *shared.Room, timeout time.Duration) bool {
+	waiter := make(chan struct{})
+	sp.waitersMutex.Lock()
+	sp.onlineWaiters[room.Name] = append(sp.onlineWaiters[room.Name], waiter)
+	sp.waitersMutex.Unlock()
+
+	defer func() {
+		sp.waitersMutex.Lock()
+		defer sp.waitersMutex.Unlock()
+		waiters := sp.onlineWaiters[room.Name]
+		for i, w := range waiters {
+			if w == waiter {
+				sp.onlineWaiters[room.Name] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(sp.onlineWaiters[room.Name]) == 0 {
+			delete(sp.onlineWaiters, room.Name)
+		}
+	}()
+
+	// Room may have come online before we started waiting
+	if room.IsOnline() {
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-waiter:
+		return true
+	case <-timer.C:
+		return room.IsOnline()
+	}
+}
+
+// waitUpstreamConnected waits for the requested stream of a room to connect, returns whether it did
+func (sp *StreamProtocol) waitUpstreamConnected(room *shared.Room, timeout time.Duration) bool {
+	pc := room.GetPeerConnection()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if pc == nil || room.GetPeerConnection() != pc {
+			return false
+		}
+		switch pc.ConnectionState() {
+		case webrtc.PeerConnectionStateConnected:
+			return true
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			return false
+		default:
+			time.Sleep(250 * time.Millisecond)
+		}
+	}
+	return false
+}
+
+// notifyRoomOnline wakes up requests waiting for the room to come online and serves subscribed relays
+func (sp *StreamProtocol) notifyRoomOnline(room *shared.Room) {
+	sp.waitersMutex.Lock()
+	for _, waiter := range sp.onlineWaiters[room.Name] {
+		close(waiter)
+	}
+	delete(sp.onlineWaiters, room.Name)
+	subs := sp.subscriptions[room.Name]
+	delete(sp.subscriptions, room.Name)
+	sp.waitersMutex.Unlock()
+
+	for _, sub := range subs {
+		slog.Info("Room came online, serving subscribed relay", "room", room.Name, "peer", sub.stream.Conn().RemotePeer())
+		if err := sp.serveRoom(sub.stream, sub.safeBRW, room); err != nil {
+			slog.Error("Failed to serve room stream to subscribed relay", "room", room.Name, "peer", sub.stream.Conn().RemotePeer(), "err", err)
+		}
+	}
+}
+
+// closeServed closes the connections serving a room stream to other relays
+func (sp *StreamProtocol) closeServed(roomName string) {
+	for key, conn := range sp.servedConns.Copy() {
+		if key.room != roomName {
+			continue
+		}
+		if err := conn.pc.Close(); err != nil {
+			slog.Error("Failed to close served room stream", "room", roomName, "peer", key.peer, "err", err)
+		}
+	}
+}
+
+// closePush redirects the node pushing a room stream to the room's new owner and closes the push
+func (sp *StreamProtocol) closePush(roomName string, ownerID peer.ID) {
+	conn, ok := sp.incomingConns.Get(roomName)
+	if !ok {
+		return
+	}
+	sp.incomingConns.Delete(roomName)
+	if conn.signal != nil {
+		sp.redirectPush(conn.signal, roomName, ownerID)
+	}
+	if err := conn.pc.Close(); err != nil {
+		slog.Error("Failed to close pushed stream of yielded room", "room", roomName, "err", err)
+	}
+}
+
+// closeConnections starts closing all served, pushed and requested room streams, when the relay stops
+func (sp *StreamProtocol) closeConnections(closing *sync.WaitGroup) {
+	for key, conn := range sp.servedConns.Copy() {
+		closeConcurrently(closing, func() {
+			if err := conn.pc.Close(); err != nil {
+				slog.Error("Failed to close served room stream", "room", key.room, "peer", key.peer, "err", err)
+			}
+		})
+	}
+	for roomName, conn := range sp.incomingConns.Copy() {
+		closeConcurrently(closing, func() {
+			if err := conn.pc.Close(); err != nil {
+				slog.Error("Failed to close pushed room stream", "room", roomName, "err", err)
+			}
+		})
+	}
+	for roomName, conn := range sp.requestedConns.Copy() {
+		closeConcurrently(closing, func() {
+			if err := conn.pc.Close(); err != nil {
+				slog.Error("Failed to close requested room stream", "room", roomName, "err", err)
+			}
+		})
+	}
+}
+
+// isPushing checks if a peer is pushing a room stream to us
+func (sp *StreamProtocol) isPushing(roomName string, peerID peer.ID) bool {
+	conn, ok := sp.incomingConns.Get(roomName)
+	return ok && conn.peer == peerID
+}
+
+// isRequested checks if a room stream was requested from another relay, connected or still waiting for its offer
+func (sp *StreamProtocol) isRequested(roomName string) bool {
+	return sp.requestedConns.Has(roomName) || sp.pendingConns.Has(roomName)
+}
+
+// isServing checks if a room stream is served to any other relay
+func (sp *StreamProtocol) isServing(roomName string) bool {
+	for key := range sp.servedConns.Copy() {
+		if key.room == roomName {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectPush tells the pushing node which relay owns the room it tried to push to
+func (sp *StreamProtocol) redirectPush(safeBRW *common.SafeBufioRW, roomName string, ownerID peer.ID) {
+	redirect := pushRedirect{
+		Room:    roomName,
+		RelayID: ownerID.String(),
+	}
+	if info, ok := sp.relay.LocalMeshPeers.Get(ownerID); ok && len(info.MeshAddrs) > 0 {
+		redirect.Addrs = info.MeshAddrs
+	} else {
+		for _, addr := range sp.relay.Host.Peerstore().Addrs(ownerID) {
+			redirect.Addrs = append(redirect.Addrs, addr.String())
+		}
+	}
+
+	redirectData, err := json.Marshal(redirect)
+	if err != nil {
+		slog.Error("Failed to marshal push redirect", "room", roomName, "err", err)
+		return
+	}
+	if err = safeBRW.SendJSON(connections.NewMessageRaw(
+		"push-stream-redirect",
+		redirectData,
+	)); err != nil {
+		slog.Error("Failed to send push redirect", "room", roomName, "err", err)
+	}
+}
+
+// sendStreamError tells the other side of a signaling stream why its stream was refused
+func sendStreamError(safeBRW *common.SafeBufioRW, msgType string, roomName string, streamErr error) {
+	errorData, err := json.Marshal(streamError{Room: roomName, Error: streamErr.Error()})
+	if err != nil {
+		slog.Error("Failed to marshal stream error", "room", roomName, "err", err)
+		return
+	}
+	if err = safeBRW.SendJSON(connections.NewMessageRaw(msgType, errorData)); err != nil {
+		slog.Error("Failed to send stream error", "room", roomName, "type", msgType, "err", err)
+	}
+}
+
 // --- Public Usable Methods ---
 
-// RequestStream sends a request to get room stream from another relay
+// RequestStream sends a request to get room stream from another relay, unless one is pending already
 func (sp *StreamProtocol) RequestStream(ctx context.Context, room *shared.Room, peerID peer.ID) error {
+	if _, pending := sp.pendingConns.LoadOrStore(room.Name, true); pending {
+		slog.Debug("Room stream already requested, waiting for its offer", "room", room.Name)
+		return nil
+	}
+	if err := sp.relay.AdmissionProtocol.EnsureAdmitted(ctx, peerID); err != nil {
+		sp.pendingConns.Delete(room.Name)
+		return fmt.Errorf("failed to join mesh through relay: %w", err)
+	}
 	stream, err := sp.relay.Host.NewStream(ctx, peerID, protocolStreamRequest)
 	if err != nil {
+		sp.pendingConns.Delete(room.Name)
 		return fmt.Errorf("failed to create stream request: %w", err)
 	}
 
-	return sp.requestStream(stream, room)
+	if err = sp.requestStream(stream, room); err != nil {
+		sp.pendingConns.Delete(room.Name)
+		return err
+	}
+	return nil
 }
@@ -2,12 +2,24 @@ package core
 
 // ProtocolRegistry is a type holding all protocols to split away the bloat
 type ProtocolRegistry struct {
-	StreamProtocol *StreamProtocol
+	StreamProtocol      *StreamProtocol
+	ParticipantProtocol *ParticipantProtocol
+	StateProtocol       *StateProtocol
+	RoomProtocol        *RoomProtocol
+	HealthProtocol      *HealthProtocol
+	AdmissionProtocol   *AdmissionProtocol
+	RecordingProtocol   *RecordingProtocol
 }
 
 // NewProtocolRegistry initializes and returns a new protocol registry
 func NewProtocolRegistry(relay *Relay) ProtocolRegistry {
 	return ProtocolRegistry{
-		StreamProtocol: NewStreamProtocol(relay),
+		StreamProtocol:      NewStreamProtocol(relay),
+		ParticipantProtocol: NewParticipantProtocol(relay),
+		StateProtocol:       NewStateProtocol(relay),
+		RoomProtocol:        NewRoomProtocol(relay),
+		HealthProtocol:      NewHealthProtocol(relay),
+		AdmissionProtocol:   NewAdmissionProtocol(relay),
+		RecordingProtocol:   NewRecordingProtocol(relay),
 	}
 }
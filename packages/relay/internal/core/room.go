@@ -2,13 +2,17 @@ package core
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	gen "relay/internal/proto"
 	"relay/internal/shared"
 
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/oklog/ulid/v2"
+	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
 )
 
 // --- Room Management ---
@@ -34,25 +38,139 @@ func (r *Relay) GetRoomByName(name string) *shared.Room {
 // CreateRoom creates a new local Room struct with the given name
 func (r *Relay) CreateRoom(name string) *shared.Room {
 	roomID := ulid.Make()
-	room := shared.NewRoom(name, roomID, r.ID)
+	room := shared.NewRoom(name, roomID, r.ID, r.StreamProtocol)
+	room.RegisterOnOnlineChange(func(online bool) {
+		r.onRoomOnlineChange(room, online)
+	})
+	room.RegisterOnCodecChange(func() {
+		r.onRoomCodecChange(room)
+	})
+	room.RegisterOnKeyframeRequest(func(rid string) {
+		r.StreamProtocol.requestKeyframe(room, rid)
+	})
 	r.LocalRooms.Set(room.ID, room)
 	slog.Debug("Created new local room", "room", name, "id", room.ID)
 	return room
 }
 
+// CreateRemoteRoom creates a new local Room struct mirroring a room owned by another relay
+func (r *Relay) CreateRemoteRoom(info shared.RoomInfo) *shared.Room {
+	room := shared.NewRoom(info.Name, ulid.Make(), info.OwnerID, r.StreamProtocol)
+	room.RegisterOnOnlineChange(func(online bool) {
+		r.onRoomOnlineChange(room, online)
+	})
+	room.RegisterOnKeyframeRequest(func(rid string) {
+		r.StreamProtocol.requestKeyframe(room, rid)
+	})
+	r.LocalRooms.Set(room.ID, room)
+	slog.Debug("Created new local room for remote room", "room", info.Name, "id", room.ID, "owner_id", info.OwnerID)
+	return room
+}
+
 // DeleteRoomIfEmpty checks if a local room struct is inactive and can be removed
 func (r *Relay) DeleteRoomIfEmpty(room *shared.Room) {
 	if room == nil {
 		return
 	}
-	if room.Participants.Len() == 0 && r.LocalRooms.Has(room.ID) {
+	// Rooms we forward to other relays or record are in use, even without local participants
+	if room.Participants.Len() == 0 && !r.StreamProtocol.isServing(room.Name) && !r.RecordingProtocol.isRecording(room.Name) &&
+		r.LocalRooms.Has(room.ID) {
 		slog.Debug("Deleting empty room without participants", "room", room.Name)
 		r.LocalRooms.Delete(room.ID)
-		err := room.PeerConnection.Close()
-		if err != nil {
-			slog.Error("Failed to close Room PeerConnection", "room", room.Name, "err", err)
+		r.StreamProtocol.dropRewriters(room)
+		if pc := room.GetPeerConnection(); pc != nil {
+			if err := pc.Close(); err != nil {
+				slog.Error("Failed to close Room PeerConnection", "room", room.Name, "err", err)
+			}
+		}
+	}
+}
+
+// ClaimRoom takes ownership of a room for a local push, the current owner in mesh must hand it over first.
+// Returns RoomClaimDeniedError if the owner refuses, the runner should push to the owner instead
+func (r *Relay) ClaimRoom(ctx context.Context, name string) (*shared.Room, error) {
+	room := r.GetRoomByName(name)
+	if room != nil && room.GetOwnerID() == r.ID {
+		return room, nil
+	}
+
+	var ownerID peer.ID
+	if remoteRoom := r.GetRemoteRoomByName(name); remoteRoom != nil {
+		ownerID = remoteRoom.OwnerID
+	} else if room != nil && r.Host.Network().Connectedness(room.GetOwnerID()) == network.Connected {
+		ownerID = room.GetOwnerID()
+	}
+	if len(ownerID) > 0 {
+		slog.Debug("Room is owned by another relay, claiming it", "room", name, "owner_id", ownerID)
+		if err := r.RoomProtocol.ClaimRoom(ctx, name, ownerID); err != nil {
+			return nil, err
+		}
+		if remoteRoom, ok := r.MeshRooms.Get(name); ok && remoteRoom.OwnerID == ownerID {
+			r.MeshRooms.Delete(name)
+		}
+	}
+
+	if room == nil {
+		return r.CreateRoom(name), nil
+	}
+
+	// Adopt our mirror of the room, participants stay and receive the pushed stream instead
+	previousOwnerID := room.GetOwnerID()
+	room.SetOwnerID(r.ID)
+	slog.Info("Taking over ownership of mirrored room", "room", name, "previous_owner_id", previousOwnerID)
+	if conn, ok := r.StreamProtocol.requestedConns.Get(name); ok {
+		r.StreamProtocol.requestedConns.Delete(name)
+		if err := conn.pc.Close(); err != nil {
+			slog.Error("Failed to close requested stream of previous owner", "room", name, "err", err)
 		}
 	}
+	room.SetPeerConnection(nil)
+	r.StreamProtocol.dropRewriters(room)
+	room.SetTrack(webrtc.RTPCodecTypeAudio, nil)
+	room.SetTrack(webrtc.RTPCodecTypeVideo, nil)
+	return room, nil
+}
+
+// handOverRoom gives ownership of an owned room to another relay, mirroring it from there on.
+// Rooms that are still being pushed to can't be handed over
+func (r *Relay) handOverRoom(name string, newOwnerID peer.ID) error {
+	room := r.GetRoomByName(name)
+	if room == nil || room.GetOwnerID() != r.ID {
+		// Nothing to hand over
+		return nil
+	}
+	if room.IsOnline() || r.StreamProtocol.incomingConns.Has(name) {
+		return errors.New("room is online")
+	}
+
+	if !room.CompareAndSetOwnerID(r.ID, newOwnerID) {
+		// Someone else took it meanwhile
+		return nil
+	}
+	// Publish our state without the room, the new owner publishes its own once online
+	if err := r.publishRoomStates(context.Background()); err != nil {
+		slog.Error("Failed to publish room states after handover", "room", name, "err", err)
+	}
+	// Participants waiting here get the stream from the new owner, once it's online
+	r.DeleteRoomIfEmpty(room)
+	return nil
+}
+
+// yieldRoom gives up our claim of a room after another relay's newer claim won, see shared.RoomInfo.Supersedes.
+// The runner pushing to us is redirected to the new owner, our receivers get the stream from there
+func (r *Relay) yieldRoom(room *shared.Room, newOwnerID peer.ID) {
+	if !room.CompareAndSetOwnerID(r.ID, newOwnerID) {
+		return
+	}
+	slog.Info("Yielding room to relay with a newer claim", "room", room.Name, "owner_id", newOwnerID)
+	r.StreamProtocol.closePush(room.Name, newOwnerID)
+	r.StreamProtocol.dropRewriters(room)
+	room.SetTrack(webrtc.RTPCodecTypeAudio, nil)
+	room.SetTrack(webrtc.RTPCodecTypeVideo, nil)
+	// Publish our state without the room, so nobody keeps our claim around
+	if err := r.publishRoomStates(context.Background()); err != nil {
+		slog.Error("Failed to publish room states after yielding room", "room", room.Name, "err", err)
+	}
 }
 
 // GetRemoteRoomByName returns room from mesh by name
@@ -71,33 +189,82 @@ func (r *Relay) GetRemoteRoomByName(roomName string) *shared.RoomInfo {
 	return nil
 }
 
+// onRoomOnlineChange is called when a local room goes online or offline
+func (r *Relay) onRoomOnlineChange(room *shared.Room, online bool) {
+	slog.Info("Room online state changed", "room", room.Name, "online", online)
+	if online {
+		r.StreamProtocol.notifyRoomOnline(room)
+	}
+	r.publishRoomChange(room)
+}
+
+// onRoomCodecChange is called when a local room keeps streaming with another codec, such as after a runner reconnect
+func (r *Relay) onRoomCodecChange(room *shared.Room) {
+	slog.Info("Room codec changed", "room", room.Name,
+		"video_codec", room.TrackCodec(webrtc.RTPCodecTypeVideo), "audio_codec", room.TrackCodec(webrtc.RTPCodecTypeAudio))
+	r.publishRoomChange(room)
+}
+
+// publishRoomChange versions and publishes a change to an owned room
+func (r *Relay) publishRoomChange(room *shared.Room) {
+	// Only owned rooms are published, mirrored ones follow the owner's state
+	if !room.SetVersion(r.ID, r.clock.Now()) {
+		return
+	}
+	// Our newer claim replaces whatever the mesh knew about the room
+	info := room.Info()
+	if existing, ok := r.MeshRooms.Get(room.Name); ok && info.Supersedes(existing) {
+		r.MeshRooms.Delete(room.Name)
+	}
+	if err := r.publishRoomStates(context.Background()); err != nil {
+		slog.Error("Failed to publish room states on change", "room", room.Name, "err", err)
+	}
+}
+
 // --- State Publishing ---
 
 // publishRoomStates publishes the state of all rooms currently owned by *this* relay
+// Each update is a full snapshot of our rooms, so a newer update always supersedes the older ones
 func (r *Relay) publishRoomStates(ctx context.Context) error {
 	if r.pubTopicState == nil {
 		slog.Warn("Cannot publish room states: topic is nil")
 		return nil
 	}
 
-	var statesToPublish []shared.RoomInfo
+	privKey := r.Host.Peerstore().PrivKey(r.ID)
+	if privKey == nil {
+		return errors.New("missing private key for signing room states")
+	}
+
+	// Snapshot and its sequence number are taken together, so a later sequence number always has the newer snapshot
+	r.stateMutex.Lock()
+	entities := make(map[string]*gen.EntityState)
 	r.LocalRooms.Range(func(id ulid.ULID, room *shared.Room) bool {
-		// Only publish state for rooms owned by this relay
-		if room.OwnerID == r.ID {
-			statesToPublish = append(statesToPublish, shared.RoomInfo{
-				ID:      room.ID,
-				Name:    room.Name,
-				OwnerID: r.ID,
-			})
+		// Only publish state for rooms owned by this relay, which have been versioned by a push
+		if info := room.Info(); info.OwnerID == r.ID && info.Version != 0 {
+			info.Online = room.IsOnline()
+			// Receivers lacking the codecs find out before requesting the stream
+			info.VideoCodec = room.TrackCodec(webrtc.RTPCodecTypeVideo)
+			info.AudioCodec = room.TrackCodec(webrtc.RTPCodecTypeAudio)
+			if err := info.Sign(privKey); err != nil {
+				slog.Error("Failed to sign room state", "room", room.Name, "err", err)
+				return true
+			}
+			entities[room.Name] = info.ToProto()
 		}
 		return true // Continue iteration
 	})
-
-	if len(statesToPublish) == 0 {
-		return nil
+	r.stateSequence++
+	update := &gen.StateUpdate{
+		SequenceNumber: r.stateSequence,
+		Entities:       entities,
 	}
+	r.lastStateUpdate = update
+	r.stateMutex.Unlock()
 
-	data, err := json.Marshal(statesToPublish)
+	data, err := proto.Marshal(&gen.MeshMessage{
+		Type: &gen.MeshMessage_StateUpdate{StateUpdate: update},
+	})
 	if err != nil {
 		return fmt.Errorf("failed to marshal local room states: %w", err)
 	}
@@ -106,3 +273,30 @@ func (r *Relay) publishRoomStates(ctx context.Context) error {
 	}
 	return nil
 }
+
+// currentStateSequence returns the sequence number of the latest published state update
+func (r *Relay) currentStateSequence() uint64 {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	if r.lastStateUpdate == nil {
+		return 0
+	}
+	return r.lastStateUpdate.GetSequenceNumber()
+}
+
+// latestStateUpdate returns the latest published state update, publishing one first if none exists yet
+func (r *Relay) latestStateUpdate(ctx context.Context) (*gen.StateUpdate, error) {
+	r.stateMutex.Lock()
+	update := r.lastStateUpdate
+	r.stateMutex.Unlock()
+	if update != nil {
+		return update, nil
+	}
+
+	if err := r.publishRoomStates(ctx); err != nil {
+		return nil, err
+	}
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	return r.lastStateUpdate, nil
+}
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"relay/internal/common"
+	"relay/internal/shared"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Stream Routing ---
+// Room streams are pulled over the cheapest path through the mesh, measured by the latencies
+// every relay gossips with its metrics. Relays already receiving a room stream act as replicas
+// of the owner, so a stream can be pulled from whichever copy is closest
+
+// Route is the path a room stream is pulled over
+type Route struct {
+	Room     string        `json:"room"`
+	SourceID peer.ID       `json:"source_id"` // Owner or replica relay providing the stream
+	Path     []peer.ID     `json:"path"`      // Relays the stream passes, from our upstream neighbour to the source
+	Cost     time.Duration `json:"cost"`      // Sum of latencies along the path, 0 if unknown
+}
+
+// UpstreamID returns the relay the stream is requested from
+func (rt Route) UpstreamID() peer.ID {
+	if len(rt.Path) == 0 {
+		return rt.SourceID
+	}
+	return rt.Path[0]
+}
+
+func (rt Route) String() string {
+	hops := make([]string, 0, len(rt.Path))
+	for _, hop := range rt.Path {
+		hops = append(hops, hop.ShortString())
+	}
+	return fmt.Sprintf("%s: self -> %s (%s)", rt.Room, strings.Join(hops, " -> "), rt.Cost)
+}
+
+// meshGraph is a weighted graph of relays, edges are latencies between relays
+type meshGraph map[peer.ID]map[peer.ID]time.Duration
+
+func (g meshGraph) addEdge(from, to peer.ID, latency time.Duration) {
+	if g[from] == nil {
+		g[from] = make(map[peer.ID]time.Duration)
+	}
+	g[from][to] = latency
+	// Latencies are round trip times, use them both ways unless measured by the other side
+	if g[to] == nil {
+		g[to] = make(map[peer.ID]time.Duration)
+	}
+	if _, ok := g[to][from]; !ok {
+		g[to][from] = latency
+	}
+}
+
+// shortestPaths returns distance and previous hop of each relay reachable from given relay.
+// Relays in exclude are not passed through
+func (g meshGraph) shortestPaths(from peer.ID, exclude ...peer.ID) (map[peer.ID]time.Duration, map[peer.ID]peer.ID) {
+	dist := map[peer.ID]time.Duration{from: 0}
+	prev := make(map[peer.ID]peer.ID)
+	visited := make(map[peer.ID]bool)
+
+	// The mesh is small, plain Dijkstra without a priority queue does fine
+	for {
+		var current peer.ID
+		found := false
+		for id, d := range dist {
+			if !visited[id] && (!found || d < dist[current]) {
+				current = id
+				found = true
+			}
+		}
+		if !found {
+			break
+		}
+		visited[current] = true
+
+		for next, latency := range g[current] {
+			if visited[next] || slices.Contains(exclude, next) {
+				continue
+			}
+			if d, ok := dist[next]; !ok || dist[current]+latency < d {
+				dist[next] = dist[current] + latency
+				prev[next] = current
+			}
+		}
+	}
+	return dist, prev
+}
+
+// buildMeshGraph builds the mesh graph from our own latencies and the ones gossiped by other relays
+func (r *Relay) buildMeshGraph() meshGraph {
+	graph := make(meshGraph)
+	r.MeshLatencies.Range(func(id string, latency time.Duration) bool {
+		peerID, err := peer.Decode(id)
+		if err != nil {
+			return true
+		}
+		// Our own edges are only usable while connected
+		if r.Host.Network().Connectedness(peerID) == network.Connected {
+			graph.addEdge(r.ID, peerID, latency)
+		}
+		return true
+	})
+	for relayID, info := range r.LocalMeshPeers.Copy() {
+		if info == nil || info.MeshLatencies == nil {
+			continue
+		}
+		info.MeshLatencies.Range(func(id string, latency time.Duration) bool {
+			if peerID, err := peer.Decode(id); err == nil {
+				graph.addEdge(relayID, peerID, latency)
+			}
+			return true
+		})
+	}
+	return graph
+}
+
+// findRoute finds the cheapest route to pull a room stream from, either from the owner or a relay
+// already receiving the stream. excludeID is never passed through, so a stream isn't requested back
+// from the relay asking us for it
+func (r *Relay) findRoute(roomName string, ownerID peer.ID, excludeID peer.ID) Route {
+	// Owner is always a candidate, replicas are relays announcing a route for the room not passing us
+	candidates := []peer.ID{ownerID}
+	for relayID, info := range r.LocalMeshPeers.Copy() {
+		if relayID == ownerID || relayID == excludeID || info == nil || info.MeshRoutes == nil {
+			continue
+		}
+		if route, ok := info.MeshRoutes.Get(roomName); ok && !slices.Contains(route.Path, r.ID) {
+			candidates = append(candidates, relayID)
+		}
+	}
+
+	var exclude []peer.ID
+	if len(excludeID) > 0 {
+		exclude = append(exclude, excludeID)
+	}
+	dist, prev := r.buildMeshGraph().shortestPaths(r.ID, exclude...)
+
+	best := Route{Room: roomName, SourceID: ownerID, Path: []peer.ID{ownerID}}
+	bestFound := false
+	for _, candidateID := range candidates {
+		cost, ok := dist[candidateID]
+		if !ok || candidateID == r.ID || (bestFound && cost >= best.Cost) {
+			continue
+		}
+		var path []peer.ID
+		for hop := candidateID; hop != r.ID; hop = prev[hop] {
+			path = append([]peer.ID{hop}, path...)
+		}
+		best = Route{Room: roomName, SourceID: candidateID, Path: path, Cost: cost}
+		bestFound = true
+	}
+	if !bestFound {
+		slog.Debug("No latency known towards room owner, routing directly", "room", roomName, "owner_id", ownerID)
+	}
+	return best
+}
+
+// requestRoomStream requests the stream of a room owned by another relay over the cheapest route.
+// The chosen route is kept in MeshRoutes until the stream closes, and shared with the mesh
+func (r *Relay) requestRoomStream(ctx context.Context, room *shared.Room, excludeID peer.ID) error {
+	// No point pulling a stream we can't forward
+	if err := r.checkRoomCodecs(room.Name); err != nil {
+		return err
+	}
+
+	// Stream requested already, its route stays
+	if r.StreamProtocol.isRequested(room.Name) {
+		return nil
+	}
+
+	ownerID := room.GetOwnerID()
+	route := r.findRoute(room.Name, ownerID, excludeID)
+	slog.Info("Selected route for room stream", "room", room.Name, "owner_id", ownerID, "route", route.String())
+	if err := r.StreamProtocol.RequestStream(ctx, room, route.UpstreamID()); err != nil {
+		return err
+	}
+	r.MeshRoutes.Set(room.Name, route)
+	return nil
+}
+
+// checkRoomCodecs checks that we support the codecs of a mesh room, as gossiped by its owner.
+// Rooms with codecs not known yet pass
+func (r *Relay) checkRoomCodecs(roomName string) error {
+	info, ok := r.MeshRooms.Get(roomName)
+	if !ok {
+		return nil
+	}
+	for _, codec := range []string{info.VideoCodec, info.AudioCodec} {
+		if len(codec) > 0 && !common.SupportsCodec(codec) {
+			return fmt.Errorf("%w: room codec %s is not supported by this relay", common.ErrUnsupportedCodec, codec)
+		}
+	}
+	return nil
+}
+
+// reestablishStream gets a room stream back after losing its upstream, retrying with backoff while the room
+// still has receivers. Local tracks are kept, new upstream feeds them without receivers renegotiating
+func (r *Relay) reestablishStream(room *shared.Room) {
+	if _, running := r.reestablishing.LoadOrStore(room.Name, true); running {
+		return
+	}
+	defer r.reestablishing.Delete(room.Name)
+
+	backoff := reestablishBackoffMin
+	for attempt := 1; ; attempt++ {
+		// Rooms deleted, taken over or without receivers don't need the stream anymore
+		if !r.LocalRooms.Has(room.ID) || room.GetOwnerID() == r.ID || !r.hasRoomReceivers(room) {
+			return
+		}
+
+		remoteRoom := r.GetRemoteRoomByName(room.Name)
+		if remoteRoom == nil || !remoteRoom.Online {
+			// Nowhere to get the stream from, it's requested again once the room is back online
+			slog.Info("Room stream lost and room is offline in mesh", "room", room.Name)
+			r.StreamProtocol.dropRewriters(room)
+			room.SetTrack(webrtc.RTPCodecTypeAudio, nil)
+			room.SetTrack(webrtc.RTPCodecTypeVideo, nil)
+			// Relays we forward to find out on their own, they get the stream from wherever it comes back
+			r.StreamProtocol.closeServed(room.Name)
+			r.DeleteRoomIfEmpty(room)
+			return
+		}
+		// Room may have changed owner meanwhile
+		room.SetOwnerID(remoteRoom.OwnerID)
+
+		slog.Info("Re-establishing room stream", "room", room.Name, "owner_id", room.GetOwnerID(), "attempt", attempt)
+		err := r.requestRoomStream(context.Background(), room, "")
+		if err == nil && r.StreamProtocol.waitUpstreamConnected(room, transitStreamTimeout) {
+			slog.Info("Re-established room stream", "room", room.Name, "attempt", attempt)
+			return
+		}
+		if err != nil {
+			slog.Warn("Failed to re-establish room stream", "room", room.Name, "attempt", attempt, "err", err)
+		} else if pc := room.GetPeerConnection(); pc != nil {
+			// Give up on this attempt, closing it doesn't trigger another re-establishment while we run
+			slog.Warn("Upstream did not provide room stream in time", "room", room.Name, "attempt", attempt)
+			if err = pc.Close(); err != nil {
+				slog.Error("Failed to close timed out room stream", "room", room.Name, "err", err)
+			}
+		}
+
+		time.Sleep(backoff)
+		backoff = min(backoff*2, reestablishBackoffMax)
+	}
+}
+
+// hasRoomReceivers checks if a room stream is used by local participants, other relays or a recording
+func (r *Relay) hasRoomReceivers(room *shared.Room) bool {
+	return room.Participants.Len() > 0 || r.StreamProtocol.isServing(room.Name) || r.StreamProtocol.hasSubscriptions(room.Name) ||
+		r.RecordingProtocol.isRecording(room.Name)
+}
+
+// --- Public Usable Methods ---
+
+// GetRoute returns the route a room stream is currently pulled over, for debugging
+func (r *Relay) GetRoute(roomName string) (Route, bool) {
+	return r.MeshRoutes.Get(roomName)
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"log/slog"
+	"relay/internal/shared"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- RTCP Routing ---
+// Keyframe requests of participants and downstream relays are collected per room and sent upstream as a
+// single PLI, to the pushing runner or the relay we get the room stream from. Requests arriving while a
+// keyframe is already on its way are folded into one follow-up request, so the runner isn't flooded
+
+// keyframeSource is an upstream video track keyframes of a room can be requested for
+type keyframeSource struct {
+	pc          *webrtc.PeerConnection
+	ssrc        webrtc.SSRC
+	requestedAt time.Time // when a keyframe was last requested
+	pending     bool      // whether a follow-up request is scheduled
+}
+
+// setKeyframeSource sets the upstream video track of a room, of given simulcast layer or the only one if rid is empty
+func (sp *StreamProtocol) setKeyframeSource(roomName string, rid string, pc *webrtc.PeerConnection, ssrc webrtc.SSRC) {
+	sp.keyframeMutex.Lock()
+	defer sp.keyframeMutex.Unlock()
+	if sp.keyframeSources[roomName] == nil {
+		sp.keyframeSources[roomName] = make(map[string]*keyframeSource)
+	}
+	sp.keyframeSources[roomName][rid] = &keyframeSource{pc: pc, ssrc: ssrc}
+}
+
+// removeKeyframeSource removes the upstream video track of a room, unless already replaced by a newer upstream
+func (sp *StreamProtocol) removeKeyframeSource(roomName string, rid string, pc *webrtc.PeerConnection) {
+	sp.keyframeMutex.Lock()
+	defer sp.keyframeMutex.Unlock()
+	if source, ok := sp.keyframeSources[roomName][rid]; ok && source.pc == pc {
+		delete(sp.keyframeSources[roomName], rid)
+	}
+	if len(sp.keyframeSources[roomName]) == 0 {
+		delete(sp.keyframeSources, roomName)
+	}
+}
+
+// requestKeyframe asks upstream for a keyframe of the room video, of given simulcast layer or all layers if rid is empty
+func (sp *StreamProtocol) requestKeyframe(room *shared.Room, rid string) {
+	sp.keyframeMutex.Lock()
+	defer sp.keyframeMutex.Unlock()
+
+	for sourceRID, source := range sp.keyframeSources[room.Name] {
+		if len(rid) > 0 && sourceRID != rid {
+			continue
+		}
+		wait := keyframeRequestInterval - time.Since(source.requestedAt)
+		if wait <= 0 {
+			source.requestedAt = time.Now()
+			go sp.sendPLI(room.Name, source.pc, source.ssrc)
+			continue
+		}
+		if source.pending {
+			continue
+		}
+		// A keyframe was asked for moments ago, which may have been sent before this receiver lost it
+		source.pending = true
+		time.AfterFunc(wait, func() {
+			sp.keyframeMutex.Lock()
+			source.pending = false
+			source.requestedAt = time.Now()
+			sp.keyframeMutex.Unlock()
+			sp.sendPLI(room.Name, source.pc, source.ssrc)
+		})
+	}
+}
+
+// sendPLI sends a PLI for an upstream video track
+func (sp *StreamProtocol) sendPLI(roomName string, pc *webrtc.PeerConnection, ssrc webrtc.SSRC) {
+	if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		return
+	}
+	slog.Debug("Requesting keyframe upstream", "room", roomName, "ssrc", ssrc)
+	packets := []rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}}
+	if err := pc.WriteRTCP(packets); err != nil {
+		slog.Error("Failed to send PLI upstream", "room", roomName, "err", err)
+		return
+	}
+	if capture := sp.relay.RecordingProtocol.capture(roomName); capture != nil {
+		capture.WriteRTCP(nil, packets, true)
+	}
+}
+
+// readUpstreamRTCP reads RTCP the runner or upstream relay sends for a track, until the track ends.
+// Sender reports aren't forwarded, but are read for the receiver reports sent back and for captures
+func (sp *StreamProtocol) readUpstreamRTCP(roomName string, track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	for {
+		var packets []rtcp.Packet
+		var err error
+		if len(track.RID()) > 0 {
+			packets, _, err = receiver.ReadSimulcastRTCP(track.RID())
+		} else {
+			packets, _, err = receiver.ReadRTCP()
+		}
+		if err != nil {
+			return
+		}
+		if capture := sp.relay.RecordingProtocol.capture(roomName); capture != nil {
+			capture.WriteRTCP(track, packets, false)
+		}
+	}
+}
@@ -2,15 +2,18 @@ package core
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
+	gen "relay/internal/proto"
 	"relay/internal/shared"
 	"time"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"google.golang.org/protobuf/proto"
 )
 
 // --- PubSub Message Handlers ---
@@ -38,13 +41,19 @@ func (r *Relay) handleRoomStateMessages(ctx context.Context, sub *pubsub.Subscri
 				continue
 			}
 
-			var states []shared.RoomInfo
-			if err := json.Unmarshal(msg.Data, &states); err != nil {
-				slog.Error("Failed to unmarshal room states", "from", msg.GetFrom(), "data_len", len(msg.Data), "err", err)
+			// Decoded and validated by validateRoomStateMessage
+			meshMsg, ok := msg.ValidatorData.(*gen.MeshMessage)
+			if !ok {
+				slog.Error("Room states message without validated data", "from", msg.GetFrom())
 				continue
 			}
 
-			r.updateMeshRoomStates(msg.GetFrom(), states)
+			switch msgType := meshMsg.GetType().(type) {
+			case *gen.MeshMessage_StateUpdate:
+				r.onStateUpdate(msg.GetFrom(), msgType.StateUpdate)
+			default:
+				slog.Warn("Unexpected message type on room states topic", "from", msg.GetFrom(), "type", fmt.Sprintf("%T", msgType))
+			}
 		}
 	}
 }
@@ -72,20 +81,65 @@ func (r *Relay) handleRelayMetricsMessages(ctx context.Context, sub *pubsub.Subs
 				continue
 			}
 
-			var info RelayInfo
-			if err := json.Unmarshal(msg.Data, &info); err != nil {
-				slog.Error("Failed to unmarshal relay status", "from", msg.GetFrom(), "data_len", len(msg.Data), "err", err)
+			// Decoded and validated by validateRelayMetricsMessage
+			info, ok := msg.ValidatorData.(*RelayInfo)
+			if !ok {
+				slog.Error("Relay status without validated data", "from", msg.GetFrom())
+				continue
+			}
+			r.onPeerStatus(*info)
+		}
+	}
+}
+
+// handleRelayHealthMessages processes incoming failure detector messages from peers.
+func (r *Relay) handleRelayHealthMessages(ctx context.Context, sub *pubsub.Subscription) {
+	slog.Debug("Starting relay health message handler...")
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping relay health message handler")
+			return
+		default:
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				if errors.Is(err, context.Canceled) || errors.Is(err, pubsub.ErrSubscriptionCancelled) || errors.Is(err, context.DeadlineExceeded) {
+					slog.Info("Relay health subscription ended", "err", err)
+					return
+				}
+				slog.Error("Error receiving relay health message", "err", err)
+				time.Sleep(1 * time.Second)
 				continue
 			}
-			if info.ID != msg.GetFrom() {
-				slog.Error("Peer ID mismatch in relay status", "expected", info.ID, "actual", msg.GetFrom())
+			if msg.GetFrom() == r.Host.ID() {
 				continue
 			}
-			r.onPeerStatus(info)
+
+			// Decoded and validated by validateRelayHealthMessage
+			meshMsg, ok := msg.ValidatorData.(*gen.MeshMessage)
+			if !ok {
+				slog.Error("Relay health message without validated data", "from", msg.GetFrom())
+				continue
+			}
+			r.HealthProtocol.onHealthMessage(ctx, msg.GetFrom(), meshMsg)
 		}
 	}
 }
 
+// publishHealthMessage publishes a failure detector message to the mesh
+func (r *Relay) publishHealthMessage(ctx context.Context, msg *gen.MeshMessage) error {
+	if r.pubTopicRelayHealth == nil {
+		slog.Warn("Cannot publish relay health message: topic is nil")
+		return nil
+	}
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal relay health message: %w", err)
+	}
+	return r.pubTopicRelayHealth.Publish(ctx, data)
+}
+
 // --- State Check Functions ---
 // hasConnectedPeer checks if peer is in map and has a valid connection
 func (r *Relay) hasConnectedPeer(peerID peer.ID) bool {
@@ -104,16 +158,46 @@ func (r *Relay) hasConnectedPeer(peerID peer.ID) bool {
 // onPeerStatus updates the status of a peer based on received metrics, adding local perspective
 func (r *Relay) onPeerStatus(recvInfo RelayInfo) {
 	r.LocalMeshPeers.Set(recvInfo.ID, &recvInfo)
+
+	// Relays further along the mesh are only known through gossip, keep their addresses so they can be dialed
+	if recvInfo.ID != r.ID {
+		var addrs []multiaddr.Multiaddr
+		for _, addr := range recvInfo.MeshAddrs {
+			multiAddr, err := multiaddr.NewMultiaddr(addr)
+			if err != nil {
+				slog.Debug("Ignoring invalid mesh address of peer", "peer", recvInfo.ID, "addr", addr, "err", err)
+				continue
+			}
+			addrs = append(addrs, multiAddr)
+		}
+		r.Host.Peerstore().AddAddrs(recvInfo.ID, addrs, meshAddrTTL)
+	}
+
+	// Peer has published a room state update we haven't seen, recover it
+	if lastSeq, _ := r.meshStateSequences.Get(recvInfo.ID); recvInfo.StateSequence > lastSeq {
+		slog.Debug("Missing latest room state update from peer, requesting retransmission", "peer", recvInfo.ID, "have", lastSeq, "latest", recvInfo.StateSequence)
+		go r.StateProtocol.RequestRetransmission(context.Background(), recvInfo.ID, recvInfo.StateSequence)
+	}
 }
 
-// onPeerConnected is called when a new peer connects to the relay
+// onPeerConnected is called when we connect to a new peer, joining the mesh through it if it's a relay
 func (r *Relay) onPeerConnected(peerID peer.ID) {
+	if r.AdmissionProtocol.admitted.Has(peerID) {
+		return
+	}
+	if err := r.AdmissionProtocol.Handshake(context.Background(), peerID); err != nil {
+		slog.Debug("Mesh handshake with peer failed", "peer", peerID, "err", err)
+	}
+}
+
+// onPeerAdmitted is called when a relay completed the mesh handshake with us
+func (r *Relay) onPeerAdmitted(peerID peer.ID) {
 	// Add to local peer map
 	r.LocalMeshPeers.Set(peerID, &RelayInfo{
 		ID: peerID,
 	})
 
-	slog.Info("Peer connected", "peer", peerID)
+	slog.Info("Peer admitted to mesh", "peer", peerID)
 
 	// Trigger immediate state exchange
 	go func() {
@@ -130,44 +214,181 @@ func (r *Relay) onPeerConnected(peerID peer.ID) {
 // onPeerDisconnected marks a peer as disconnected in our status view and removes latency info
 func (r *Relay) onPeerDisconnected(peerID peer.ID) {
 	slog.Info("Mesh peer disconnected, deleting from local peer map", "peer", peerID)
+	r.removeMeshPeer(peerID)
+}
+
+// onRelayDead is called when the mesh agreed that a relay is dead, dropping it and its rooms
+func (r *Relay) onRelayDead(peerID peer.ID, reason string) {
+	slog.Warn("Mesh peer declared dead", "peer", peerID, "reason", reason)
+	r.removeMeshPeer(peerID)
+	if r.Host.Network().Connectedness(peerID) == network.Connected {
+		if err := r.Host.Network().ClosePeer(peerID); err != nil {
+			slog.Error("Failed to close connection to dead peer", "peer", peerID, "err", err)
+		}
+	}
+}
+
+// removeMeshPeer forgets everything we know about a mesh peer
+func (r *Relay) removeMeshPeer(peerID peer.ID) {
 	// Remove peer from local mesh peers
 	if r.LocalMeshPeers.Has(peerID) {
 		r.LocalMeshPeers.Delete(peerID)
 	}
+	// Peer has to handshake again when it comes back
+	r.AdmissionProtocol.forget(peerID)
 	// Remove any rooms associated with this peer
-	if r.MeshRooms.Has(peerID.String()) {
-		r.MeshRooms.Delete(peerID.String())
+	r.removeMeshRoomsOwnedBy(peerID, nil)
+	// Forget the state sequence, the peer starts over if it comes back
+	if r.meshStateSequences.Has(peerID) {
+		r.meshStateSequences.Delete(peerID)
 	}
 	// Remove any latencies associated with this peer
-	if r.LocalMeshPeers.Has(peerID) {
-		r.LocalMeshPeers.Delete(peerID)
+	if r.MeshLatencies.Has(peerID.String()) {
+		r.MeshLatencies.Delete(peerID.String())
 	}
 
-	// TODO: If any rooms were routed through this peer, handle that case
+	// Streams pulled from the peer lost their upstream, closing them gets them re-established from elsewhere
+	for roomName, route := range r.MeshRoutes.Copy() {
+		if route.UpstreamID() != peerID {
+			continue
+		}
+		room := r.GetRoomByName(roomName)
+		if room == nil {
+			continue
+		}
+		if pc := room.GetPeerConnection(); pc != nil {
+			slog.Info("Lost upstream relay of room stream", "room", roomName, "peer", peerID)
+			if err := pc.Close(); err != nil {
+				slog.Error("Failed to close room stream of lost upstream relay", "room", roomName, "err", err)
+			}
+		}
+	}
+}
+
+// onStateUpdate applies a room state update from a peer, ignoring duplicate or reordered updates
+func (r *Relay) onStateUpdate(peerID peer.ID, update *gen.StateUpdate) bool {
+	// Concurrent updates from the peer must not move the sequence backwards
+	var lastSeq uint64
+	var known bool
+	if !r.meshStateSequences.Update(peerID, func(current uint64, ok bool) (uint64, bool) {
+		lastSeq, known = current, ok
+		return update.GetSequenceNumber(), !ok || update.GetSequenceNumber() > current
+	}) {
+		slog.Debug("Ignoring outdated room state update", "peer", peerID, "sequence", update.GetSequenceNumber(), "last", lastSeq)
+		return false
+	}
+	if known && update.GetSequenceNumber() > lastSeq+1 {
+		// Updates are full snapshots, so the newest one covers everything we missed
+		slog.Debug("Gap in room state updates, recovered by snapshot", "peer", peerID, "missed", update.GetSequenceNumber()-lastSeq-1)
+	}
+
+	states := make([]shared.RoomInfo, 0, len(update.GetEntities()))
+	for name, entity := range update.GetEntities() {
+		state, err := shared.RoomInfoFromProto(entity)
+		if err != nil {
+			slog.Error("Invalid room state entity", "peer", peerID, "entity", name, "err", err)
+			continue
+		}
+		if state.OwnerID != peerID {
+			slog.Warn("Ignoring room state for a room not owned by sender", "peer", peerID, "room", state.Name, "owner_id", state.OwnerID)
+			continue
+		}
+		if err = state.Verify(); err != nil {
+			slog.Warn("Ignoring room state with invalid signature", "peer", peerID, "room", state.Name, "err", err)
+			continue
+		}
+		states = append(states, state)
+	}
+
+	r.updateMeshRoomStates(peerID, states)
+	return true
+}
+
+// mergeMeshRoomState stores a room state unless a superseding state of the same room is already known.
+// Returns whether the state was stored
+func (r *Relay) mergeMeshRoomState(state shared.RoomInfo) bool {
+	if existing, ok := r.MeshRooms.Get(state.Name); ok && existing.Supersedes(state) {
+		slog.Debug("Ignoring superseded room state", "room", state.Name, "owner_id", state.OwnerID, "version", state.Version, "current_owner_id", existing.OwnerID, "current_version", existing.Version)
+		return false
+	}
+
+	// Compare against our own claim of the room too
+	if room := r.GetRoomByName(state.Name); room != nil {
+		if local := room.Info(); local.OwnerID == r.ID && local.Version != 0 {
+			if local.Supersedes(state) {
+				slog.Debug("Ignoring room state superseded by our own", "room", state.Name, "owner_id", state.OwnerID, "version", state.Version, "local_version", local.Version)
+				return false
+			}
+			slog.Warn("Room is claimed by another relay with a newer state", "room", state.Name, "owner_id", state.OwnerID, "version", state.Version, "local_version", local.Version)
+			r.yieldRoom(room, state.OwnerID)
+		}
+	}
+
+	r.MeshRooms.Set(state.Name, state)
+	return true
+}
+
+// removeMeshRoomsOwnedBy removes mesh rooms of owner, except for the ones in keep
+func (r *Relay) removeMeshRoomsOwnedBy(ownerID peer.ID, keep map[string]bool) {
+	for name, room := range r.MeshRooms.Copy() {
+		if room.OwnerID == ownerID && !keep[name] {
+			slog.Debug("Removing mesh room", "room", name, "owner_id", ownerID)
+			r.MeshRooms.Delete(name)
+		}
+	}
 }
 
-// updateMeshRoomStates merges received room states into the MeshRooms map
-// TODO: Wrap in another type with timestamp or another mechanism to avoid conflicts
+// updateMeshRoomStates replaces the MeshRooms of a peer with its received room states.
+// Conflicting claims for the same room name are merged last-writer-wins, see shared.RoomInfo.Supersedes
 func (r *Relay) updateMeshRoomStates(peerID peer.ID, states []shared.RoomInfo) {
+	// Snapshot doesn't contain rooms the peer no longer owns
+	keep := make(map[string]bool, len(states))
+	for _, state := range states {
+		keep[state.Name] = true
+	}
+	r.removeMeshRoomsOwnedBy(peerID, keep)
+
 	for _, state := range states {
 		if state.OwnerID == r.ID {
 			continue
 		}
+		// Our next versions must order after anything seen in the mesh
+		r.clock.Update(state.Version)
 
-		// If previously did not exist, but does now, request a connection if participants exist for our room
-		existed := r.MeshRooms.Has(state.ID.String())
-		if !existed {
-			// Request connection to this peer if we have participants in our local room
-			if room, ok := r.LocalRooms.Get(state.ID); ok {
-				if room.Participants.Len() > 0 {
-					slog.Debug("Got new remote room state, we locally have participants for, requesting stream", "room_name", room.Name, "peer", peerID)
-					if err := r.StreamProtocol.RequestStream(context.Background(), room, peerID); err != nil {
-						slog.Error("Failed to request stream for new remote room state", "room_name", room.Name, "peer", peerID, "err", err)
-					}
-				}
+		if !r.mergeMeshRoomState(state) {
+			continue
+		}
+
+		// If the remote room is online and we have participants waiting locally, request the stream
+		if !state.Online {
+			continue
+		}
+		room := r.GetRoomByName(state.Name)
+		subscribed := r.StreamProtocol.hasSubscriptions(state.Name)
+		if room == nil && subscribed {
+			// Other relays wait for the room through us, get the stream to forward it
+			room = r.CreateRemoteRoom(state)
+		}
+		if room == nil || !r.hasRoomReceivers(room) || room.IsOnline() {
+			continue
+		}
+		if room.GetOwnerID() == r.ID {
+			// Local room nobody pushes to, participants were waiting for the room to show up anywhere
+			if r.StreamProtocol.incomingConns.Has(room.Name) {
+				continue
+			}
+			slog.Debug("Remote relay owns a room we have waiting participants for, mirroring it", "room_name", room.Name, "peer", peerID)
+			if !room.CompareAndSetOwnerID(r.ID, state.OwnerID) {
+				continue
 			}
 		}
+		if r.StreamProtocol.isRequested(room.Name) {
+			continue
+		}
 
-		r.MeshRooms.Set(state.ID.String(), state)
+		slog.Debug("Remote room came online, we locally have participants for, requesting stream", "room_name", room.Name, "peer", peerID)
+		if err := r.requestRoomStream(context.Background(), room, ""); err != nil {
+			slog.Error("Failed to request stream for remote room state", "room_name", room.Name, "peer", peerID, "err", err)
+		}
 	}
 }
@@ -0,0 +1,182 @@
+package core
+
+import (
+	"fmt"
+	"log/slog"
+	"relay/internal/common"
+	"relay/internal/shared"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Forwarded Tracks ---
+// Local tracks of a room outlive their source, so a reconnecting runner or a new upstream relay feeds
+// the same tracks and receivers continue uninterrupted. Packets are rewritten to continue where the
+// previous source left off
+
+// rewriterFor returns the RTP rewriter of packets forwarded to a local track
+func (sp *StreamProtocol) rewriterFor(track *webrtc.TrackLocalStaticRTP) *common.RTPRewriter {
+	if rewriter, ok := sp.trackRewriters.Get(track); ok {
+		return rewriter
+	}
+	rewriter := common.NewRTPRewriter(track.Codec().ClockRate)
+	sp.trackRewriters.Set(track, rewriter)
+	return rewriter
+}
+
+// dropRewriters forgets the RTP rewriters and packet histories of the room's current tracks
+func (sp *StreamProtocol) dropRewriters(room *shared.Room) {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		sp.dropTrack(room.GetTrack(kind))
+	}
+}
+
+// dropTrack forgets the RTP rewriter, packet history and taps of a local track
+func (sp *StreamProtocol) dropTrack(track *webrtc.TrackLocalStaticRTP) {
+	if track == nil {
+		return
+	}
+	sp.trackRewriters.Delete(track)
+	sp.ForgetTrack(track)
+}
+
+// WriteRTP writes a packet to a local track, keeping video packets for retransmissions to its receivers
+// and feeding taps of in-process receivers
+func (sp *StreamProtocol) WriteRTP(track *webrtc.TrackLocalStaticRTP, packet *rtp.Packet) error {
+	sp.relay.WebRTC.KeepPacket(track, packet)
+	if taps, ok := sp.trackTaps.Get(track); ok {
+		taps.Push(packet)
+	}
+	return track.WriteRTP(packet)
+}
+
+// ForgetTrack drops the packet history and taps of a local track that is no longer forwarded to
+func (sp *StreamProtocol) ForgetTrack(track *webrtc.TrackLocalStaticRTP) {
+	if track == nil {
+		return
+	}
+	sp.relay.WebRTC.ForgetPackets(track)
+	sp.trackTaps.Delete(track)
+}
+
+// TapTrack passes packets forwarded to a local track to given function, until untapped by key
+func (sp *StreamProtocol) TapTrack(track *webrtc.TrackLocalStaticRTP, key any, tap func(packet *rtp.Packet)) {
+	taps, _ := sp.trackTaps.LoadOrStore(track, common.NewTrackTaps())
+	taps.Tap(key, tap)
+}
+
+// UntapTrack removes a tap added with TapTrack
+func (sp *StreamProtocol) UntapTrack(track *webrtc.TrackLocalStaticRTP, key any) {
+	if taps, ok := sp.trackTaps.Get(track); ok {
+		taps.Untap(key)
+	}
+}
+
+// --- Pushed Tracks ---
+
+// pushedTrack is a room local track fed by pushes
+type pushedTrack struct {
+	mutex sync.Mutex
+	local *webrtc.TrackLocalStaticRTP
+	rid   string // Simulcast layer of the track, empty without simulcast
+	feed  uint64 // Incremented for each push feeding the track
+}
+
+func pushedTrackKey(roomName string, kind webrtc.RTPCodecType, rid string) string {
+	if len(rid) > 0 {
+		return roomName + "/" + kind.String() + "/" + rid
+	}
+	return roomName + "/" + kind.String()
+}
+
+// currentPushedTrack returns the room local track of given kind and simulcast layer
+func currentPushedTrack(room *shared.Room, kind webrtc.RTPCodecType, rid string) *webrtc.TrackLocalStaticRTP {
+	if len(rid) == 0 {
+		return room.GetTrack(kind)
+	}
+	if layer := room.GetVideoLayer(rid); layer != nil {
+		return layer.Track
+	}
+	return nil
+}
+
+// attachPushedTrack returns the room local track a pushed remote track should feed, creating it if the
+// room has none or the codec changed. Returned feed identifies this push as the one feeding the track
+func (sp *StreamProtocol) attachPushedTrack(room *shared.Room, remoteTrack *webrtc.TrackRemote) (*pushedTrack, uint64, error) {
+	kind := remoteTrack.Kind()
+	rid := remoteTrack.RID()
+	key := pushedTrackKey(room.Name, kind, rid)
+
+	pushed, ok := sp.pushedTracks.Get(key)
+	current := currentPushedTrack(room, kind, rid)
+	if !ok || current == nil || pushed.local != current || !strings.EqualFold(current.Codec().MimeType, remoteTrack.Codec().MimeType) {
+		localTrack, err := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, kind.String(), fmt.Sprintf("nestri-%s-%s", room.Name, kind.String()))
+		if err != nil {
+			return nil, 0, err
+		}
+		// Replaced tracks aren't forwarded to anymore. Feeds keep counting, so the release of the
+		// previous push doesn't remove the new track
+		var feed uint64
+		if ok {
+			if pushed.local != current {
+				sp.dropTrack(pushed.local)
+			}
+			pushed.mutex.Lock()
+			feed = pushed.feed
+			pushed.mutex.Unlock()
+		}
+		sp.dropTrack(current)
+
+		pushed = &pushedTrack{local: localTrack, rid: rid, feed: feed}
+		sp.pushedTracks.Set(key, pushed)
+		if len(rid) > 0 {
+			slog.Info("Received simulcast video layer for room", "room", room.Name, "rid", rid)
+			room.SetVideoLayer(rid, localTrack)
+		} else {
+			room.SetTrack(kind, localTrack)
+		}
+	} else {
+		slog.Info("Reconnected push continues existing room track", "room", room.Name, "track_kind", kind.String(), "rid", rid)
+	}
+
+	// New push may reuse the SSRC of the previous one
+	sp.rewriterFor(pushed.local).SwitchSource()
+
+	pushed.mutex.Lock()
+	defer pushed.mutex.Unlock()
+	pushed.feed++
+	return pushed, pushed.feed, nil
+}
+
+// releasePushedTrack removes the track of an ended push from the room, unless a reconnected push took it over in time
+func (sp *StreamProtocol) releasePushedTrack(room *shared.Room, kind webrtc.RTPCodecType, rid string, feed uint64) {
+	time.Sleep(pushReconnectGrace)
+
+	key := pushedTrackKey(room.Name, kind, rid)
+	pushed, ok := sp.pushedTracks.Get(key)
+	if !ok {
+		return
+	}
+	pushed.mutex.Lock()
+	takenOver := pushed.feed != feed
+	pushed.mutex.Unlock()
+	if takenOver {
+		return
+	}
+
+	slog.Debug("No push reconnected in time, removing track from room", "room", room.Name, "track_kind", kind.String(), "rid", rid)
+	sp.pushedTracks.Delete(key)
+	sp.dropTrack(pushed.local)
+	if currentPushedTrack(room, kind, rid) != pushed.local {
+		return
+	}
+	if len(rid) > 0 {
+		room.RemoveVideoLayer(rid)
+	} else {
+		room.SetTrack(kind, nil)
+	}
+}
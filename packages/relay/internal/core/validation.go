@@ -0,0 +1,181 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	gen "relay/internal/proto"
+	"relay/internal/shared"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"google.golang.org/protobuf/proto"
+)
+
+// --- PubSub Validation ---
+// Validators run before messages are forwarded to other relays or passed to our handlers,
+// decoded messages are handed to the handlers through ValidatorData
+
+// validateMeshMessage checks the common requirements of all relay topics.
+// Messages of peers not admitted yet are ignored rather than rejected, admission may still be in progress
+func (r *Relay) validateMeshMessage(from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	// Only accept messages relayed to us by admitted mesh members
+	if !r.AdmissionProtocol.IsAdmitted(from) {
+		slog.Debug("Ignoring PubSub message from non-admitted peer", "peer", from, "topic", msg.GetTopic())
+		return pubsub.ValidationIgnore
+	}
+	if len(msg.Data) == 0 || len(msg.Data) > maxMeshMessageSize {
+		slog.Warn("Rejecting PubSub message with invalid size", "peer", from, "origin", msg.GetFrom(), "topic", msg.GetTopic(), "data_len", len(msg.Data))
+		return pubsub.ValidationReject
+	}
+	return pubsub.ValidationAccept
+}
+
+// validateRoomStateMessage accepts signed room state updates of rooms owned by the publishing relay
+func (r *Relay) validateRoomStateMessage(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if result := r.validateMeshMessage(from, msg); result != pubsub.ValidationAccept {
+		return result
+	}
+
+	var meshMsg gen.MeshMessage
+	if err := proto.Unmarshal(msg.Data, &meshMsg); err != nil {
+		slog.Warn("Rejecting malformed room state message", "peer", from, "origin", msg.GetFrom(), "err", err)
+		return pubsub.ValidationReject
+	}
+	update := meshMsg.GetStateUpdate()
+	if update == nil {
+		slog.Warn("Rejecting unexpected message type on room states topic", "peer", from, "origin", msg.GetFrom())
+		return pubsub.ValidationReject
+	}
+	for name, entity := range update.GetEntities() {
+		state, err := shared.RoomInfoFromProto(entity)
+		if err != nil || state.Name != name {
+			slog.Warn("Rejecting room state update with invalid room", "peer", from, "origin", msg.GetFrom(), "room", name, "err", err)
+			return pubsub.ValidationReject
+		}
+		if state.OwnerID != msg.GetFrom() {
+			slog.Warn("Rejecting room state update for a room not owned by sender", "peer", from, "origin", msg.GetFrom(), "room", name, "owner_id", state.OwnerID)
+			return pubsub.ValidationReject
+		}
+		if err = state.Verify(); err != nil {
+			slog.Warn("Rejecting room state update with invalid signature", "peer", from, "origin", msg.GetFrom(), "room", name, "err", err)
+			return pubsub.ValidationReject
+		}
+	}
+
+	msg.ValidatorData = &meshMsg
+	return pubsub.ValidationAccept
+}
+
+// validateRelayMetricsMessage accepts well-formed relay status of the publishing relay
+func (r *Relay) validateRelayMetricsMessage(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if result := r.validateMeshMessage(from, msg); result != pubsub.ValidationAccept {
+		return result
+	}
+
+	var info RelayInfo
+	if err := json.Unmarshal(msg.Data, &info); err != nil {
+		slog.Warn("Rejecting malformed relay status", "peer", from, "origin", msg.GetFrom(), "err", err)
+		return pubsub.ValidationReject
+	}
+	if info.ID != msg.GetFrom() {
+		slog.Warn("Rejecting relay status with mismatching relay ID", "peer", from, "origin", msg.GetFrom(), "relay_id", info.ID)
+		return pubsub.ValidationReject
+	}
+
+	msg.ValidatorData = &info
+	return pubsub.ValidationAccept
+}
+
+// validateRelayHealthMessage accepts well-formed failure detector messages
+func (r *Relay) validateRelayHealthMessage(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if result := r.validateMeshMessage(from, msg); result != pubsub.ValidationAccept {
+		return result
+	}
+
+	var meshMsg gen.MeshMessage
+	if err := proto.Unmarshal(msg.Data, &meshMsg); err != nil {
+		slog.Warn("Rejecting malformed relay health message", "peer", from, "origin", msg.GetFrom(), "err", err)
+		return pubsub.ValidationReject
+	}
+	var relayID string
+	switch msgType := meshMsg.GetType().(type) {
+	case *gen.MeshMessage_Heartbeat:
+		// Relays only speak for themselves in heartbeats
+		if msgType.Heartbeat.GetRelayId() != msg.GetFrom().String() {
+			slog.Warn("Rejecting heartbeat published for another relay", "peer", from, "origin", msg.GetFrom())
+			return pubsub.ValidationReject
+		}
+		relayID = msgType.Heartbeat.GetRelayId()
+	case *gen.MeshMessage_SuspectRelay:
+		relayID = msgType.SuspectRelay.GetRelayId()
+	case *gen.MeshMessage_Disconnect:
+		relayID = msgType.Disconnect.GetRelayId()
+	default:
+		slog.Warn("Rejecting unexpected message type on relay health topic", "peer", from, "origin", msg.GetFrom())
+		return pubsub.ValidationReject
+	}
+	if _, err := peer.Decode(relayID); err != nil {
+		slog.Warn("Rejecting relay health message with invalid relay ID", "peer", from, "origin", msg.GetFrom(), "err", err)
+		return pubsub.ValidationReject
+	}
+
+	msg.ValidatorData = &meshMsg
+	return pubsub.ValidationAccept
+}
+
+// --- Peer Scoring ---
+
+// peerScoreThresholds are GossipSub score thresholds, relays sending a handful of invalid messages are graylisted
+var peerScoreThresholds = &pubsub.PeerScoreThresholds{
+	GossipThreshold:             -500,
+	PublishThreshold:            -1000,
+	GraylistThreshold:           -2500,
+	AcceptPXThreshold:           100,
+	OpportunisticGraftThreshold: 5,
+}
+
+// peerScoreParams returns GossipSub peer score parameters for our topics
+func (r *Relay) peerScoreParams() *pubsub.PeerScoreParams {
+	topicParams := &pubsub.TopicScoreParams{
+		TopicWeight: 1,
+		// Reward staying in the mesh
+		TimeInMeshWeight:  0.01,
+		TimeInMeshQuantum: time.Second,
+		TimeInMeshCap:     600,
+		// Reward being first to deliver messages
+		FirstMessageDeliveriesWeight: 1,
+		FirstMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(10 * time.Minute),
+		FirstMessageDeliveriesCap:    50,
+		// Penalize invalid messages heavily, the penalty is squared, so 5 reach graylist threshold
+		InvalidMessageDeliveriesWeight: -100,
+		InvalidMessageDeliveriesDecay:  pubsub.ScoreParameterDecay(time.Hour),
+	}
+
+	return &pubsub.PeerScoreParams{
+		// Mesh delivery penalties are left out, our topics are too quiet for them
+		SkipAtomicValidation: true,
+		Topics: map[string]*pubsub.TopicScoreParams{
+			roomStateTopicName:    topicParams,
+			relayMetricsTopicName: topicParams,
+			relayHealthTopicName:  topicParams,
+		},
+		TopicScoreCap: 100,
+		// Peers not admitted to the mesh are graylisted right away
+		AppSpecificScore: func(p peer.ID) float64 {
+			if r.AdmissionProtocol.IsAdmitted(p) {
+				return 0
+			}
+			return peerScoreThresholds.GraylistThreshold * 2
+		},
+		AppSpecificWeight: 1,
+		// Router detected misbehaviour, such as ignored IWANTs or backoff violations
+		BehaviourPenaltyWeight:    -10,
+		BehaviourPenaltyThreshold: 5,
+		BehaviourPenaltyDecay:     pubsub.ScoreParameterDecay(10 * time.Minute),
+		DecayInterval:             pubsub.DefaultDecayInterval,
+		DecayToZero:               pubsub.DefaultDecayToZero,
+		RetainScore:               time.Hour,
+	}
+}
@@ -125,6 +125,58 @@ func (x *ProtoMessageInput) GetData() *ProtoInput {
 	return nil
 }
 
+type ProtoMessageBitrate struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MessageBase   *ProtoMessageBase      `protobuf:"bytes,1,opt,name=message_base,json=messageBase,proto3" json:"message_base,omitempty"`
+	TargetBitrate uint64                 `protobuf:"varint,3,opt,name=target_bitrate,json=targetBitrate,proto3" json:"target_bitrate,omitempty"` // Consolidated target bitrate of all receivers downstream, bits per second
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProtoMessageBitrate) Reset() {
+	*x = ProtoMessageBitrate{}
+	mi := &file_messages_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProtoMessageBitrate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProtoMessageBitrate) ProtoMessage() {}
+
+func (x *ProtoMessageBitrate) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProtoMessageBitrate.ProtoReflect.Descriptor instead.
+func (*ProtoMessageBitrate) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ProtoMessageBitrate) GetMessageBase() *ProtoMessageBase {
+	if x != nil {
+		return x.MessageBase
+	}
+	return nil
+}
+
+func (x *ProtoMessageBitrate) GetTargetBitrate() uint64 {
+	if x != nil {
+		return x.TargetBitrate
+	}
+	return 0
+}
+
 var File_messages_proto protoreflect.FileDescriptor
 
 const file_messages_proto_rawDesc = "" +
@@ -135,7 +187,10 @@ const file_messages_proto_rawDesc = "" +
 	"\alatency\x18\x02 \x01(\v2\x1a.proto.ProtoLatencyTrackerR\alatency\"v\n" +
 	"\x11ProtoMessageInput\x12:\n" +
 	"\fmessage_base\x18\x01 \x01(\v2\x17.proto.ProtoMessageBaseR\vmessageBase\x12%\n" +
-	"\x04data\x18\x02 \x01(\v2\x11.proto.ProtoInputR\x04dataB\x16Z\x14relay/internal/protob\x06proto3"
+	"\x04data\x18\x02 \x01(\v2\x11.proto.ProtoInputR\x04data\"~\n" +
+	"\x13ProtoMessageBitrate\x12:\n" +
+	"\fmessage_base\x18\x01 \x01(\v2\x17.proto.ProtoMessageBaseR\vmessageBase\x12%\n" +
+	"\x0etarget_bitrate\x18\x03 \x01(\x04R\rtargetBitrateJ\x04\b\x02\x10\x03B\x16Z\x14relay/internal/protob\x06proto3"
 
 var (
 	file_messages_proto_rawDescOnce sync.Once
@@ -149,22 +204,24 @@ func file_messages_proto_rawDescGZIP() []byte {
 	return file_messages_proto_rawDescData
 }
 
-var file_messages_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_messages_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
 var file_messages_proto_goTypes = []any{
 	(*ProtoMessageBase)(nil),    // 0: proto.ProtoMessageBase
 	(*ProtoMessageInput)(nil),   // 1: proto.ProtoMessageInput
-	(*ProtoLatencyTracker)(nil), // 2: proto.ProtoLatencyTracker
-	(*ProtoInput)(nil),          // 3: proto.ProtoInput
+	(*ProtoMessageBitrate)(nil), // 2: proto.ProtoMessageBitrate
+	(*ProtoLatencyTracker)(nil), // 3: proto.ProtoLatencyTracker
+	(*ProtoInput)(nil),          // 4: proto.ProtoInput
 }
 var file_messages_proto_depIdxs = []int32{
-	2, // 0: proto.ProtoMessageBase.latency:type_name -> proto.ProtoLatencyTracker
+	3, // 0: proto.ProtoMessageBase.latency:type_name -> proto.ProtoLatencyTracker
 	0, // 1: proto.ProtoMessageInput.message_base:type_name -> proto.ProtoMessageBase
-	3, // 2: proto.ProtoMessageInput.data:type_name -> proto.ProtoInput
-	3, // [3:3] is the sub-list for method output_type
-	3, // [3:3] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	4, // 2: proto.ProtoMessageInput.data:type_name -> proto.ProtoInput
+	0, // 3: proto.ProtoMessageBitrate.message_base:type_name -> proto.ProtoMessageBase
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_messages_proto_init() }
@@ -180,7 +237,7 @@ func file_messages_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_messages_proto_rawDesc), len(file_messages_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   3,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
@@ -28,6 +28,10 @@ type EntityState struct {
 	EntityId      string                 `protobuf:"bytes,2,opt,name=entity_id,json=entityId,proto3" json:"entity_id,omitempty"`               // Unique identifier (e.g., room name)
 	Active        bool                   `protobuf:"varint,3,opt,name=active,proto3" json:"active,omitempty"`                                  // Whether the entity is active
 	OwnerRelayId  string                 `protobuf:"bytes,4,opt,name=owner_relay_id,json=ownerRelayId,proto3" json:"owner_relay_id,omitempty"` // Relay ID that owns this entity
+	Version       uint64                 `protobuf:"varint,5,opt,name=version,proto3" json:"version,omitempty"`                                // Hybrid logical clock timestamp of the owner's latest change
+	Signature     []byte                 `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"`                             // Owner relay's signature over the other fields
+	VideoCodec    string                 `protobuf:"bytes,7,opt,name=video_codec,json=videoCodec,proto3" json:"video_codec,omitempty"`         // MIME type of the room video codec, empty while unknown
+	AudioCodec    string                 `protobuf:"bytes,8,opt,name=audio_codec,json=audioCodec,proto3" json:"audio_codec,omitempty"`         // MIME type of the room audio codec, empty while unknown
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -90,17 +94,51 @@ func (x *EntityState) GetOwnerRelayId() string {
 	return ""
 }
 
+func (x *EntityState) GetVersion() uint64 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *EntityState) GetSignature() []byte {
+	if x != nil {
+		return x.Signature
+	}
+	return nil
+}
+
+func (x *EntityState) GetVideoCodec() string {
+	if x != nil {
+		return x.VideoCodec
+	}
+	return ""
+}
+
+func (x *EntityState) GetAudioCodec() string {
+	if x != nil {
+		return x.AudioCodec
+	}
+	return ""
+}
+
 var File_state_proto protoreflect.FileDescriptor
 
 const file_state_proto_rawDesc = "" +
 	"\n" +
-	"\vstate.proto\x12\x05proto\"\x89\x01\n" +
+	"\vstate.proto\x12\x05proto\"\x83\x02\n" +
 	"\vEntityState\x12\x1f\n" +
 	"\ventity_type\x18\x01 \x01(\tR\n" +
 	"entityType\x12\x1b\n" +
 	"\tentity_id\x18\x02 \x01(\tR\bentityId\x12\x16\n" +
 	"\x06active\x18\x03 \x01(\bR\x06active\x12$\n" +
-	"\x0eowner_relay_id\x18\x04 \x01(\tR\fownerRelayIdB\x16Z\x14relay/internal/protob\x06proto3"
+	"\x0eowner_relay_id\x18\x04 \x01(\tR\fownerRelayId\x12\x18\n" +
+	"\aversion\x18\x05 \x01(\x04R\aversion\x12\x1c\n" +
+	"\tsignature\x18\x06 \x01(\fR\tsignature\x12\x1f\n" +
+	"\vvideo_codec\x18\a \x01(\tR\n" +
+	"videoCodec\x12\x1f\n" +
+	"\vaudio_codec\x18\b \x01(\tR\n" +
+	"audioCodecB\x16Z\x14relay/internal/protob\x06proto3"
 
 var (
 	file_state_proto_rawDescOnce sync.Once
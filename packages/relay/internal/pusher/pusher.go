@@ -0,0 +1,352 @@
+package pusher
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"relay/internal/common"
+	"relay/internal/connections"
+	"sync"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	ws "github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Push Client ---
+// A pusher pushes a room stream to a relay like a runner does, for tools feeding relays without a runner.
+// Tracks are added before starting, the push is negotiated once started
+
+const (
+	protocolStreamPush = "/nestri-relay/stream-push/1.0.0" // Stream push protocol of relays
+)
+
+// RedirectError is returned when the relay refuses the push because another relay owns the room
+type RedirectError struct {
+	Room    string   `json:"room"`
+	RelayID string   `json:"relay_id"`
+	Addrs   []string `json:"addrs,omitempty"`
+}
+
+func (e *RedirectError) Error() string {
+	return fmt.Sprintf("room %s is owned by relay %s", e.Room, e.RelayID)
+}
+
+// Pusher is a stream push of a room to a relay
+type Pusher struct {
+	Room string
+
+	host      host.Host
+	stream    network.Stream
+	safeBRW   *common.SafeBufioRW
+	pc        *webrtc.PeerConnection
+	connected chan struct{}
+	accepted  chan error // Answer of the relay to the room claim
+	failed    chan error // Rejection of the relay after accepting the room
+
+	// Relays take candidates once they have the offer, as sent by runners
+	candidateMutex    sync.Mutex
+	offerSent         bool
+	pendingCandidates []webrtc.ICECandidateInit
+	done              chan struct{}
+	closeOnce         sync.Once
+}
+
+// New connects to the relay at given multiaddr, which must include its peer ID, to push a room stream
+func New(ctx context.Context, relayAddr string, roomName string) (*Pusher, error) {
+	addr, err := multiaddr.NewMultiaddr(relayAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse relay address: %w", err)
+	}
+	relayInfo, err := peer.AddrInfoFromP2pAddr(addr)
+	if err != nil {
+		return nil, fmt.Errorf("relay address lacks peer ID: %w", err)
+	}
+
+	p2pHost, err := libp2p.New(
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Transport(ws.New),
+		libp2p.Security(noise.ID, noise.New),
+		libp2p.NoListenAddrs,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create libp2p host: %w", err)
+	}
+	if err = p2pHost.Connect(ctx, *relayInfo); err != nil {
+		_ = p2pHost.Close()
+		return nil, fmt.Errorf("failed to connect to relay: %w", err)
+	}
+	stream, err := p2pHost.NewStream(ctx, relayInfo.ID, protocolStreamPush)
+	if err != nil {
+		_ = p2pHost.Close()
+		return nil, fmt.Errorf("failed to open stream push: %w", err)
+	}
+
+	pc, err := newPeerConnection()
+	if err != nil {
+		_ = stream.Reset()
+		_ = p2pHost.Close()
+		return nil, fmt.Errorf("failed to create PeerConnection: %w", err)
+	}
+
+	p := &Pusher{
+		Room:      roomName,
+		host:      p2pHost,
+		stream:    stream,
+		safeBRW:   common.NewSafeBufioRW(bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))),
+		pc:        pc,
+		connected: make(chan struct{}),
+		accepted:  make(chan error, 1),
+		failed:    make(chan error, 1),
+		done:      make(chan struct{}),
+	}
+	var connectedOnce sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		slog.Debug("Stream push connection state changed", "room", roomName, "state", state.String())
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			connectedOnce.Do(func() { close(p.connected) })
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateClosed:
+			_ = p.Close()
+		}
+	})
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		p.candidateMutex.Lock()
+		defer p.candidateMutex.Unlock()
+		if !p.offerSent {
+			p.pendingCandidates = append(p.pendingCandidates, candidate.ToJSON())
+			return
+		}
+		p.sendCandidate(candidate.ToJSON())
+	})
+	return p, nil
+}
+
+// newPeerConnection creates a PeerConnection offering the codecs and extensions relays accept from runners
+func newPeerConnection() (*webrtc.PeerConnection, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := common.RegisterCodecs(mediaEngine); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureSimulcastExtensionHeaders(mediaEngine); err != nil {
+		return nil, err
+	}
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+	settingEngine := webrtc.SettingEngine{}
+	settingEngine.SetIncludeLoopbackCandidate(true)
+
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithSettingEngine(settingEngine))
+	return api.NewPeerConnection(webrtc.Configuration{SDPSemantics: webrtc.SDPSemanticsUnifiedPlan})
+}
+
+// AddTrack adds a track to push, tracks must be added before starting
+func (p *Pusher) AddTrack(track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	return p.pc.AddTrack(track)
+}
+
+// CreateDataChannel creates the data channel relays forward participant input and bitrate hints on,
+// set up like runners do. It must be created before starting
+func (p *Pusher) CreateDataChannel() (*connections.NestriDataChannel, error) {
+	settingOrdered := true
+	settingMaxRetransmits := uint16(2)
+	dc, err := p.pc.CreateDataChannel("data", &webrtc.DataChannelInit{
+		Ordered:        &settingOrdered,
+		MaxRetransmits: &settingMaxRetransmits,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return connections.NewNestriDataChannel(dc), nil
+}
+
+// Mid returns the negotiated media ID of a sender, empty before the push is started
+func (p *Pusher) Mid(sender *webrtc.RTPSender) string {
+	for _, transceiver := range p.pc.GetTransceivers() {
+		if transceiver.Sender() == sender {
+			return transceiver.Mid()
+		}
+	}
+	return ""
+}
+
+// Start claims the room on the relay and negotiates the push, returning once media can flow
+func (p *Pusher) Start(ctx context.Context) error {
+	roomData, err := json.Marshal(p.Room)
+	if err != nil {
+		return fmt.Errorf("failed to marshal room name: %w", err)
+	}
+	if err = p.safeBRW.SendJSON(connections.NewMessageRaw("push-stream-room", roomData)); err != nil {
+		return fmt.Errorf("failed to send room: %w", err)
+	}
+
+	go p.handleMessages()
+
+	select {
+	case err = <-p.accepted:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err = p.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	p.candidateMutex.Lock()
+	err = p.safeBRW.SendJSON(connections.NewMessageSDP("offer", offer))
+	p.offerSent = true
+	for _, candidate := range p.pendingCandidates {
+		p.sendCandidate(candidate)
+	}
+	p.pendingCandidates = nil
+	p.candidateMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to send offer: %w", err)
+	}
+
+	select {
+	case <-p.connected:
+		slog.Info("Pushing room stream to relay", "room", p.Room, "relay", p.stream.Conn().RemotePeer())
+		return nil
+	case err = <-p.failed:
+		return err
+	case <-p.done:
+		return errors.New("stream push closed before connecting")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendCandidate sends a local ICE candidate to the relay
+func (p *Pusher) sendCandidate(candidate webrtc.ICECandidateInit) {
+	if err := p.safeBRW.SendJSON(connections.NewMessageICE("ice-candidate", candidate)); err != nil {
+		slog.Error("Failed to send ICE candidate for stream push", "room", p.Room, "err", err)
+	}
+}
+
+// handleMessages handles signaling from the relay until the push ends
+func (p *Pusher) handleMessages() {
+	defer func() {
+		_ = p.Close()
+	}()
+
+	iceHolder := make([]webrtc.ICECandidateInit, 0)
+	for {
+		data, err := p.safeBRW.Receive()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, network.ErrReset) {
+				slog.Error("Failed to receive data for stream push", "room", p.Room, "err", err)
+			}
+			report(p.accepted, errors.New("relay closed the stream push"))
+			return
+		}
+
+		var rawMsg connections.MessageRaw
+		if err = json.Unmarshal(data, &rawMsg); err != nil {
+			slog.Error("Failed to unmarshal message for stream push", "room", p.Room, "err", err)
+			continue
+		}
+
+		switch rawMsg.Type {
+		case "push-stream-ok":
+			report(p.accepted, nil)
+		case "push-stream-redirect":
+			redirect := &RedirectError{}
+			if err = json.Unmarshal(rawMsg.Data, redirect); err != nil {
+				slog.Error("Failed to unmarshal push redirect", "room", p.Room, "err", err)
+			}
+			report(p.accepted, redirect)
+			return
+		case "push-stream-error":
+			var streamErr struct {
+				Error string `json:"error"`
+			}
+			if err = json.Unmarshal(rawMsg.Data, &streamErr); err != nil {
+				slog.Error("Failed to unmarshal push error", "room", p.Room, "err", err)
+			}
+			slog.Error("Relay rejected stream push", "room", p.Room, "err", streamErr.Error)
+			report(p.failed, fmt.Errorf("relay rejected stream push: %s", streamErr.Error))
+			return
+		case "answer":
+			var answerMsg connections.MessageSDP
+			if err = json.Unmarshal(data, &answerMsg); err != nil {
+				slog.Error("Failed to unmarshal answer for stream push", "room", p.Room, "err", err)
+				continue
+			}
+			if err = p.pc.SetRemoteDescription(answerMsg.SDP); err != nil {
+				slog.Error("Failed to set remote description for stream push", "room", p.Room, "err", err)
+				return
+			}
+			for _, heldIce := range iceHolder {
+				if err = p.pc.AddICECandidate(heldIce); err != nil {
+					slog.Error("Failed to add held ICE candidate for stream push", "room", p.Room, "err", err)
+				}
+			}
+			iceHolder = make([]webrtc.ICECandidateInit, 0)
+		case "ice-candidate":
+			var iceMsg connections.MessageICE
+			if err = json.Unmarshal(data, &iceMsg); err != nil {
+				slog.Error("Failed to unmarshal ICE candidate for stream push", "room", p.Room, "err", err)
+				continue
+			}
+			if p.pc.RemoteDescription() == nil {
+				// Hold the candidate until remote description is set
+				iceHolder = append(iceHolder, iceMsg.Candidate)
+			} else if err = p.pc.AddICECandidate(iceMsg.Candidate); err != nil {
+				slog.Error("Failed to add ICE candidate for stream push", "room", p.Room, "err", err)
+			}
+		default:
+			slog.Debug("Ignoring stream push message", "room", p.Room, "type", rawMsg.Type)
+		}
+	}
+}
+
+// report sends an outcome of the push to Start, unless one is pending already
+func report(outcome chan<- error, err error) {
+	select {
+	case outcome <- err:
+	default:
+	}
+}
+
+// Done is closed once the push ended
+func (p *Pusher) Done() <-chan struct{} {
+	return p.done
+}
+
+// Close ends the push
+func (p *Pusher) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.done)
+		err = p.pc.Close()
+		_ = p.stream.Close()
+		if hostErr := p.host.Close(); err == nil {
+			err = hostErr
+		}
+	})
+	return err
+}
@@ -0,0 +1,313 @@
+package shared
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Capture ---
+// A capture keeps the raw RTP and RTCP a relay receives for a room, before any rewriting, with arrival times.
+// The file starts with captureMagic, followed by records of a type byte, a capture track ID byte, the arrival
+// offset from the capture start in nanoseconds (uint64) and the data length (uint32), all big endian, then the data.
+// The first record holds the CaptureInfo as JSON, each track gets a record with its CaptureTrack as JSON
+// before its first packet
+
+const (
+	captureMagic       = "NRTPCAP1"
+	captureHeaderSize  = 1 + 1 + 8 + 4
+	captureMaxDataSize = 1 << 20 // Largest record data accepted when reading, in bytes
+)
+
+// Capture record types
+const (
+	CaptureRecordInfo    byte = iota // CaptureInfo as JSON
+	CaptureRecordTrack               // CaptureTrack as JSON
+	CaptureRecordRTP                 // RTP packet received on a track
+	CaptureRecordRTCPIn              // Compound RTCP packet received from upstream
+	CaptureRecordRTCPOut             // Compound RTCP packet sent upstream
+)
+
+// CaptureInfo describes a capture
+type CaptureInfo struct {
+	Room      string    `json:"room"`
+	RelayID   string    `json:"relay_id"`
+	StartedAt time.Time `json:"started_at"` // Wall clock time of offset zero
+}
+
+// CaptureTrack describes a captured upstream track
+type CaptureTrack struct {
+	ID          uint8  `json:"id"` // Capture track ID, starting from 1
+	Kind        string `json:"kind"`
+	MimeType    string `json:"mime_type"`
+	ClockRate   uint32 `json:"clock_rate"`
+	Channels    uint16 `json:"channels,omitempty"`
+	SDPFmtpLine string `json:"sdp_fmtp_line,omitempty"`
+	PayloadType uint8  `json:"payload_type"`
+	RID         string `json:"rid,omitempty"` // Simulcast layer, empty without simulcast
+}
+
+// Codec returns the codec capability of the captured track
+func (t *CaptureTrack) Codec() webrtc.RTPCodecCapability {
+	return webrtc.RTPCodecCapability{
+		MimeType:    t.MimeType,
+		ClockRate:   t.ClockRate,
+		Channels:    t.Channels,
+		SDPFmtpLine: t.SDPFmtpLine,
+	}
+}
+
+// CaptureRecord is a record read from a capture file
+type CaptureRecord struct {
+	Type   byte
+	Track  uint8         // Capture track ID, 0 if not related to a track
+	Offset time.Duration // Arrival time since the capture start
+	Data   []byte
+}
+
+// Capture writes upstream packets of a room to a capture file
+type Capture struct {
+	mutex     sync.Mutex
+	path      string
+	file      *os.File
+	writer    *bufio.Writer
+	startedAt time.Time
+	tracks    map[*webrtc.TrackRemote]uint8
+	closed    bool
+}
+
+// NewCapture creates a capture file for a room in given directory, as the relay with given ID
+func NewCapture(roomName string, dir string, relayID string) (*Capture, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create capture directory: %w", err)
+	}
+	startedAt := time.Now().UTC()
+	path := filepath.Join(dir, recordingFileName(roomName)+"-"+startedAt.Format("20060102-150405")+".rtpcap")
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	c := &Capture{
+		path:      path,
+		file:      file,
+		writer:    bufio.NewWriter(file),
+		startedAt: startedAt,
+		tracks:    make(map[*webrtc.TrackRemote]uint8),
+	}
+	infoData, err := json.Marshal(CaptureInfo{Room: roomName, RelayID: relayID, StartedAt: startedAt})
+	if err == nil {
+		_, err = c.writer.WriteString(captureMagic)
+	}
+	if err == nil {
+		err = c.writeRecord(CaptureRecordInfo, 0, 0, infoData)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to write capture header: %w", err)
+	}
+	slog.Info("Started capturing room", "room", roomName, "path", path)
+	return c, nil
+}
+
+// Path returns the path of the capture file
+func (c *Capture) Path() string {
+	return c.path
+}
+
+// WriteRTP captures an RTP packet received on an upstream track
+func (c *Capture) WriteRTP(track *webrtc.TrackRemote, packet *rtp.Packet) {
+	data, err := packet.Marshal()
+	if err != nil {
+		slog.Error("Failed to marshal captured RTP packet", "path", c.path, "err", err)
+		return
+	}
+	c.write(CaptureRecordRTP, track, data)
+}
+
+// WriteRTCP captures RTCP packets received from upstream, or sent upstream if outbound, for a track if known
+func (c *Capture) WriteRTCP(track *webrtc.TrackRemote, packets []rtcp.Packet, outbound bool) {
+	data, err := rtcp.Marshal(packets)
+	if err != nil {
+		slog.Error("Failed to marshal captured RTCP packets", "path", c.path, "err", err)
+		return
+	}
+	recordType := CaptureRecordRTCPIn
+	if outbound {
+		recordType = CaptureRecordRTCPOut
+	}
+	c.write(recordType, track, data)
+}
+
+// Close finishes the capture file
+func (c *Capture) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	err := c.writer.Flush()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	slog.Info("Stopped capturing room", "path", c.path)
+	return err
+}
+
+func (c *Capture) write(recordType byte, track *webrtc.TrackRemote, data []byte) {
+	offset := time.Since(c.startedAt)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	trackID, err := c.trackID(track, offset)
+	if err == nil {
+		err = c.writeRecord(recordType, trackID, offset, data)
+	}
+	if err != nil {
+		slog.Error("Failed to write capture record", "path", c.path, "err", err)
+	}
+}
+
+// trackID returns the capture track ID of a track, describing it first if new. mutex must be held
+func (c *Capture) trackID(track *webrtc.TrackRemote, offset time.Duration) (uint8, error) {
+	if track == nil {
+		return 0, nil
+	}
+	if id, ok := c.tracks[track]; ok {
+		return id, nil
+	}
+	if len(c.tracks) >= 255 {
+		return 0, errors.New("too many captured tracks")
+	}
+
+	codec := track.Codec()
+	description := CaptureTrack{
+		ID:          uint8(len(c.tracks) + 1),
+		Kind:        track.Kind().String(),
+		MimeType:    codec.MimeType,
+		ClockRate:   codec.ClockRate,
+		Channels:    codec.Channels,
+		SDPFmtpLine: codec.SDPFmtpLine,
+		PayloadType: uint8(track.PayloadType()),
+		RID:         track.RID(),
+	}
+	data, err := json.Marshal(description)
+	if err != nil {
+		return 0, err
+	}
+	if err = c.writeRecord(CaptureRecordTrack, description.ID, offset, data); err != nil {
+		return 0, err
+	}
+	c.tracks[track] = description.ID
+	return description.ID, nil
+}
+
+// writeRecord writes a record to the capture file. mutex must be held
+func (c *Capture) writeRecord(recordType byte, trackID uint8, offset time.Duration, data []byte) error {
+	var header [captureHeaderSize]byte
+	header[0] = recordType
+	header[1] = trackID
+	binary.BigEndian.PutUint64(header[2:], uint64(max(offset, 0)))
+	binary.BigEndian.PutUint32(header[10:], uint32(len(data)))
+	if _, err := c.writer.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.writer.Write(data); err != nil {
+		return err
+	}
+	// Descriptions are rare, make sure they're on disk with what came before
+	if recordType == CaptureRecordInfo || recordType == CaptureRecordTrack {
+		return c.writer.Flush()
+	}
+	return nil
+}
+
+// --- Capture Reading ---
+
+// CaptureReader reads records of a capture file in order
+type CaptureReader struct {
+	Info CaptureInfo
+
+	file   *os.File
+	reader *bufio.Reader
+}
+
+// OpenCapture opens a capture file, reading its info
+func OpenCapture(path string) (*CaptureReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %w", err)
+	}
+	r := &CaptureReader{
+		file:   file,
+		reader: bufio.NewReader(file),
+	}
+
+	magic := make([]byte, len(captureMagic))
+	if _, err = io.ReadFull(r.reader, magic); err != nil || string(magic) != captureMagic {
+		_ = file.Close()
+		return nil, errors.New("not a capture file")
+	}
+	record, err := r.Next()
+	if err == nil && record.Type != CaptureRecordInfo {
+		err = errors.New("capture file does not start with its info")
+	}
+	if err == nil {
+		err = json.Unmarshal(record.Data, &r.Info)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to read capture info: %w", err)
+	}
+	return r, nil
+}
+
+// Next returns the next record, io.EOF at the end of the capture.
+// Captures of a relay that didn't shut down cleanly may end with a partial record, which reads as io.EOF too
+func (r *CaptureReader) Next() (*CaptureRecord, error) {
+	var header [captureHeaderSize]byte
+	if _, err := io.ReadFull(r.reader, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[10:])
+	if length > captureMaxDataSize {
+		return nil, fmt.Errorf("capture record of %d bytes is too large", length)
+	}
+	record := &CaptureRecord{
+		Type:   header[0],
+		Track:  header[1],
+		Offset: time.Duration(binary.BigEndian.Uint64(header[2:])),
+		Data:   make([]byte, length),
+	}
+	if _, err := io.ReadFull(r.reader, record.Data); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// Close closes the capture file
+func (r *CaptureReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,250 @@
+package shared
+
+import (
+	"log/slog"
+	"relay/internal/common"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// --- Video Layers ---
+// Rooms pushed with simulcast have a local track per encoding (RID). Instead of the shared room video track,
+// each receiver gets its own video track, fed from the layer fitting its bandwidth estimate
+
+const (
+	layerBitrateWindow   = time.Second // How often the bitrate of a layer is measured
+	layerHeadroom        = 0.85        // Share of the estimate a selected layer may use
+	layerLossDecrease    = 26          // Fraction lost (out of 256) over which the receiver estimate decreases, ~10%
+	layerLossIncrease    = 5           // Fraction lost (out of 256) under which the receiver estimate increases, ~2%
+	layerEstimateDecay   = 0.85        // Estimate multiplier on heavy loss
+	layerEstimateGrowth  = 1.08        // Estimate multiplier on low loss
+	layerMinimumEstimate = 50_000      // Lowest receiver estimate, bits per second
+)
+
+const (
+	layerProbeRatio    = 1.4              // Estimate over the forwarded layer bitrate at which the next layer up is tried
+	layerProbeInterval = 10 * time.Second // Least time between layer switches before trying the next layer up
+)
+
+// VideoLayer is a simulcast encoding of a room's video
+type VideoLayer struct {
+	RID   string
+	Track *webrtc.TrackLocalStaticRTP
+
+	mutex       sync.Mutex
+	bitrate     uint64 // measured bitrate, bits per second
+	windowBytes uint64
+	windowStart time.Time
+}
+
+// CountPacket accounts a received packet to the measured bitrate of the layer
+func (l *VideoLayer) CountPacket(packet *rtp.Packet) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if l.windowStart.IsZero() {
+		l.windowStart = now
+	}
+	l.windowBytes += uint64(packet.MarshalSize())
+	if elapsed := now.Sub(l.windowStart); elapsed >= layerBitrateWindow {
+		l.bitrate = uint64(float64(l.windowBytes*8) / elapsed.Seconds())
+		l.windowBytes = 0
+		l.windowStart = now
+	}
+}
+
+// Bitrate returns the measured bitrate of the layer in bits per second, 0 if not measured yet
+func (l *VideoLayer) Bitrate() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.bitrate
+}
+
+// LayerForwarder feeds a receiver's own video track from the room video layer fitting its bandwidth.
+// The estimate comes from the send-side bandwidth estimator, REMB of the receiver, or is derived from its
+// reported packet loss. Send-side estimates don't grow far past what is sent, so layers are stepped down only
+// when the estimate drops, and the next layer up is tried once the estimate has stayed clear of the current one.
+// A selected layer is forwarded from its next keyframe on, the previous layer is forwarded until then
+type LayerForwarder struct {
+	Track *webrtc.TrackLocalStaticRTP
+
+	writer          common.TrackWriter
+	rewriter        *common.RTPRewriter
+	layers          func() []*VideoLayer
+	requestKeyframe func(rid string)
+
+	mutex      sync.Mutex
+	rid        string    // RID of the forwarded layer
+	target     string    // RID of the selected layer, forwarded once its keyframe arrives
+	estimate   uint64    // bandwidth estimate of the receiver in bits per second, 0 if unknown
+	switchedAt time.Time // when the selected layer last changed
+}
+
+func NewLayerForwarder(track *webrtc.TrackLocalStaticRTP, writer common.TrackWriter, layers func() []*VideoLayer, requestKeyframe func(rid string)) *LayerForwarder {
+	f := &LayerForwarder{
+		Track:           track,
+		writer:          writer,
+		rewriter:        common.NewRTPRewriter(track.Codec().ClockRate),
+		layers:          layers,
+		requestKeyframe: requestKeyframe,
+	}
+	f.selectLayer(false)
+	return f
+}
+
+// Selected returns the RID of the layer forwarded to the receiver, or of the selected one if none is forwarded yet
+func (f *LayerForwarder) Selected() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.rid) == 0 {
+		return f.target
+	}
+	return f.rid
+}
+
+// Forward writes a packet of given layer to the receiver's track, if that layer is forwarded to the receiver.
+// The first keyframe of a newly selected layer switches forwarding over to it
+func (f *LayerForwarder) Forward(rid string, packet *rtp.Packet) error {
+	// Held while writing, so no packet of the previous layer follows the switch
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if rid != f.rid {
+		if rid != f.target || !common.IsKeyframeStart(f.Track.Codec().MimeType, packet.Payload) {
+			return nil
+		}
+		slog.Debug("Forwarding video layer to receiver from keyframe", "from", f.rid, "to", rid)
+		f.rid = rid
+		// Layers have their own sequence numbers and timestamps
+		f.rewriter.SwitchSource()
+	}
+
+	// Packet is shared by all receivers, rewrite a copy
+	out := packet.Clone()
+	f.rewriter.Rewrite(out)
+	return f.writer.WriteRTP(f.Track, out)
+}
+
+// SetEstimate sets the bandwidth estimate of the receiver, selecting the layer fitting it
+func (f *LayerForwarder) SetEstimate(bitrate uint64) {
+	bitrate = max(bitrate, layerMinimumEstimate)
+	f.mutex.Lock()
+	// The first estimate counts as a drop, the receiver may not keep up with the layer it got meanwhile
+	dropped := f.estimate == 0 || bitrate < f.estimate
+	f.estimate = bitrate
+	f.mutex.Unlock()
+	f.selectLayer(dropped)
+}
+
+// HandleRTCP updates the receiver estimate from RTCP sent by the receiver
+func (f *LayerForwarder) HandleRTCP(packets []rtcp.Packet) {
+	for _, packet := range packets {
+		switch pkt := packet.(type) {
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			f.SetEstimate(uint64(pkt.Bitrate))
+		case *rtcp.ReceiverReport:
+			for _, report := range pkt.Reports {
+				f.onLoss(report.FractionLost)
+			}
+		}
+	}
+}
+
+// onLoss adjusts the receiver estimate on reported loss, backing off from the current layer on heavy loss
+func (f *LayerForwarder) onLoss(fractionLost uint8) {
+	f.mutex.Lock()
+	estimate := f.estimate
+	current := f.rid
+	f.mutex.Unlock()
+
+	switch {
+	case fractionLost > layerLossDecrease:
+		if estimate == 0 {
+			// No estimate yet, start from the layer the receiver can't keep up with
+			for _, layer := range f.layers() {
+				if layer.RID == current {
+					estimate = layer.Bitrate()
+				}
+			}
+		}
+		estimate = uint64(float64(estimate) * layerEstimateDecay)
+	case fractionLost < layerLossIncrease && estimate != 0:
+		estimate = uint64(float64(estimate) * layerEstimateGrowth)
+	default:
+		return
+	}
+	if estimate == 0 {
+		return
+	}
+	f.SetEstimate(estimate)
+}
+
+// selectLayer selects the layer fitting the receiver estimate, the lowest layer if none fits.
+// A forwarded layer over the estimate is only left when the estimate dropped
+func (f *LayerForwarder) selectLayer(dropped bool) {
+	layers := f.layers()
+	if len(layers) == 0 {
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	current := slices.IndexFunc(layers, func(layer *VideoLayer) bool { return layer.RID == f.target })
+	selected := current
+	if f.estimate == 0 {
+		// Without an estimate receivers get the best quality, as they did before simulcast
+		selected = len(layers) - 1
+	} else {
+		fitting := 0
+		budget := uint64(float64(f.estimate) * layerHeadroom)
+		for i, layer := range layers {
+			if layer.Bitrate() <= budget {
+				fitting = i
+			}
+		}
+		switch {
+		case current < 0, fitting > current, fitting < current && dropped:
+			selected = fitting
+		case fitting == current && current < len(layers)-1 &&
+			float64(f.estimate) >= float64(layers[current].Bitrate())*layerProbeRatio &&
+			time.Since(f.switchedAt) >= layerProbeInterval:
+			// Estimate is clear of the current layer, see if the receiver keeps up with the next one
+			selected = current + 1
+		}
+	}
+
+	if selected != current {
+		slog.Debug("Switching video layer for receiver", "from", f.target, "to", layers[selected].RID, "estimate", f.estimate)
+		f.target = layers[selected].RID
+		f.switchedAt = time.Now()
+		// Forwarding switches at the next keyframe of the new layer
+		if f.requestKeyframe != nil {
+			go f.requestKeyframe(f.target)
+		}
+	}
+}
+
+// sortLayers sorts layers by measured bitrate, lowest first
+func sortLayers(layers []*VideoLayer) {
+	slices.SortFunc(layers, func(a, b *VideoLayer) int {
+		if a.Bitrate() != b.Bitrate() {
+			if a.Bitrate() < b.Bitrate() {
+				return -1
+			}
+			return 1
+		}
+		// Not measured yet, keep RID order stable
+		if a.RID < b.RID {
+			return -1
+		} else if a.RID > b.RID {
+			return 1
+		}
+		return 0
+	})
+}
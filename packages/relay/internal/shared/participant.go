@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"relay/internal/common"
 	"relay/internal/connections"
+	"sync/atomic"
 
 	"github.com/oklog/ulid/v2"
 	"github.com/pion/webrtc/v4"
@@ -13,32 +14,126 @@ type Participant struct {
 	ID             ulid.ULID
 	PeerConnection *webrtc.PeerConnection
 	DataChannel    *connections.NestriDataChannel
+	SafeBRW        *common.SafeBufioRW // Signaling stream of the participant
+
+	senders        *common.SafeMap[webrtc.RTPCodecType, *webrtc.RTPSender]
+	layerForwarder atomic.Pointer[LayerForwarder] // Video layer forwarder of the participant, nil without simulcast
+	transportCC    atomic.Bool                    // Whether the participant sends TWCC feedback, making send-side estimates usable
+
+	onKeyframeRequest func(rid string) // Asks the room for a keyframe upstream
 }
 
-func NewParticipant() (*Participant, error) {
+func NewParticipant(safeBRW *common.SafeBufioRW) (*Participant, error) {
 	id, err := common.NewULID()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create ULID for Participant: %w", err)
 	}
 	return &Participant{
-		ID: id,
+		ID:      id,
+		SafeBRW: safeBRW,
+		senders: common.NewSafeMap[webrtc.RTPCodecType, *webrtc.RTPSender](),
 	}, nil
 }
 
-func (p *Participant) addTrack(trackLocal *webrtc.TrackLocalStaticRTP) error {
+// setTrack sends the given track to participant, replacing the previously sent track of same kind if any
+func (p *Participant) setTrack(kind webrtc.RTPCodecType, trackLocal *webrtc.TrackLocalStaticRTP) error {
+	if sender, ok := p.senders.Get(kind); ok {
+		if sender.Track() == trackLocal {
+			return nil
+		}
+		if err := sender.ReplaceTrack(trackLocal); err == nil {
+			return nil
+		}
+		// Codec most likely changed, fall back to a new sender
+		if err := p.PeerConnection.RemoveTrack(sender); err != nil {
+			return err
+		}
+		p.senders.Delete(kind)
+	}
+	return p.addTrack(kind, trackLocal)
+}
+
+func (p *Participant) addTrack(kind webrtc.RTPCodecType, trackLocal *webrtc.TrackLocalStaticRTP) error {
 	rtpSender, err := p.PeerConnection.AddTrack(trackLocal)
 	if err != nil {
 		return err
 	}
+	p.senders.Set(kind, rtpSender)
 
 	go func() {
-		rtcpBuffer := make([]byte, 1400)
+		received := false
 		for {
-			if _, _, rtcpErr := rtpSender.Read(rtcpBuffer); rtcpErr != nil {
+			packets, _, rtcpErr := rtpSender.ReadRTCP()
+			if rtcpErr != nil {
 				break
 			}
+			// Participant joining mid-stream can't decode until a keyframe, ask for one once it reports receiving
+			if kind == webrtc.RTPCodecTypeVideo && (!received || HasKeyframeRequest(packets)) {
+				received = true
+				p.requestKeyframe()
+			}
+			// Receivers sending TWCC feedback are estimated send-side, others by their REMB and loss reports
+			if HasTransportCC(packets) {
+				p.transportCC.Store(true)
+			}
+			if forwarder := p.layerForwarder.Load(); forwarder != nil && kind == webrtc.RTPCodecTypeVideo && !p.transportCC.Load() {
+				forwarder.HandleRTCP(packets)
+			}
 		}
 	}()
 
 	return nil
 }
+
+// requestKeyframe asks for a keyframe of the video layer forwarded to the participant
+func (p *Participant) requestKeyframe() {
+	if p.onKeyframeRequest == nil {
+		return
+	}
+	rid := ""
+	if forwarder := p.layerForwarder.Load(); forwarder != nil {
+		rid = forwarder.Selected()
+	}
+	p.onKeyframeRequest(rid)
+}
+
+// UpdateBandwidth feeds the send-side bandwidth estimate of the participant, from the WebRTC API its
+// PeerConnection was created with, to its video layer forwarder.
+// Returns the estimate in bits per second, 0 while the participant sends no TWCC feedback
+func (p *Participant) UpdateBandwidth(webRTC *common.WebRTCAPI) uint64 {
+	if p.PeerConnection == nil || !p.transportCC.Load() {
+		return 0
+	}
+	estimate := webRTC.TargetBitrate(p.PeerConnection)
+	if forwarder := p.layerForwarder.Load(); forwarder != nil && estimate > 0 {
+		forwarder.SetEstimate(estimate)
+	}
+	return estimate
+}
+
+// signalOffer creates a new offer for the participant and sends it over the signaling stream
+func (p *Participant) signalOffer() error {
+	if p.PeerConnection == nil || p.SafeBRW == nil {
+		return fmt.Errorf("participant %s has no PeerConnection or signaling stream", p.ID)
+	}
+
+	offer, err := p.PeerConnection.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	if err = p.PeerConnection.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	if offer, err = common.WithoutFEC(offer); err != nil {
+		return fmt.Errorf("failed to strip FEC of offer: %w", err)
+	}
+	return p.SafeBRW.SendJSON(connections.NewMessageSDP("offer", offer))
+}
+
+// Close closes the participant's PeerConnection
+func (p *Participant) Close() error {
+	if p.PeerConnection == nil {
+		return nil
+	}
+	return p.PeerConnection.Close()
+}
@@ -0,0 +1,750 @@
+package shared
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/av1"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/bluenviron/mediacommon/pkg/codecs/vp9"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4"
+	"github.com/bluenviron/mediacommon/pkg/formats/fmp4/seekablebuffer"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// --- Recording ---
+// A recorder receives a room like a participant would, writing its stream to disk instead of sending it.
+// Each pair of room codecs gets a fragmented MP4, a new one is started when the runner comes back with other codecs.
+// Every fragment starts with a producer reference time box, mapping media time to the relay wall clock,
+// so moments in a recording can be matched with bug reports of players. The sidecar JSON lists the files with
+// the wall clock time of their media time zero. VP8 has no fMP4 sample entry here, it goes into an IVF file
+// next to an audio only fMP4. Files are written from a goroutine of their own, a slow disk drops recorded
+// packets instead of stalling forwarding to the room's receivers
+
+const (
+	recordingFragmentDuration = 2 * time.Second // Media time covered by each fMP4 fragment
+	recordingTrackCheck       = time.Second     // How often room tracks are checked for replacement
+	recordingMaxLate          = 512             // Packets a sample waits for reordered or retransmitted packets
+	recordingOpusChannels     = 2
+	recordingPacketBuffer     = 2048 // Packets waiting to be written before new ones are dropped
+	recordingDropLogInterval  = 1000 // Dropped packets between warnings
+)
+
+// fMP4 track IDs
+const (
+	recordingVideoTrackID = 1
+	recordingAudioTrackID = 2
+)
+
+// RecordingInfo describes a recording, stored as JSON next to its media files
+type RecordingInfo struct {
+	Room      string          `json:"room"`
+	RelayID   string          `json:"relay_id"`
+	StartedAt time.Time       `json:"started_at"`
+	StoppedAt *time.Time      `json:"stopped_at,omitempty"`
+	Files     []RecordingFile `json:"files"`
+}
+
+// RecordingFile is a media file of a recording
+type RecordingFile struct {
+	Path       string    `json:"path"`
+	VideoCodec string    `json:"video_codec,omitempty"`
+	AudioCodec string    `json:"audio_codec,omitempty"`
+	StartedAt  time.Time `json:"started_at"` // Wall clock time of media time zero, zero until media arrived
+}
+
+// Recorder writes the stream of a room to disk
+type Recorder struct {
+	Room *Room
+
+	mutex    sync.Mutex
+	dir      string
+	baseName string
+	info     RecordingInfo
+	audio    *webrtc.TrackLocalStaticRTP // Tapped room tracks
+	video    *webrtc.TrackLocalStaticRTP
+	segment  *recordingSegment
+	stopped  bool
+	stop     chan struct{}
+
+	packets chan recordedPacket // Tapped packets waiting to be written
+	dropped atomic.Uint64       // Packets dropped because writing fell behind
+}
+
+// recordedPacket is a tapped packet of a room track, for the segment that was current when it was tapped
+type recordedPacket struct {
+	segment *recordingSegment
+	track   *recordingTrack
+	packet  *rtp.Packet
+}
+
+// NewRecorder starts recording a room into given directory, as the relay with given ID
+func NewRecorder(room *Room, dir string, relayID string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	startedAt := time.Now().UTC()
+	r := &Recorder{
+		Room:     room,
+		dir:      dir,
+		baseName: recordingFileName(room.Name) + "-" + startedAt.Format("20060102-150405"),
+		info: RecordingInfo{
+			Room:      room.Name,
+			RelayID:   relayID,
+			StartedAt: startedAt,
+		},
+		stop:    make(chan struct{}),
+		packets: make(chan recordedPacket, recordingPacketBuffer),
+	}
+
+	r.mutex.Lock()
+	r.followTracks()
+	err := r.writeInfo()
+	r.mutex.Unlock()
+	if err != nil {
+		r.Stop()
+		return nil, err
+	}
+
+	go r.watchTracks()
+	go r.writePackets()
+	slog.Info("Started recording room", "room", room.Name, "path", r.infoPath())
+	return r, nil
+}
+
+// Path returns the path of the recording's JSON description
+func (r *Recorder) Path() string {
+	return r.infoPath()
+}
+
+// Stop finishes the recording, closing its files
+func (r *Recorder) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+	close(r.stop)
+
+	r.untap()
+	r.closeSegment()
+	stoppedAt := time.Now().UTC()
+	r.info.StoppedAt = &stoppedAt
+	if err := r.writeInfo(); err != nil {
+		slog.Error("Failed to write recording info", "room", r.Room.Name, "err", err)
+	}
+	slog.Info("Stopped recording room", "room", r.Room.Name, "path", r.infoPath(), "dropped_packets", r.dropped.Load())
+}
+
+// watchTracks follows room track replacements until the recording stops
+func (r *Recorder) watchTracks() {
+	ticker := time.NewTicker(recordingTrackCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.mutex.Lock()
+			if !r.stopped {
+				r.followTracks()
+			}
+			r.mutex.Unlock()
+		}
+	}
+}
+
+// followTracks taps the current room tracks, starting a new file when their codecs changed. mutex must be held
+func (r *Recorder) followTracks() {
+	audio := r.Room.GetTrack(webrtc.RTPCodecTypeAudio)
+	video := r.Room.GetTrack(webrtc.RTPCodecTypeVideo)
+	if audio == r.audio && video == r.video {
+		return
+	}
+
+	r.untap()
+	r.audio, r.video = audio, video
+	if audio == nil || video == nil {
+		// Room is offline, recording resumes once it's back
+		return
+	}
+
+	if r.segment == nil || !strings.EqualFold(r.segment.videoCodec, video.Codec().MimeType) ||
+		!strings.EqualFold(r.segment.audioCodec, audio.Codec().MimeType) {
+		r.closeSegment()
+		segment, err := r.newSegment(video.Codec(), audio.Codec())
+		if err != nil {
+			slog.Error("Failed to start recording file", "room", r.Room.Name, "err", err)
+			return
+		}
+		r.segment = segment
+		if err = r.writeInfo(); err != nil {
+			slog.Error("Failed to write recording info", "room", r.Room.Name, "err", err)
+		}
+	}
+
+	segment := r.segment
+	r.Room.writer.TapTrack(audio, r, func(packet *rtp.Packet) {
+		r.queuePacket(segment, segment.audio, packet)
+	})
+	r.Room.writer.TapTrack(video, r, func(packet *rtp.Packet) {
+		r.queuePacket(segment, segment.video, packet)
+	})
+	// Video can't be decoded before the next keyframe
+	r.Room.RequestKeyframe("")
+}
+
+// untap stops receiving packets of the tapped room tracks. mutex must be held
+func (r *Recorder) untap() {
+	if r.audio != nil {
+		r.Room.writer.UntapTrack(r.audio, r)
+	}
+	if r.video != nil {
+		r.Room.writer.UntapTrack(r.video, r)
+	}
+	r.audio, r.video = nil, nil
+}
+
+// queuePacket hands a tapped packet to the writing goroutine, dropping it if writing fell behind.
+// Called while forwarding the packet, so it must not block
+func (r *Recorder) queuePacket(segment *recordingSegment, track *recordingTrack, packet *rtp.Packet) {
+	// Packets are shared with the forwarded track
+	select {
+	case r.packets <- recordedPacket{segment: segment, track: track, packet: packet.Clone()}:
+	default:
+		if dropped := r.dropped.Add(1); dropped%recordingDropLogInterval == 1 {
+			slog.Warn("Recording falls behind, dropping packets", "room", r.Room.Name, "dropped_packets", dropped)
+		}
+	}
+}
+
+// writePackets records queued packets until the recording stops
+func (r *Recorder) writePackets() {
+	for {
+		select {
+		case <-r.stop:
+			return
+		case queued := <-r.packets:
+			r.handlePacket(queued.segment, queued.track, queued.packet)
+		}
+	}
+}
+
+// handlePacket records a packet of a room track
+func (r *Recorder) handlePacket(segment *recordingSegment, track *recordingTrack, packet *rtp.Packet) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped || segment != r.segment {
+		return
+	}
+	if err := segment.push(track, packet); err != nil {
+		slog.Error("Failed to record packet", "room", r.Room.Name, "err", err)
+	}
+}
+
+// newSegment creates the files of a recording for given codecs. mutex must be held
+func (r *Recorder) newSegment(video, audio webrtc.RTPCodecCapability) (*recordingSegment, error) {
+	name := r.baseName
+	if len(r.info.Files) > 0 {
+		name = fmt.Sprintf("%s-%d", name, len(r.info.Files)+1)
+	}
+	path := filepath.Join(r.dir, name+".mp4")
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording file: %w", err)
+	}
+
+	segment := &recordingSegment{
+		file:       file,
+		fileIndex:  len(r.info.Files),
+		info:       &r.info,
+		videoCodec: video.MimeType,
+		audioCodec: audio.MimeType,
+		audio:      newRecordingTrack(recordingAudioTrackID, audio),
+	}
+	r.info.Files = append(r.info.Files, RecordingFile{
+		Path:       filepath.Base(path),
+		VideoCodec: video.MimeType,
+		AudioCodec: audio.MimeType,
+	})
+
+	if strings.EqualFold(video.MimeType, webrtc.MimeTypeVP8) {
+		ivfPath := filepath.Join(r.dir, name+".ivf")
+		segment.ivf, err = ivfwriter.New(ivfPath, ivfwriter.WithCodec(video.MimeType))
+		if err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("failed to create VP8 recording file: %w", err)
+		}
+		r.info.Files = append(r.info.Files, RecordingFile{
+			Path:       filepath.Base(ivfPath),
+			VideoCodec: video.MimeType,
+		})
+		segment.ivfIndex = len(r.info.Files) - 1
+	} else {
+		segment.video = newRecordingTrack(recordingVideoTrackID, video)
+		if segment.video.builder == nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("recording video codec %s is not supported", video.MimeType)
+		}
+	}
+	if segment.audio.builder == nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("recording audio codec %s is not supported", audio.MimeType)
+	}
+	return segment, nil
+}
+
+// closeSegment writes out and closes the current files. mutex must be held
+func (r *Recorder) closeSegment() {
+	if r.segment == nil {
+		return
+	}
+	if err := r.segment.close(); err != nil {
+		slog.Error("Failed to finish recording file", "room", r.Room.Name, "err", err)
+	}
+	r.segment = nil
+}
+
+func (r *Recorder) infoPath() string {
+	return filepath.Join(r.dir, r.baseName+".json")
+}
+
+// writeInfo writes the recording description. mutex must be held
+func (r *Recorder) writeInfo() error {
+	data, err := json.MarshalIndent(r.info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal recording info: %w", err)
+	}
+	if err = os.WriteFile(r.infoPath(), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write recording info: %w", err)
+	}
+	return nil
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// recordingFileName makes a room name safe to use in file names
+func recordingFileName(roomName string) string {
+	return unsafeFileChars.ReplaceAllString(roomName, "_")
+}
+
+// --- Recording Files ---
+
+// recordingSegment is the fMP4 file, and IVF file for VP8, recording a pair of room codecs
+type recordingSegment struct {
+	file      *os.File
+	fileIndex int            // Index of the fMP4 file in info
+	info      *RecordingInfo // Updated once media time zero is known
+	ivf       *ivfwriter.IVFWriter
+	ivfIndex  int
+
+	videoCodec string
+	audioCodec string
+	video      *recordingTrack // nil when video goes to IVF
+	audio      *recordingTrack
+
+	initialized bool
+	startedAt   time.Time // Wall clock time of media time zero
+	sequence    uint32
+	partStart   time.Time // Wall clock time the current fragment started
+}
+
+// recordingTrack turns packets of a room track into fMP4 samples
+type recordingTrack struct {
+	id        int
+	mimeType  string
+	clockRate uint32
+	builder   *samplebuilder.SampleBuilder // nil for unsupported codecs
+	codec     fmp4.Codec                   // nil until the codec parameters are known
+
+	started bool
+	lastTS  uint32 // RTP timestamp of the latest sample
+	dts     uint64 // Decode time of the latest sample, in clock rate units since media time zero
+
+	pending    *fmp4.PartSample // Latest sample, waiting for the next one to know its duration
+	pendingDTS uint64
+	pendingAt  time.Time
+
+	samples   []*fmp4.PartSample // Samples of the current fragment
+	partDTS   uint64             // Decode time of the first sample of the current fragment
+	partStart time.Time          // When the first sample of the current fragment arrived
+}
+
+func newRecordingTrack(id int, codec webrtc.RTPCodecCapability) *recordingTrack {
+	track := &recordingTrack{
+		id:        id,
+		mimeType:  codec.MimeType,
+		clockRate: codec.ClockRate,
+	}
+	var depacketizer rtp.Depacketizer
+	switch strings.ToLower(codec.MimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		depacketizer = &codecs.H264Packet{}
+	case strings.ToLower(webrtc.MimeTypeH265):
+		depacketizer = &h265Depacketizer{}
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		depacketizer = &codecs.VP9Packet{}
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		depacketizer = &codecs.AV1Depacketizer{}
+	case strings.ToLower(webrtc.MimeTypeOpus):
+		depacketizer = &codecs.OpusPacket{}
+		track.codec = &fmp4.CodecOpus{ChannelCount: recordingOpusChannels}
+	default:
+		return track
+	}
+	track.builder = samplebuilder.New(recordingMaxLate, depacketizer, codec.ClockRate)
+	return track
+}
+
+// push records a packet of a track
+func (s *recordingSegment) push(track *recordingTrack, packet *rtp.Packet) error {
+	if track != nil {
+		track.builder.Push(packet)
+		for sample := track.builder.Pop(); sample != nil; sample = track.builder.Pop() {
+			if err := s.addSample(track, sample); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// VP8 video
+	if s.ivf == nil {
+		return nil
+	}
+	if !s.initialized {
+		if err := s.initialize(); err != nil {
+			return err
+		}
+	}
+	return s.ivf.WriteRTP(packet)
+}
+
+// addSample adds a depacketized sample to the current fragment of its track
+func (s *recordingSegment) addSample(track *recordingTrack, sample *media.Sample) error {
+	partSample, err := track.toPartSample(sample)
+	if err != nil || partSample == nil {
+		return err
+	}
+
+	if !s.initialized {
+		// Files start with decodable video, audio before it is dropped
+		if s.video != nil && (track != s.video || track.codec == nil || partSample.IsNonSyncSample) {
+			return nil
+		}
+		if err = s.initialize(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	if !track.started {
+		// Tracks start when their first sample arrived, relative to media time zero
+		track.started = true
+		track.lastTS = sample.PacketTimestamp
+		track.dts = uint64(now.Sub(s.startedAt).Seconds() * float64(track.clockRate))
+	} else {
+		if elapsed := int32(sample.PacketTimestamp - track.lastTS); elapsed > 0 {
+			track.dts += uint64(elapsed)
+		}
+		track.lastTS = sample.PacketTimestamp
+	}
+
+	if track.pending != nil {
+		track.pending.Duration = uint32(track.dts - track.pendingDTS)
+		track.appendSample(track.pending, track.pendingDTS, track.pendingAt)
+	}
+	track.pending = partSample
+	track.pendingDTS = track.dts
+	track.pendingAt = now
+
+	if now.Sub(s.partStart) >= recordingFragmentDuration {
+		return s.flush()
+	}
+	return nil
+}
+
+// appendSample adds a sample with known duration to the current fragment
+func (t *recordingTrack) appendSample(sample *fmp4.PartSample, dts uint64, receivedAt time.Time) {
+	if len(t.samples) == 0 {
+		t.partDTS = dts
+		t.partStart = receivedAt
+	}
+	t.samples = append(t.samples, sample)
+}
+
+// toPartSample converts a depacketized sample to a fMP4 sample, learning codec parameters from it.
+// Returns nil for samples that can't be recorded
+func (t *recordingTrack) toPartSample(sample *media.Sample) (*fmp4.PartSample, error) {
+	switch strings.ToLower(t.mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		au, err := h264.AnnexBUnmarshal(sample.Data)
+		if err != nil {
+			return nil, nil
+		}
+		var sps, pps []byte
+		for _, nalu := range au {
+			switch h264.NALUType(nalu[0] & 0x1f) {
+			case h264.NALUTypeSPS:
+				sps = nalu
+			case h264.NALUTypePPS:
+				pps = nalu
+			}
+		}
+		if t.codec == nil && sps != nil && pps != nil {
+			t.codec = &fmp4.CodecH264{SPS: sps, PPS: pps}
+		}
+		return fmp4.NewPartSampleH26x(0, h264.IDRPresent(au), au)
+	case strings.ToLower(webrtc.MimeTypeH265):
+		au, err := h264.AnnexBUnmarshal(sample.Data)
+		if err != nil {
+			return nil, nil
+		}
+		var vps, sps, pps []byte
+		for _, nalu := range au {
+			switch h265.NALUType((nalu[0] >> 1) & 0x3f) {
+			case h265.NALUType_VPS_NUT:
+				vps = nalu
+			case h265.NALUType_SPS_NUT:
+				sps = nalu
+			case h265.NALUType_PPS_NUT:
+				pps = nalu
+			}
+		}
+		if t.codec == nil && vps != nil && sps != nil && pps != nil {
+			t.codec = &fmp4.CodecH265{VPS: vps, SPS: sps, PPS: pps}
+		}
+		return fmp4.NewPartSampleH26x(0, h265.IsRandomAccess(au), au)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		var header vp9.Header
+		if err := header.Unmarshal(sample.Data); err != nil {
+			return nil, nil
+		}
+		keyframe := header.FrameType == vp9.FrameTypeKeyFrame
+		if t.codec == nil && keyframe && header.ColorConfig != nil {
+			t.codec = &fmp4.CodecVP9{
+				Width:             header.Width(),
+				Height:            header.Height(),
+				Profile:           header.Profile,
+				BitDepth:          header.ColorConfig.BitDepth,
+				ChromaSubsampling: header.ChromaSubsampling(),
+				ColorRange:        header.ColorConfig.ColorRange,
+			}
+		}
+		return &fmp4.PartSample{IsNonSyncSample: !keyframe, Payload: sample.Data}, nil
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		tu, err := av1.BitstreamUnmarshal(sample.Data, true)
+		if err != nil {
+			return nil, nil
+		}
+		var sequenceHeader []byte
+		for _, obu := range tu {
+			var header av1.OBUHeader
+			if err = header.Unmarshal(obu); err == nil && header.Type == av1.OBUTypeSequenceHeader {
+				sequenceHeader = obu
+			}
+		}
+		if t.codec == nil && sequenceHeader != nil {
+			t.codec = &fmp4.CodecAV1{SequenceHeader: sequenceHeader}
+		}
+		return fmp4.NewPartSampleAV1(sequenceHeader != nil, tu)
+	default:
+		return &fmp4.PartSample{Payload: sample.Data}, nil
+	}
+}
+
+// initialize writes the fMP4 header, once the codec parameters are known. Media time zero is now
+func (s *recordingSegment) initialize() error {
+	init := fmp4.Init{}
+	if s.video != nil {
+		init.Tracks = append(init.Tracks, &fmp4.InitTrack{ID: s.video.id, TimeScale: s.video.clockRate, Codec: s.video.codec})
+	}
+	init.Tracks = append(init.Tracks, &fmp4.InitTrack{ID: s.audio.id, TimeScale: s.audio.clockRate, Codec: s.audio.codec})
+
+	var buf seekablebuffer.Buffer
+	if err := init.Marshal(&buf); err != nil {
+		return fmt.Errorf("failed to marshal recording header: %w", err)
+	}
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write recording header: %w", err)
+	}
+
+	s.initialized = true
+	s.startedAt = time.Now()
+	s.partStart = s.startedAt
+	s.info.Files[s.fileIndex].StartedAt = s.startedAt.UTC()
+	if s.ivf != nil {
+		s.info.Files[s.ivfIndex].StartedAt = s.startedAt.UTC()
+	}
+	return nil
+}
+
+// flush writes the current fragment of all tracks
+func (s *recordingSegment) flush() error {
+	s.partStart = time.Now()
+	part := fmp4.Part{SequenceNumber: s.sequence}
+	var reference *recordingTrack
+	for _, track := range []*recordingTrack{s.video, s.audio} {
+		if track == nil || len(track.samples) == 0 {
+			continue
+		}
+		part.Tracks = append(part.Tracks, &fmp4.PartTrack{
+			ID:       track.id,
+			BaseTime: track.partDTS,
+			Samples:  track.samples,
+		})
+		if reference == nil {
+			reference = track
+		}
+	}
+	if reference == nil {
+		return nil
+	}
+	s.sequence++
+
+	var buf seekablebuffer.Buffer
+	if err := part.Marshal(&buf); err != nil {
+		return fmt.Errorf("failed to marshal recording fragment: %w", err)
+	}
+	// Wall clock time the first sample of the fragment arrived at
+	if _, err := s.file.Write(producerReferenceTime(reference.id, reference.partStart, reference.partDTS)); err != nil {
+		return fmt.Errorf("failed to write recording fragment time: %w", err)
+	}
+	if _, err := s.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write recording fragment: %w", err)
+	}
+
+	for _, track := range []*recordingTrack{s.video, s.audio} {
+		if track != nil {
+			track.samples = nil
+		}
+	}
+	return nil
+}
+
+// close writes out remaining samples and closes the files
+func (s *recordingSegment) close() error {
+	var errs []error
+	if s.initialized {
+		for _, track := range []*recordingTrack{s.video, s.audio} {
+			if track == nil || track.pending == nil {
+				continue
+			}
+			// Last sample lasts as long as the one before it, if known
+			if len(track.samples) > 0 {
+				track.pending.Duration = track.samples[len(track.samples)-1].Duration
+			}
+			track.appendSample(track.pending, track.pendingDTS, track.pendingAt)
+			track.pending = nil
+		}
+		errs = append(errs, s.flush())
+	}
+	if s.ivf != nil {
+		errs = append(errs, s.ivf.Close())
+	}
+	errs = append(errs, s.file.Close())
+	return errors.Join(errs...)
+}
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the Unix epoch (1970)
+const ntpEpochOffset = 2208988800
+
+// producerReferenceTime builds a prft box (ISO/IEC 14496-12), telling the wall clock time
+// at which media time of a track was received
+func producerReferenceTime(trackID int, wallClock time.Time, mediaTime uint64) []byte {
+	box := make([]byte, 32)
+	binary.BigEndian.PutUint32(box[0:], uint32(len(box)))
+	copy(box[4:], "prft")
+	box[8] = 1 // Version 1, 64 bit media time
+	binary.BigEndian.PutUint32(box[12:], uint32(trackID))
+	seconds := uint64(wallClock.Unix()) + ntpEpochOffset
+	fraction := uint64(wallClock.Nanosecond()) << 32 / uint64(time.Second)
+	binary.BigEndian.PutUint64(box[16:], seconds<<32|fraction)
+	binary.BigEndian.PutUint64(box[24:], mediaTime)
+	return box
+}
+
+// --- H.265 Depacketizer ---
+
+// h265Depacketizer turns H.265 RTP payloads (RFC 7798, without DONL) into Annex B NAL units
+type h265Depacketizer struct {
+	fragment []byte // NAL unit being reassembled from fragmentation units
+}
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+const (
+	h265AggregationPacket  = 48
+	h265FragmentationUnit  = 49
+	h265PayloadContentInfo = 50
+)
+
+func (d *h265Depacketizer) Unmarshal(payload []byte) ([]byte, error) {
+	if len(payload) < 3 {
+		return nil, errors.New("H.265 payload too short")
+	}
+
+	switch (payload[0] >> 1) & 0x3f {
+	case h265AggregationPacket:
+		var out []byte
+		for offset := 2; offset+2 <= len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[offset:]))
+			offset += 2
+			if offset+size > len(payload) {
+				return nil, errors.New("H.265 aggregation packet truncated")
+			}
+			out = append(out, annexBStartCode...)
+			out = append(out, payload[offset:offset+size]...)
+			offset += size
+		}
+		return out, nil
+	case h265FragmentationUnit:
+		fuHeader := payload[2]
+		if fuHeader&0x80 != 0 {
+			// Start of the NAL unit, its header gets the type of the fragments
+			d.fragment = append([]byte{payload[0]&0x81 | (fuHeader&0x3f)<<1, payload[1]}, payload[3:]...)
+		} else if d.fragment != nil {
+			d.fragment = append(d.fragment, payload[3:]...)
+		}
+		if fuHeader&0x40 == 0 || d.fragment == nil {
+			return nil, nil
+		}
+		out := append(append([]byte{}, annexBStartCode...), d.fragment...)
+		d.fragment = nil
+		return out, nil
+	case h265PayloadContentInfo:
+		return nil, nil
+	default:
+		return append(append([]byte{}, annexBStartCode...), payload...), nil
+	}
+}
+
+func (d *h265Depacketizer) IsPartitionHead(payload []byte) bool {
+	if len(payload) < 3 {
+		return false
+	}
+	if (payload[0]>>1)&0x3f == h265FragmentationUnit {
+		return payload[2]&0x80 != 0
+	}
+	return true
+}
+
+func (d *h265Depacketizer) IsPartitionTail(marker bool, _ []byte) bool {
+	return marker
+}
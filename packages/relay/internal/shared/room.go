@@ -1,58 +1,259 @@
 package shared
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"relay/internal/common"
 	"relay/internal/connections"
+	gen "relay/internal/proto"
+	"strings"
+	"sync"
 
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/oklog/ulid/v2"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
+	"google.golang.org/protobuf/proto"
 )
 
 type RoomInfo struct {
-	ID      ulid.ULID `json:"id"`
-	Name    string    `json:"name"`
-	OwnerID peer.ID   `json:"owner_id"`
+	ID        ulid.ULID `json:"id"`
+	Name      string    `json:"name"`
+	OwnerID   peer.ID   `json:"owner_id"`
+	Online    bool      `json:"online"`              // Only filled in for mesh state, use Room.IsOnline for local rooms
+	Version   uint64    `json:"version"`             // HLC timestamp of the owner's latest change to the room
+	Signature []byte    `json:"signature,omitempty"` // Owner's signature over the state, only filled in for mesh state
+
+	VideoCodec string `json:"video_codec,omitempty"` // MIME type of the video codec, only filled in for mesh state
+	AudioCodec string `json:"audio_codec,omitempty"` // MIME type of the audio codec, only filled in for mesh state
+}
+
+// ToProto converts RoomInfo to a mesh EntityState
+func (ri *RoomInfo) ToProto() *gen.EntityState {
+	return &gen.EntityState{
+		EntityType:   "room",
+		EntityId:     ri.Name,
+		Active:       ri.Online,
+		OwnerRelayId: ri.OwnerID.String(),
+		Version:      ri.Version,
+		Signature:    ri.Signature,
+		VideoCodec:   ri.VideoCodec,
+		AudioCodec:   ri.AudioCodec,
+	}
+}
+
+// RoomInfoFromProto converts a mesh EntityState of a room to RoomInfo
+func RoomInfoFromProto(entity *gen.EntityState) (RoomInfo, error) {
+	if entity.GetEntityType() != "room" {
+		return RoomInfo{}, fmt.Errorf("entity %s is not a room: %s", entity.GetEntityId(), entity.GetEntityType())
+	}
+	ownerID, err := peer.Decode(entity.GetOwnerRelayId())
+	if err != nil {
+		return RoomInfo{}, fmt.Errorf("invalid owner relay ID for room %s: %w", entity.GetEntityId(), err)
+	}
+	return RoomInfo{
+		Name:       entity.GetEntityId(),
+		OwnerID:    ownerID,
+		Online:     entity.GetActive(),
+		Version:    entity.GetVersion(),
+		Signature:  entity.GetSignature(),
+		VideoCodec: entity.GetVideoCodec(),
+		AudioCodec: entity.GetAudioCodec(),
+	}, nil
+}
+
+// signedBytes returns the deterministic encoding of the state covered by the owner's signature
+func (ri *RoomInfo) signedBytes() ([]byte, error) {
+	entity := ri.ToProto()
+	entity.Signature = nil
+	return proto.MarshalOptions{Deterministic: true}.Marshal(entity)
+}
+
+// Sign signs the room state with the owner relay's private key
+func (ri *RoomInfo) Sign(key crypto.PrivKey) error {
+	data, err := ri.signedBytes()
+	if err != nil {
+		return fmt.Errorf("failed to encode room state for signing: %w", err)
+	}
+	ri.Signature, err = key.Sign(data)
+	if err != nil {
+		return fmt.Errorf("failed to sign room state: %w", err)
+	}
+	return nil
+}
+
+// Verify checks that the room state was signed by its owner relay
+func (ri *RoomInfo) Verify() error {
+	if len(ri.Signature) == 0 {
+		return fmt.Errorf("room %s state is not signed", ri.Name)
+	}
+	pubKey, err := ri.OwnerID.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to extract public key of owner %s: %w", ri.OwnerID, err)
+	}
+	data, err := ri.signedBytes()
+	if err != nil {
+		return fmt.Errorf("failed to encode room state for verification: %w", err)
+	}
+	ok, err := pubKey.Verify(data, ri.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to verify room state signature: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("invalid signature for room %s state from owner %s", ri.Name, ri.OwnerID)
+	}
+	return nil
+}
+
+// Supersedes reports whether this room state wins over other state of the same room name.
+// Newer versions win, equal versions are settled by the owner relay ID so every relay picks the same owner
+func (ri *RoomInfo) Supersedes(other RoomInfo) bool {
+	if ri.Version != other.Version {
+		return ri.Version > other.Version
+	}
+	return ri.OwnerID > other.OwnerID
 }
 
 type Room struct {
-	RoomInfo
-	PeerConnection *webrtc.PeerConnection
-	AudioTrack     *webrtc.TrackLocalStaticRTP
-	VideoTrack     *webrtc.TrackLocalStaticRTP
-	DataChannel    *connections.NestriDataChannel
-	Participants   *common.SafeMap[ulid.ULID, *Participant]
+	ID           ulid.ULID
+	Name         string
+	Participants *common.SafeMap[ulid.ULID, *Participant]
+
+	writer common.TrackWriter // Writes packets forwarded to the local tracks of the room
+
+	stateMutex     sync.Mutex // Guards ownerID, version, peerConnection and dataChannel, written from gossip, push and stream goroutines
+	ownerID        peer.ID
+	version        uint64                         // HLC timestamp of our latest change to the room, 0 unless we own and pushed it
+	peerConnection *webrtc.PeerConnection         // Requested upstream stream of the room, nil if none
+	dataChannel    *connections.NestriDataChannel // DataChannel of the pushed stream of the room, nil if none
+
+	trackMutex        sync.Mutex // Guards audioTrack and videoTrack, use GetTrack and SetTrack
+	audioTrack        *webrtc.TrackLocalStaticRTP
+	videoTrack        *webrtc.TrackLocalStaticRTP
+	onOnlineChange    func(online bool)
+	onCodecChange     func()
+	onKeyframeRequest func(rid string)
+
+	videoLayers     *common.SafeMap[string, *VideoLayer]     // RID -> simulcast video layer, empty without simulcast
+	layerForwarders *common.SafeMap[string, *LayerForwarder] // receiver ID -> forwarder of the receiver's video layer
 }
 
-func NewRoom(name string, roomID ulid.ULID, ownerID peer.ID) *Room {
+func NewRoom(name string, roomID ulid.ULID, ownerID peer.ID, writer common.TrackWriter) *Room {
 	return &Room{
-		RoomInfo: RoomInfo{
-			ID:      roomID,
-			Name:    name,
-			OwnerID: ownerID,
-		},
-		Participants: common.NewSafeMap[ulid.ULID, *Participant](),
+		ID:              roomID,
+		Name:            name,
+		ownerID:         ownerID,
+		Participants:    common.NewSafeMap[ulid.ULID, *Participant](),
+		writer:          writer,
+		videoLayers:     common.NewSafeMap[string, *VideoLayer](),
+		layerForwarders: common.NewSafeMap[string, *LayerForwarder](),
+	}
+}
+
+// Info returns a snapshot of the room's ID, name, owner and version
+func (r *Room) Info() RoomInfo {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	return RoomInfo{
+		ID:      r.ID,
+		Name:    r.Name,
+		OwnerID: r.ownerID,
+		Version: r.version,
 	}
 }
 
+// GetOwnerID returns the ID of the relay owning the room
+func (r *Room) GetOwnerID() peer.ID {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	return r.ownerID
+}
+
+// SetOwnerID sets the relay owning the room, a new owner resets the version of our claim
+func (r *Room) SetOwnerID(ownerID peer.ID) {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	if r.ownerID != ownerID {
+		r.ownerID = ownerID
+		r.version = 0
+	}
+}
+
+// CompareAndSetOwnerID sets the relay owning the room only if it still is old. Returns whether it was set
+func (r *Room) CompareAndSetOwnerID(old, ownerID peer.ID) bool {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	if r.ownerID != old {
+		return false
+	}
+	if r.ownerID != ownerID {
+		r.ownerID = ownerID
+		r.version = 0
+	}
+	return true
+}
+
+// SetVersion versions the room state, only while the room is owned by ownerID. Returns whether it was set
+func (r *Room) SetVersion(ownerID peer.ID, version uint64) bool {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	if r.ownerID != ownerID {
+		return false
+	}
+	r.version = version
+	return true
+}
+
+// GetPeerConnection returns the PeerConnection of the room's requested upstream stream, nil if none
+func (r *Room) GetPeerConnection() *webrtc.PeerConnection {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	return r.peerConnection
+}
+
+// SetPeerConnection sets the PeerConnection of the room's requested upstream stream
+func (r *Room) SetPeerConnection(pc *webrtc.PeerConnection) {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	r.peerConnection = pc
+}
+
+// GetDataChannel returns the DataChannel of the room's pushed stream, nil if none
+func (r *Room) GetDataChannel() *connections.NestriDataChannel {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	return r.dataChannel
+}
+
+// SetDataChannel sets the DataChannel of the room's pushed stream
+func (r *Room) SetDataChannel(ndc *connections.NestriDataChannel) {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	r.dataChannel = ndc
+}
+
 // AddParticipant adds a Participant to a Room
 func (r *Room) AddParticipant(participant *Participant) {
 	slog.Debug("Adding participant to room", "participant", participant.ID, "room", r.Name)
+	participant.onKeyframeRequest = r.RequestKeyframe
 	r.Participants.Set(participant.ID, participant)
 }
 
-// Removes a Participant from a Room by participant's ID
-func (r *Room) removeParticipantByID(pID ulid.ULID) {
-	if _, ok := r.Participants.Get(pID); ok {
-		r.Participants.Delete(pID)
-	}
+// RemoveParticipantByID removes a Participant from a Room by participant's ID. Returns whether it was in the room
+func (r *Room) RemoveParticipantByID(pID ulid.ULID) bool {
+	_, removed := r.Participants.LoadAndDelete(pID)
+	r.RemoveLayerForwarder(pID.String())
+	return removed
 }
 
 // Removes all participants from a Room
 /*func (r *Room) removeAllParticipants() {
 	for id, participant := range r.Participants.Copy() {
-		if err := r.signalParticipantOffline(participant); err != nil {
+		if err := r.SignalParticipantOffline(participant); err != nil {
 			slog.Error("Failed to signal participant offline", "participant", participant.ID, "room", r.Name, "err", err)
 		}
 		r.Participants.Delete(id)
@@ -62,22 +263,100 @@ func (r *Room) removeParticipantByID(pID ulid.ULID) {
 
 // IsOnline checks if the room is online (has both audio and video tracks)
 func (r *Room) IsOnline() bool {
-	return r.AudioTrack != nil && r.VideoTrack != nil
+	r.trackMutex.Lock()
+	defer r.trackMutex.Unlock()
+	return r.isOnlineLocked()
+}
+
+// isOnlineLocked checks if the room is online, trackMutex must be held
+func (r *Room) isOnlineLocked() bool {
+	return r.audioTrack != nil && r.videoTrack != nil
+}
+
+// RegisterOnOnlineChange registers a callback for when the room goes online or offline
+func (r *Room) RegisterOnOnlineChange(callback func(online bool)) {
+	r.onOnlineChange = callback
+}
+
+// RegisterOnCodecChange registers a callback for when a track of an online room is replaced by one with another codec
+func (r *Room) RegisterOnCodecChange(callback func()) {
+	r.onCodecChange = callback
+}
+
+// TrackCodec returns the MIME type of the room track of given kind, empty without the track
+func (r *Room) TrackCodec(trackType webrtc.RTPCodecType) string {
+	if track := r.GetTrack(trackType); track != nil {
+		return track.Codec().MimeType
+	}
+	return ""
+}
+
+// RegisterOnKeyframeRequest registers a callback for receivers asking for a keyframe of the room video
+func (r *Room) RegisterOnKeyframeRequest(callback func(rid string)) {
+	r.onKeyframeRequest = callback
+}
+
+// RequestKeyframe asks for a keyframe of the room video upstream, of given simulcast layer or all layers if rid is empty
+func (r *Room) RequestKeyframe(rid string) {
+	if r.onKeyframeRequest != nil {
+		r.onKeyframeRequest(rid)
+	}
+}
+
+// GetTrack returns the room's local track of given kind
+func (r *Room) GetTrack(trackType webrtc.RTPCodecType) *webrtc.TrackLocalStaticRTP {
+	r.trackMutex.Lock()
+	defer r.trackMutex.Unlock()
+	return r.trackOf(trackType)
+}
+
+// trackOf returns the room track of given kind, trackMutex must be held
+func (r *Room) trackOf(trackType webrtc.RTPCodecType) *webrtc.TrackLocalStaticRTP {
+	switch trackType {
+	case webrtc.RTPCodecTypeAudio:
+		return r.audioTrack
+	case webrtc.RTPCodecTypeVideo:
+		return r.videoTrack
+	default:
+		return nil
+	}
 }
 
 func (r *Room) SetTrack(trackType webrtc.RTPCodecType, track *webrtc.TrackLocalStaticRTP) {
-	//oldOnline := r.IsOnline()
+	r.swapTrack(trackType, nil, track, false)
+}
+
+// compareAndSetTrack sets the room track of given kind only if it still is old. Returns whether it was set
+func (r *Room) compareAndSetTrack(trackType webrtc.RTPCodecType, old, track *webrtc.TrackLocalStaticRTP) bool {
+	return r.swapTrack(trackType, old, track, true)
+}
+
+// swapTrack sets the room track of given kind and signals participants of the change.
+// With compare set, the track is only set if the current one is old, checked under the same lock
+func (r *Room) swapTrack(trackType webrtc.RTPCodecType, old, track *webrtc.TrackLocalStaticRTP, compare bool) bool {
+	r.trackMutex.Lock()
+	if compare && r.trackOf(trackType) != old {
+		r.trackMutex.Unlock()
+		return false
+	}
+	oldOnline := r.isOnlineLocked()
+	oldCodec := ""
+	if oldTrack := r.trackOf(trackType); oldTrack != nil {
+		oldCodec = oldTrack.Codec().MimeType
+	}
 
 	switch trackType {
 	case webrtc.RTPCodecTypeAudio:
-		r.AudioTrack = track
+		r.audioTrack = track
 	case webrtc.RTPCodecTypeVideo:
-		r.VideoTrack = track
+		r.videoTrack = track
 	default:
 		slog.Warn("Unknown track type", "room", r.Name, "trackType", trackType)
 	}
 
-	/*newOnline := r.IsOnline()
+	newOnline := r.isOnlineLocked()
+	r.trackMutex.Unlock()
+
 	if oldOnline != newOnline {
 		if newOnline {
 			slog.Debug("Room online, participants will be signaled", "room", r.Name)
@@ -87,33 +366,50 @@ func (r *Room) SetTrack(trackType webrtc.RTPCodecType, track *webrtc.TrackLocalS
 			r.signalParticipantsOffline()
 		}
 
-		// TODO: Publish updated state to mesh
-		go func() {
-			if err := r.Relay.publishRoomStates(context.Background()); err != nil {
-				slog.Error("Failed to publish room states on change", "room", r.Name, "err", err)
-			}
-		}()
-	}*/
+		if r.onOnlineChange != nil {
+			go r.onOnlineChange(newOnline)
+		}
+	} else if newOnline && track != nil {
+		slog.Debug("Room track replaced, participants will be signaled", "room", r.Name, "trackType", trackType)
+		r.signalParticipantsWithTracks()
+		if !strings.EqualFold(oldCodec, track.Codec().MimeType) && r.onCodecChange != nil {
+			go r.onCodecChange()
+		}
+	}
+	return true
 }
 
-/* TODO: libp2p'ify
 func (r *Room) signalParticipantsWithTracks() {
 	for _, participant := range r.Participants.Copy() {
-		if err := r.signalParticipantWithTracks(participant); err != nil {
+		if err := r.SignalParticipantWithTracks(participant); err != nil {
 			slog.Error("Failed to signal participant with tracks", "participant", participant.ID, "room", r.Name, "err", err)
 		}
 	}
 }
 
-func (r *Room) signalParticipantWithTracks(participant *Participant) error {
-	if r.AudioTrack != nil {
-		if err := participant.addTrack(r.AudioTrack); err != nil {
-			return fmt.Errorf("failed to add audio track: %w", err)
+func (r *Room) signalParticipantsOffline() {
+	for _, participant := range r.Participants.Copy() {
+		if err := r.SignalParticipantOffline(participant); err != nil {
+			slog.Error("Failed to signal participant offline", "participant", participant.ID, "room", r.Name, "err", err)
+		}
+	}
+}
+
+// SignalParticipantWithTracks adds the room tracks to a participant and sends it an offer
+func (r *Room) SignalParticipantWithTracks(participant *Participant) error {
+	if audioTrack := r.GetTrack(webrtc.RTPCodecTypeAudio); audioTrack != nil {
+		if err := participant.setTrack(webrtc.RTPCodecTypeAudio, audioTrack); err != nil {
+			return fmt.Errorf("failed to set audio track: %w", err)
 		}
 	}
-	if r.VideoTrack != nil {
-		if err := participant.addTrack(r.VideoTrack); err != nil {
-			return fmt.Errorf("failed to add video track: %w", err)
+	if videoTrack := r.GetTrack(webrtc.RTPCodecTypeVideo); videoTrack != nil {
+		forwarder := r.LayerForwarder(participant.ID.String())
+		participant.layerForwarder.Store(forwarder)
+		if forwarder != nil {
+			videoTrack = forwarder.Track
+		}
+		if err := participant.setTrack(webrtc.RTPCodecTypeVideo, videoTrack); err != nil {
+			return fmt.Errorf("failed to set video track: %w", err)
 		}
 	}
 	if err := participant.signalOffer(); err != nil {
@@ -122,23 +418,116 @@ func (r *Room) signalParticipantWithTracks(participant *Participant) error {
 	return nil
 }
 
-func (r *Room) signalParticipantsOffline() {
-	for _, participant := range r.Participants.Copy() {
-		if err := r.signalParticipantOffline(participant); err != nil {
-			slog.Error("Failed to signal participant offline", "participant", participant.ID, "room", r.Name, "err", err)
+// SignalParticipantOffline signals a single participant that the room is offline
+func (r *Room) SignalParticipantOffline(participant *Participant) error {
+	// Skip if signaling stream is nil
+	if participant.SafeBRW == nil {
+		return nil
+	}
+	roomNameData, err := json.Marshal(r.Name)
+	if err != nil {
+		return fmt.Errorf("failed to marshal room name: %w", err)
+	}
+	return participant.SafeBRW.SendJSON(connections.NewMessageRaw("request-stream-offline", roomNameData))
+}
+
+// IsLayered checks if the room video is pushed as simulcast layers
+func (r *Room) IsLayered() bool {
+	return r.videoLayers.Len() > 0
+}
+
+// VideoLayers returns the room video layers, lowest bitrate first
+func (r *Room) VideoLayers() []*VideoLayer {
+	layers := make([]*VideoLayer, 0, r.videoLayers.Len())
+	for _, layer := range r.videoLayers.Copy() {
+		layers = append(layers, layer)
+	}
+	sortLayers(layers)
+	return layers
+}
+
+// GetVideoLayer returns the room video layer with given RID
+func (r *Room) GetVideoLayer(rid string) *VideoLayer {
+	if layer, ok := r.videoLayers.Get(rid); ok {
+		return layer
+	}
+	return nil
+}
+
+// SetVideoLayer sets the local track of a simulcast video layer, the first layer also serves as room video track
+func (r *Room) SetVideoLayer(rid string, track *webrtc.TrackLocalStaticRTP) *VideoLayer {
+	layer := &VideoLayer{RID: rid, Track: track}
+	r.videoLayers.Set(rid, layer)
+	if !r.compareAndSetTrack(webrtc.RTPCodecTypeVideo, nil, track) {
+		r.reselectLayers()
+	}
+	return layer
+}
+
+// RemoveVideoLayer removes a simulcast video layer, the room video track moves on to a remaining layer
+func (r *Room) RemoveVideoLayer(rid string) {
+	layer, ok := r.videoLayers.Get(rid)
+	if !ok {
+		return
+	}
+	r.videoLayers.Delete(rid)
+	r.writer.ForgetTrack(layer.Track)
+
+	var next *webrtc.TrackLocalStaticRTP
+	if layers := r.VideoLayers(); len(layers) > 0 {
+		next = layers[len(layers)-1].Track
+	}
+	r.compareAndSetTrack(webrtc.RTPCodecTypeVideo, layer.Track, next)
+	if r.videoLayers.Len() == 0 {
+		// Receivers get the plain room video track again
+		for _, id := range r.layerForwarders.Keys() {
+			r.RemoveLayerForwarder(id)
+		}
+		return
+	}
+	r.reselectLayers()
+}
+
+// ForwardVideoLayer forwards a packet of a video layer to receivers the layer is selected for
+func (r *Room) ForwardVideoLayer(rid string, packet *rtp.Packet) {
+	for id, forwarder := range r.layerForwarders.Copy() {
+		if err := forwarder.Forward(rid, packet); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			slog.Error("Failed to forward video layer to receiver", "room", r.Name, "receiver", id, "rid", rid, "err", err)
 		}
 	}
 }
 
-// signalParticipantOffline signals a single participant offline
-func (r *Room) signalParticipantOffline(participant *Participant) error {
-	// Skip if websocket is nil or closed
-	if participant.WebSocket == nil || participant.WebSocket.IsClosed() {
+// LayerForwarder returns the video layer forwarder of a receiver, creating it if needed.
+// Returns nil if the room video is not layered
+func (r *Room) LayerForwarder(receiverID string) *LayerForwarder {
+	videoTrack := r.GetTrack(webrtc.RTPCodecTypeVideo)
+	if !r.IsLayered() || videoTrack == nil {
 		return nil
 	}
-	if err := participant.WebSocket.SendAnswerMessageWS(connections.AnswerOffline); err != nil {
-		return err
+	if forwarder, ok := r.layerForwarders.Get(receiverID); ok {
+		return forwarder
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(videoTrack.Codec(), videoTrack.ID(), videoTrack.StreamID())
+	if err != nil {
+		slog.Error("Failed to create video track for receiver", "room", r.Name, "receiver", receiverID, "err", err)
+		return nil
+	}
+	forwarder := NewLayerForwarder(track, r.writer, r.VideoLayers, r.RequestKeyframe)
+	r.layerForwarders.Set(receiverID, forwarder)
+	return forwarder
+}
+
+// RemoveLayerForwarder removes the video layer forwarder of a receiver
+func (r *Room) RemoveLayerForwarder(receiverID string) {
+	if forwarder, ok := r.layerForwarders.Get(receiverID); ok {
+		r.layerForwarders.Delete(receiverID)
+		r.writer.ForgetTrack(forwarder.Track)
+	}
+}
+
+// reselectLayers selects layers for all receivers again, after the available layers changed
+func (r *Room) reselectLayers() {
+	for _, forwarder := range r.layerForwarders.Copy() {
+		forwarder.selectLayer(false)
 	}
-	return nil
 }
-*/
@@ -0,0 +1,24 @@
+package shared
+
+import "github.com/pion/rtcp"
+
+// HasTransportCC checks if receiver RTCP contains TWCC feedback
+func HasTransportCC(packets []rtcp.Packet) bool {
+	for _, packet := range packets {
+		if _, ok := packet.(*rtcp.TransportLayerCC); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HasKeyframeRequest checks if receiver RTCP asks for a keyframe, by PLI or FIR
+func HasKeyframeRequest(packets []rtcp.Packet) bool {
+	for _, packet := range packets {
+		switch packet.(type) {
+		case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+			return true
+		}
+	}
+	return false
+}
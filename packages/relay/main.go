@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -15,11 +17,11 @@ func main() {
 	mainCtx, mainStopper := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 
 	// Get flags and log them
-	common.InitFlags()
-	common.GetFlags().DebugLog()
+	flags := common.ParseFlags()
+	flags.DebugLog()
 
 	logLevel := slog.LevelInfo
-	if common.GetFlags().Verbose {
+	if flags.Verbose {
 		logLevel = slog.LevelDebug
 	}
 
@@ -31,15 +33,38 @@ func main() {
 	logger := slog.New(customHandler)
 	slog.SetDefault(logger)
 
+	config := core.ConfigFromFlags(flags)
+
+	// Only sign a mesh admission approval for another relay if requested
+	if len(flags.ApproveRelay) > 0 {
+		approval, err := core.ApproveRelay(config, flags.ApproveRelay)
+		if err != nil {
+			slog.Error("Failed to approve relay", "err", err)
+			return
+		}
+		approvalData, err := json.MarshalIndent(approval, "", "  ")
+		if err != nil {
+			slog.Error("Failed to marshal approval", "err", err)
+			return
+		}
+		fmt.Println(string(approvalData))
+		mainStopper()
+		return
+	}
+
 	// Start relay
-	err := core.InitRelay(mainCtx, mainStopper)
+	relay, err := core.NewRelay(mainCtx, config)
 	if err != nil {
 		slog.Error("Failed to initialize relay", "err", err)
 		mainStopper()
 		return
 	}
+	slog.Info("Relay initialized", "id", relay.ID)
 
 	// Wait for exit signal
 	<-mainCtx.Done()
 	slog.Info("Shutting down gracefully by signal...")
+	if err = relay.Close(); err != nil {
+		slog.Error("Failed to close relay", "err", err)
+	}
 }
@@ -256,6 +256,18 @@ pub fn encoder_cbr_params(encoder: &VideoEncoderInfo, bitrate: u32) -> VideoEnco
     })
 }
 
+/// Returns the name of the target bitrate property of an encoder element, which takes kbps like the parameters above
+pub fn encoder_bitrate_property(encoder: &gst::Element) -> Option<String> {
+    encoder
+        .list_properties()
+        .iter()
+        .map(|prop| prop.name().to_string())
+        .find(|prop| {
+            let pl = prop.to_lowercase();
+            pl.contains("bitrate") && !pl.contains("max")
+        })
+}
+
 pub fn encoder_gop_params(encoder: &VideoEncoderInfo, gop_size: u32) -> VideoEncoderInfo {
     modify_encoder_params(encoder, |prop| {
         let pl = prop.to_lowercase();
@@ -327,8 +327,13 @@ async fn main() -> Result<(), Box<dyn Error>> {
 
     /* Output */
     // WebRTC sink Element
-    let signaller =
-        NestriSignaller::new(args.app.room, p2p_conn.clone(), video_source.clone()).await?;
+    let signaller = NestriSignaller::new(
+        args.app.room,
+        p2p_conn.clone(),
+        video_source.clone(),
+        video_encoder.clone(),
+    )
+    .await?;
     let webrtcsink = BaseWebRTCSink::with_signaller(Signallable::from(signaller.clone()));
     webrtcsink.set_property_from_str("stun-server", "stun://stun.l.google.com:19302");
     webrtcsink.set_property_from_str("congestion-control", "disabled");
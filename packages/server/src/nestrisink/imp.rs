@@ -1,10 +1,11 @@
+use crate::enc_helper;
 use crate::messages::{MessageBase, MessageICE, MessageRaw, MessageSDP};
 use crate::p2p::p2p::NestriConnection;
 use crate::p2p::p2p_protocol_stream::NestriStreamProtocol;
 use crate::proto::proto::proto_input::InputType::{
     KeyDown, KeyUp, MouseKeyDown, MouseKeyUp, MouseMove, MouseMoveAbs, MouseWheel,
 };
-use crate::proto::proto::{ProtoInput, ProtoMessageInput};
+use crate::proto::proto::{ProtoInput, ProtoMessageBitrate, ProtoMessageInput};
 use atomic_refcell::AtomicRefCell;
 use glib::subclass::prelude::*;
 use gst::glib;
@@ -21,6 +22,7 @@ pub struct Signaller {
     stream_room: PLRwLock<Option<String>>,
     stream_protocol: PLRwLock<Option<Arc<NestriStreamProtocol>>>,
     wayland_src: PLRwLock<Option<Arc<gst::Element>>>,
+    video_encoder: PLRwLock<Option<gst::Element>>,
     data_channel: AtomicRefCell<Option<gst_webrtc::WebRTCDataChannel>>,
 }
 impl Default for Signaller {
@@ -29,6 +31,7 @@ impl Default for Signaller {
             stream_room: PLRwLock::new(None),
             stream_protocol: PLRwLock::new(None),
             wayland_src: PLRwLock::new(None),
+            video_encoder: PLRwLock::new(None),
             data_channel: AtomicRefCell::new(None),
         }
     }
@@ -59,6 +62,14 @@ impl Signaller {
         self.wayland_src.read().clone()
     }
 
+    pub fn set_video_encoder(&self, video_encoder: gst::Element) {
+        *self.video_encoder.write() = Some(video_encoder);
+    }
+
+    pub fn get_video_encoder(&self) -> Option<gst::Element> {
+        self.video_encoder.read().clone()
+    }
+
     pub fn set_data_channel(&self, data_channel: gst_webrtc::WebRTCDataChannel) {
         match self.data_channel.try_borrow_mut() {
             Ok(mut dc) => *dc = Some(data_channel),
@@ -141,6 +152,47 @@ impl Signaller {
                 }
             });
         }
+        {
+            stream_protocol.register_callback("push-stream-redirect", move |data| {
+                if let Ok(message) = serde_json::from_slice::<MessageRaw>(&data) {
+                    // Room is owned by another relay in the mesh, which refused to hand it over
+                    let relay_id = message.data["relay_id"].as_str().unwrap_or_default();
+                    let addrs = message.data["addrs"]
+                        .as_array()
+                        .map(|addrs| {
+                            addrs
+                                .iter()
+                                .filter_map(|addr| addr.as_str())
+                                .collect::<Vec<_>>()
+                                .join(", ")
+                        })
+                        .unwrap_or_default();
+                    gst::error!(
+                        gst::CAT_DEFAULT,
+                        "Room is owned by relay {}, push to it instead: {}",
+                        relay_id,
+                        addrs
+                    );
+                } else {
+                    gst::error!(gst::CAT_DEFAULT, "Failed to decode push redirect");
+                }
+            });
+        }
+        {
+            stream_protocol.register_callback("push-stream-error", move |data| {
+                if let Ok(message) = serde_json::from_slice::<MessageRaw>(&data) {
+                    // Relay refused the push, such as while another node pushes the room
+                    gst::error!(
+                        gst::CAT_DEFAULT,
+                        "Relay refused push to room {}: {}",
+                        message.data["room"].as_str().unwrap_or_default(),
+                        message.data["error"].as_str().unwrap_or_default()
+                    );
+                } else {
+                    gst::error!(gst::CAT_DEFAULT, "Failed to decode push error");
+                }
+            });
+        }
         {
             let self_obj = self.obj().clone();
             // After creating webrtcsink
@@ -169,7 +221,11 @@ impl Signaller {
                     if let Some(data_channel) = data_channel {
                         gst::info!(gst::CAT_DEFAULT, "Data channel created");
                         if let Some(wayland_src) = signaller.imp().get_wayland_src() {
-                            setup_data_channel(&data_channel, &*wayland_src);
+                            setup_data_channel(
+                                &data_channel,
+                                &*wayland_src,
+                                signaller.imp().get_video_encoder(),
+                            );
                             signaller.imp().set_data_channel(data_channel);
                         } else {
                             gst::error!(gst::CAT_DEFAULT, "Wayland display source not set");
@@ -303,13 +359,61 @@ impl ObjectImpl for Signaller {
     }
 }
 
-fn setup_data_channel(data_channel: &gst_webrtc::WebRTCDataChannel, wayland_src: &gst::Element) {
+/// Video encoder bitrate the relay may lower to what its receivers take, never above the configured one
+struct BitrateControl {
+    encoder: gst::Element,
+    property: String,
+    configured_kbps: u64,
+}
+
+impl BitrateControl {
+    fn new(encoder: gst::Element) -> Option<Self> {
+        let property = enc_helper::encoder_bitrate_property(&encoder)?;
+        let configured_kbps = encoder
+            .property_value(&property)
+            .transform::<u64>()
+            .ok()?
+            .get::<u64>()
+            .ok()?;
+        if configured_kbps == 0 {
+            return None;
+        }
+        Some(Self {
+            encoder,
+            property,
+            configured_kbps,
+        })
+    }
+
+    fn set_target_bitrate(&self, target_bitrate: u64) {
+        let kbps = (target_bitrate / 1000).clamp(1, self.configured_kbps);
+        tracing::debug!("Setting video encoder bitrate to {} kbps", kbps);
+        self.encoder
+            .set_property_from_str(&self.property, &kbps.to_string());
+    }
+}
+
+fn setup_data_channel(
+    data_channel: &gst_webrtc::WebRTCDataChannel,
+    wayland_src: &gst::Element,
+    video_encoder: Option<gst::Element>,
+) {
     let wayland_src = wayland_src.clone();
+    let bitrate_control = video_encoder.and_then(BitrateControl::new);
 
     data_channel.connect_on_message_data(move |_data_channel, data| {
         if let Some(data) = data {
+            // All messages share the base of ProtoMessageInput, decoding as one tells their type
             match ProtoMessageInput::decode(data.to_vec().as_slice()) {
                 Ok(message_input) => {
+                    let payload_type = message_input
+                        .message_base
+                        .as_ref()
+                        .map(|base| base.payload_type.as_str());
+                    if payload_type == Some("bitrate") {
+                        handle_bitrate_message(data.to_vec().as_slice(), bitrate_control.as_ref());
+                        return;
+                    }
                     if let Some(input_msg) = message_input.data {
                         // Process the input message and create an event
                         if let Some(event) = handle_input_message(input_msg) {
@@ -328,6 +432,18 @@ fn setup_data_channel(data_channel: &gst_webrtc::WebRTCDataChannel, wayland_src:
     });
 }
 
+fn handle_bitrate_message(data: &[u8], bitrate_control: Option<&BitrateControl>) {
+    let Some(bitrate_control) = bitrate_control else {
+        return;
+    };
+    match ProtoMessageBitrate::decode(data) {
+        Ok(message_bitrate) => bitrate_control.set_target_bitrate(message_bitrate.target_bitrate),
+        Err(e) => {
+            tracing::error!("Failed to decode MessageBitrate: {:?}", e);
+        }
+    }
+}
+
 fn handle_input_message(input_msg: ProtoInput) -> Option<gst::Event> {
     if let Some(input_type) = input_msg.input_type {
         match input_type {
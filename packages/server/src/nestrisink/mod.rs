@@ -15,11 +15,13 @@ impl NestriSignaller {
         room: String,
         nestri_conn: NestriConnection,
         wayland_src: Arc<gst::Element>,
+        video_encoder: gst::Element,
     ) -> Result<Self, Box<dyn std::error::Error>> {
         let obj: Self = glib::Object::new();
         obj.imp().set_stream_room(room);
         obj.imp().set_nestri_connection(nestri_conn).await?;
         obj.imp().set_wayland_src(wayland_src);
+        obj.imp().set_video_encoder(video_encoder);
         Ok(obj)
     }
 }
@@ -136,4 +136,13 @@ pub struct ProtoMessageInput {
     #[prost(message, optional, tag="2")]
     pub data: ::core::option::Option<ProtoInput>,
 }
+#[allow(clippy::derive_partial_eq_without_eq)]
+#[derive(Clone, PartialEq, ::prost::Message)]
+pub struct ProtoMessageBitrate {
+    #[prost(message, optional, tag="1")]
+    pub message_base: ::core::option::Option<ProtoMessageBase>,
+    /// Consolidated target bitrate of all receivers downstream, bits per second
+    #[prost(uint64, tag="3")]
+    pub target_bitrate: u64,
+}
 // @@protoc_insertion_point(module)